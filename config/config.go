@@ -1,29 +1,344 @@
 package config
 
-import "os"
+import (
+	"log"
+	"log/slog"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"ImageServer/models"
+	"ImageServer/utils"
+)
 
 type Config struct {
-	Path     string
-	Port     string
-	Username string
-	Password string
-	Domain   string
+	Path             string
+	CachePath        string
+	Port             string
+	Username         string
+	Password         string
+	AuthMode         string
+	APIKeys          []string
+	Domain           string
+	ConvertibleTypes models.ExtSlice
+	MaxUploadBytes   int64
+	MaxStorageBytes  int64
+	UploadFolders    []string
+	StripMetadata    bool
+	ConvertOnUpload  bool
+	LogLevel         slog.Level
+	RateLimitRPS     float64
+	RateLimitBurst   int
+	CORS             CORSConfig
+
+	// TrustedProxies are the addresses or CIDR ranges whose
+	// X-Forwarded-For header is believed when working out the client IP.
+	// None are trusted by default.
+	TrustedProxies []string
+
+	// MaxConversions bounds how many variants are generated at once;
+	// ConversionWait is how long a request queues for a slot.
+	MaxConversions int
+	ConversionWait time.Duration
+
+	// MaxPixels is the largest width × height decoded, for uploads and
+	// variants alike; 0 disables the check.
+	MaxPixels int64
+
+	// FindExtensions are appended in order to image paths that do not
+	// exist, so /a/b serves a/b.png.
+	FindExtensions models.ExtSlice
+
+	// CacheMaxBytes bounds the size of the variant cache; the least
+	// recently used variants are evicted every CacheSweepInterval once it is
+	// exceeded. 0 lets the cache grow without limit.
+	CacheMaxBytes      int64
+	CacheSweepInterval time.Duration
+
+	// VariantTTL is how long a cached variant is served before it is
+	// generated again from the original; 0 keeps variants forever.
+	VariantTTL time.Duration
+
+	// DecodedCacheBytes bounds the memory used to keep decoded originals
+	// between variant generations; 0 disables the cache.
+	DecodedCacheBytes int64
+
+	// Interpolator names the scaler variants use unless a request picks
+	// one with interp.
+	Interpolator string
+
+	// ProgressiveJPEG writes JPEG variants as progressive scans unless a
+	// request sets progressive=false.
+	ProgressiveJPEG bool
+
+	// AutoFormat serves WebP to clients that accept it when a request does
+	// not name a format.
+	AutoFormat bool
+
+	// DefaultMaxDimension caps the size of originals served without an
+	// explicit variant; 0 disables the cap.
+	DefaultMaxDimension int
+
+	// FallbackImage is served for missing images requested with
+	// fallback=true; a transparent pixel is used when unset.
+	FallbackImage string
+
+	// WatermarkPath is the image drawn by the watermark variant; the
+	// variant is rejected when unset.
+	WatermarkPath string
+
+	// ShutdownTimeout is how long in-flight requests may take to finish
+	// after SIGINT or SIGTERM.
+	ShutdownTimeout time.Duration
+
+	// Server timeouts guarding against slow clients
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// ConversionTimeout bounds how long a request waits for its variant
+	// to be generated.
+	ConversionTimeout time.Duration
+
+	// StorageBackend selects where originals are kept: "local" stores them
+	// below Path, "s3" in the bucket described by S3 and "memory" nowhere
+	// persistent.
+	StorageBackend string
+	S3             S3Config
+
+	// SigningKey is the HMAC key for signed URLs. With SignedURLsRequired
+	// set, images are only served through unexpired signed URLs.
+	SigningKey         string
+	SignedURLsRequired bool
+
+	// UploadSessionPath holds resumable uploads until they complete;
+	// sessions untouched for UploadSessionTTL are discarded. At most
+	// MaxUploadSessions may be open at once.
+	UploadSessionPath string
+	UploadSessionTTL  time.Duration
+	MaxUploadSessions int
+
+	// UsageCacheTTL is how long a computed storage usage figure is reused.
+	UsageCacheTTL time.Duration
+
+	// FetchTimeout bounds downloading a remote image, redirects included.
+	FetchTimeout time.Duration
+
+	// FolderTokens maps a folder prefix to the token required to fetch
+	// images below it. Folders without a token stay public.
+	FolderTokens map[string]string
+}
+
+type S3Config struct {
+	Endpoint  string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Region    string
+	UseSSL    bool
+	// Prefix is prepended to every object key, e.g. "images/"
+	Prefix string
+}
+
+type CORSConfig struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
 }
 
 func Load() *Config {
+	fileValues = nil
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		fileValues = loadFile(path)
+	}
+
 	cfg := &Config{
-		Path:     getEnv("DATA_PATH", "./data"),
-		Port:     getEnv("PORT", "5000"),
-		Username: getEnv("SERVER_USERNAME", "user"),
-		Password: getEnv("SERVER_PASSWORD", "test123"),
-		Domain:   getEnv("IMAGE_SERVER_DOMAIN", "http://localhost:5000"),
+		Path:             getEnv("DATA_PATH", "./data"),
+		CachePath:        getEnv("CACHE_PATH", "./cache"),
+		Port:             getEnv("PORT", "5000"),
+		Username:         getEnv("SERVER_USERNAME", "user"),
+		Password:         getEnv("SERVER_PASSWORD", "test123"),
+		AuthMode:         getEnv("AUTH_MODE", "basic"),
+		APIKeys:          getEnvList("API_KEY"),
+		Domain:           getEnv("IMAGE_SERVER_DOMAIN", "http://localhost:5000"),
+		ConvertibleTypes: getEnvExtSlice("CONVERTIBLE_TYPES", models.ConverableTypes),
+		MaxUploadBytes:   getEnvInt64("MAX_UPLOAD_BYTES", 20<<20),
+		MaxStorageBytes:  getEnvInt64("MAX_STORAGE_BYTES", 0),
+		UploadFolders:    getEnvList("UPLOAD_ALLOWED_FOLDERS"),
+		StripMetadata:    getEnvBool("STRIP_METADATA", true),
+		ConvertOnUpload:  getEnvBool("CONVERT_ON_UPLOAD", false),
+		LogLevel:         getEnvLogLevel("LOG_LEVEL", slog.LevelInfo),
+		RateLimitRPS:     getEnvFloat("RATE_LIMIT_RPS", 0),
+		RateLimitBurst:   int(getEnvInt64("RATE_LIMIT_BURST", 10)),
+		TrustedProxies:   getEnvList("TRUSTED_PROXIES"),
+		CORS: CORSConfig{
+			AllowedOrigins:   getEnvList("CORS_ALLOWED_ORIGINS"),
+			AllowedMethods:   getEnvListDefault("CORS_ALLOWED_METHODS", []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}),
+			AllowedHeaders:   getEnvListDefault("CORS_ALLOWED_HEADERS", []string{"Authorization", "Content-Type", "X-Request-ID"}),
+			AllowCredentials: getEnvBool("CORS_ALLOW_CREDENTIALS", false),
+		},
+		MaxConversions: int(getEnvInt64("MAX_CONCURRENT_CONVERSIONS", int64(runtime.NumCPU()))),
+		ConversionWait: getEnvDuration("CONVERSION_WAIT_TIMEOUT", 10*time.Second),
+
+		DefaultMaxDimension: int(getEnvInt64("DEFAULT_MAX_DIMENSION", 0)),
+		Interpolator:        getEnv("SCALE_INTERPOLATOR", "catmullrom"),
+		ProgressiveJPEG:     getEnvBool("PROGRESSIVE_JPEG", false),
+		AutoFormat:          getEnvBool("AUTO_FORMAT", false),
+		DecodedCacheBytes:   getEnvInt64("DECODED_CACHE_BYTES", 64<<20),
+		CacheMaxBytes:       getEnvInt64("CACHE_MAX_BYTES", 0),
+		CacheSweepInterval:  getEnvDuration("CACHE_SWEEP_INTERVAL", 10*time.Minute),
+		VariantTTL:          getEnvDuration("VARIANT_TTL", 0),
+		FindExtensions:      getEnvExtSlice("FIND_EXTENSIONS", utils.FindExtensions),
+		MaxPixels:           getEnvInt64("MAX_PIXELS", 100_000_000),
+		FallbackImage:       getEnv("FALLBACK_IMAGE", ""),
+		WatermarkPath:       getEnv("WATERMARK_PATH", ""),
+		ShutdownTimeout:     getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+
+		ReadHeaderTimeout: getEnvDuration("READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       getEnvDuration("READ_TIMEOUT", 60*time.Second),
+		WriteTimeout:      getEnvDuration("WRITE_TIMEOUT", 60*time.Second),
+		IdleTimeout:       getEnvDuration("IDLE_TIMEOUT", 120*time.Second),
+		ConversionTimeout: getEnvDuration("CONVERSION_TIMEOUT", 30*time.Second),
+
+		StorageBackend: getEnv("STORAGE_BACKEND", "local"),
+		S3: S3Config{
+			Endpoint:  getEnv("S3_ENDPOINT", ""),
+			Bucket:    getEnv("S3_BUCKET", ""),
+			AccessKey: getEnv("S3_ACCESS_KEY", ""),
+			SecretKey: getEnv("S3_SECRET_KEY", ""),
+			Region:    getEnv("S3_REGION", ""),
+			UseSSL:    getEnvBool("S3_USE_SSL", true),
+			Prefix:    getEnv("S3_PREFIX", ""),
+		},
+
+		SigningKey:         getEnv("SIGNING_KEY", ""),
+		SignedURLsRequired: getEnvBool("SIGNED_URLS_REQUIRED", false),
+		FolderTokens:       getEnvMap("FOLDER_TOKENS"),
+		FetchTimeout:       getEnvDuration("FETCH_TIMEOUT", 15*time.Second),
+		UsageCacheTTL:      getEnvDuration("USAGE_CACHE_TTL", time.Minute),
+		UploadSessionPath:  getEnv("UPLOAD_SESSION_PATH", "./uploads"),
+		UploadSessionTTL:   getEnvDuration("UPLOAD_SESSION_TTL", 24*time.Hour),
+		MaxUploadSessions:  int(getEnvInt64("MAX_UPLOAD_SESSIONS", 100)),
 	}
+
 	return cfg
 }
 
 func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
+	if value := lookup(key); value != "" {
 		return value
 	}
 	return defaultValue
 }
+
+func getEnvInt64(key string, defaultValue int64) int64 {
+	value := lookup(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s: %s\n", key, value)
+	}
+	return n
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := lookup(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %s\n", key, value)
+	}
+	return d
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	value := lookup(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s: %s\n", key, value)
+	}
+	return f
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	value := lookup(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %s\n", key, value)
+	}
+	return b
+}
+
+// getEnvLogLevel reads a level name such as "debug", "info", "warn" or "error".
+func getEnvLogLevel(key string, defaultValue slog.Level) slog.Level {
+	value := lookup(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		log.Fatalf("Invalid %s: %s\n", key, value)
+	}
+	return level
+}
+
+// getEnvList reads a comma-separated list, skipping empty entries.
+func getEnvList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(lookup(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getEnvMap reads comma-separated key=value pairs, e.g. "a=1,b=2".
+func getEnvMap(key string) map[string]string {
+	m := map[string]string{}
+	for _, item := range getEnvList(key) {
+		k, v, ok := strings.Cut(item, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" || v == "" {
+			log.Fatalf("Invalid %s entry: %s\n", key, item)
+		}
+		m[k] = v
+	}
+	return m
+}
+
+func getEnvListDefault(key string, defaultValue []string) []string {
+	if list := getEnvList(key); len(list) > 0 {
+		return list
+	}
+	return defaultValue
+}
+
+// getEnvExtSlice reads a comma-separated list of extensions, e.g. "png,jpg".
+func getEnvExtSlice(key string, defaultValue models.ExtSlice) models.ExtSlice {
+	value := lookup(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	return models.ParseExtSlice(value)
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+)
+
+// fileValues holds the settings read from CONFIG_FILE, keyed by the name of
+// the environment variable they stand in for.
+var fileValues map[string]string
+
+// loadFile reads a YAML or JSON config file whose keys are the environment
+// variable names, e.g.
+//
+//	DATA_PATH: /var/lib/images
+//	API_KEY: [key1, key2]
+//	FOLDER_TOKENS: {tenant-a: token1}
+//
+// Lists are joined with commas and maps become comma-separated key=value
+// pairs, matching the env var format.
+func loadFile(path string) map[string]string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Cannot read CONFIG_FILE %s: %v\n", path, err)
+	}
+
+	var raw map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		// Numbers stay as written rather than becoming float64
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err = dec.Decode(&raw)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	default:
+		log.Fatalf("CONFIG_FILE must be .yaml, .yml or .json: %s\n", path)
+	}
+	if err != nil {
+		log.Fatalf("Invalid CONFIG_FILE %s: %v\n", path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for key, value := range raw {
+		if list, ok := value.([]any); ok {
+			items := make([]string, len(list))
+			for i, item := range list {
+				items[i] = formatValue(item)
+			}
+			value = strings.Join(items, ",")
+		}
+		if m, ok := value.(map[string]any); ok {
+			pairs := make([]string, 0, len(m))
+			for k, v := range m {
+				pairs = append(pairs, k+"="+formatValue(v))
+			}
+			sort.Strings(pairs)
+			value = strings.Join(pairs, ",")
+		}
+		values[strings.ToUpper(key)] = formatValue(value)
+	}
+	return values
+}
+
+// formatValue renders a scalar from the config file the way it would be
+// written in an env var. Floats are printed without exponents, so a YAML
+// 20971520.0 still parses as an integer setting.
+func formatValue(value any) string {
+	if f, ok := value.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+// lookup returns the environment variable key, falling back to the config
+// file. The environment always takes precedence.
+func lookup(key string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fileValues[key]
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    map[string]string
+	}{
+		{
+			name:    "json integers",
+			file:    "config.json",
+			content: `{"PORT": 5000, "MAX_STORAGE_BYTES": 20971520, "RATE_LIMIT_RPS": 2.5}`,
+			want:    map[string]string{"PORT": "5000", "MAX_STORAGE_BYTES": "20971520", "RATE_LIMIT_RPS": "2.5"},
+		},
+		{
+			name:    "json lists and maps",
+			file:    "config.json",
+			content: `{"api_key": ["k1", "k2"], "FOLDER_TOKENS": {"b": "t2", "a": 7}, "STRIP_METADATA": false}`,
+			want:    map[string]string{"API_KEY": "k1,k2", "FOLDER_TOKENS": "a=7,b=t2", "STRIP_METADATA": "false"},
+		},
+		{
+			name:    "yaml",
+			file:    "config.yaml",
+			content: "PORT: 5000\nMAX_STORAGE_BYTES: 20971520.0\nAPI_KEY: [k1, k2]\nFOLDER_TOKENS: {a: t1}\n",
+			want:    map[string]string{"PORT": "5000", "MAX_STORAGE_BYTES": "20971520", "API_KEY": "k1,k2", "FOLDER_TOKENS": "a=t1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			got := loadFile(path)
+			if len(got) != len(tt.want) {
+				t.Errorf("loaded %d values, want %d: %v", len(got), len(tt.want), got)
+			}
+			for key, want := range tt.want {
+				if got[key] != want {
+					t.Errorf("%s = %q, want %q", key, got[key], want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	content := `{"PORT": 6000, "MAX_STORAGE_BYTES": 20971520, "SERVER_USERNAME": "file-user"}`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("SERVER_USERNAME", "env-user")
+	// Empty variables count as unset
+	for _, key := range []string{"PORT", "MAX_STORAGE_BYTES", "SERVER_PASSWORD"} {
+		t.Setenv(key, "")
+	}
+
+	cfg := Load()
+	if cfg.Port != "6000" {
+		t.Errorf("Port = %q, want 6000 from the file", cfg.Port)
+	}
+	if cfg.MaxStorageBytes != 20971520 {
+		t.Errorf("MaxStorageBytes = %d, want 20971520 from the file", cfg.MaxStorageBytes)
+	}
+	if cfg.Username != "env-user" {
+		t.Errorf("Username = %q, want env-user from the environment", cfg.Username)
+	}
+	if cfg.Password != "test123" {
+		t.Errorf("Password = %q, want the default test123", cfg.Password)
+	}
+}
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"ImageServer/models"
+	"ImageServer/utils"
+)
+
+// Validate reports every problem with the configuration at once so the
+// server can refuse to start instead of failing on individual requests. The
+// cache and upload session directories, and the data directory of the local
+// backend, are created if missing and must be writable.
+func (cfg *Config) Validate() error {
+	var errs []error
+
+	if port, err := strconv.Atoi(cfg.Port); err != nil || port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("PORT must be a number from 1 to 65535: %q", cfg.Port))
+	}
+
+	if u, err := url.Parse(cfg.Domain); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("IMAGE_SERVER_DOMAIN must be an absolute http(s) URL: %q", cfg.Domain))
+	}
+
+	switch cfg.StorageBackend {
+	case "local":
+		if err := checkWritable(cfg.Path); err != nil {
+			errs = append(errs, fmt.Errorf("DATA_PATH is not writable: %w", err))
+		}
+	case "memory":
+	case "s3":
+		if cfg.S3.Endpoint == "" || cfg.S3.Bucket == "" {
+			errs = append(errs, errors.New("STORAGE_BACKEND=s3 requires S3_ENDPOINT and S3_BUCKET"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("Invalid STORAGE_BACKEND: %s", cfg.StorageBackend))
+	}
+	if err := checkWritable(cfg.CachePath); err != nil {
+		errs = append(errs, fmt.Errorf("CACHE_PATH is not writable: %w", err))
+	}
+	if err := checkWritable(cfg.UploadSessionPath); err != nil {
+		errs = append(errs, fmt.Errorf("UPLOAD_SESSION_PATH is not writable: %w", err))
+	}
+
+	for _, ext := range cfg.ConvertibleTypes {
+		if !models.SupportedTypes.Has(ext) {
+			errs = append(errs, fmt.Errorf("CONVERTIBLE_TYPES contains unsupported format: %s", ext))
+		} else if !utils.CanEncode(ext) {
+			errs = append(errs, fmt.Errorf("CONVERTIBLE_TYPES contains a format that cannot be converted: %s", ext))
+		}
+	}
+
+	for _, ext := range cfg.FindExtensions {
+		if !models.SupportedTypes.Has(ext) {
+			errs = append(errs, fmt.Errorf("FIND_EXTENSIONS contains unsupported format: %s", ext))
+		}
+	}
+
+	switch cfg.AuthMode {
+	case "basic":
+	case "bearer":
+		if len(cfg.APIKeys) == 0 {
+			errs = append(errs, errors.New("AUTH_MODE=bearer requires API_KEY"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("Invalid AUTH_MODE: %s", cfg.AuthMode))
+	}
+
+	for _, proxy := range cfg.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			errs = append(errs, fmt.Errorf("TRUSTED_PROXIES contains an invalid address: %s", proxy))
+		}
+	}
+
+	if cfg.SignedURLsRequired && cfg.SigningKey == "" {
+		errs = append(errs, errors.New("SIGNED_URLS_REQUIRED requires SIGNING_KEY"))
+	}
+
+	if _, ok := utils.Interpolators[cfg.Interpolator]; !ok {
+		errs = append(errs, fmt.Errorf("Invalid SCALE_INTERPOLATOR: %s", cfg.Interpolator))
+	}
+
+	if cfg.MaxConversions < 1 {
+		errs = append(errs, errors.New("MAX_CONCURRENT_CONVERSIONS must be at least 1"))
+	}
+
+	if cfg.MaxUploadSessions < 1 {
+		errs = append(errs, errors.New("MAX_UPLOAD_SESSIONS must be at least 1"))
+	}
+
+	if cfg.VariantTTL < 0 {
+		errs = append(errs, errors.New("VARIANT_TTL must not be negative"))
+	}
+
+	if cfg.CacheMaxBytes < 0 {
+		errs = append(errs, errors.New("CACHE_MAX_BYTES must not be negative"))
+	}
+	if cfg.CacheMaxBytes > 0 && cfg.CacheSweepInterval <= 0 {
+		errs = append(errs, errors.New("CACHE_SWEEP_INTERVAL must be positive"))
+	}
+	// Evicting or purging variants from a cache that holds the originals
+	// would delete them
+	if cfg.StorageBackend == "local" && overlaps(cfg.Path, cfg.CachePath) {
+		errs = append(errs, errors.New("CACHE_PATH and DATA_PATH must not contain each other"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// overlaps reports whether one of two directories is, or lies inside, the
+// other.
+func overlaps(a, b string) bool {
+	a, errA := filepath.Abs(a)
+	b, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return true
+	}
+	within := func(dir, parent string) bool {
+		rel, err := filepath.Rel(parent, dir)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+	return within(a, b) || within(b, a)
+}
+
+// checkWritable creates dir if needed and makes sure files can be written
+// in it.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, ".validate-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
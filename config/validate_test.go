@@ -0,0 +1,98 @@
+package config
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"ImageServer/models"
+)
+
+func TestValidateCacheOverlap(t *testing.T) {
+	tests := []struct {
+		name      string
+		backend   string
+		data      string
+		cache     string
+		cacheMax  int64
+		wantError bool
+	}{
+		{name: "separate", backend: "local", data: "data", cache: "cache"},
+		{name: "same directory", backend: "local", data: "data", cache: "data", wantError: true},
+		{name: "cache inside data", backend: "local", data: "data", cache: "data/cache", wantError: true},
+		{name: "data inside cache", backend: "local", data: "cache/data", cache: "cache", wantError: true},
+		{name: "overlap with budget", backend: "local", data: "data", cache: "data/cache", cacheMax: 1 << 20, wantError: true},
+		{name: "similar prefix", backend: "local", data: "data", cache: "data-cache"},
+		{name: "memory backend", backend: "memory", data: "data", cache: "data/cache"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := validConfig(dir)
+			cfg.Path = filepath.Join(dir, tt.data)
+			cfg.CachePath = filepath.Join(dir, tt.cache)
+			cfg.StorageBackend = tt.backend
+			cfg.CacheMaxBytes = tt.cacheMax
+
+			err := cfg.Validate()
+			gotError := err != nil && strings.Contains(err.Error(), "CACHE_PATH and DATA_PATH")
+			if gotError != tt.wantError {
+				t.Errorf("Validate() = %v, want overlap error %v", err, tt.wantError)
+			}
+			if err != nil && !gotError {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateConvertibleTypes(t *testing.T) {
+	tests := []struct {
+		name      string
+		types     models.ExtSlice
+		wantError string
+	}{
+		{name: "default", types: models.ConverableTypes},
+		{name: "avif", types: models.ExtSlice{"png", "avif"}, wantError: "cannot be converted: avif"},
+		{name: "svg", types: models.ExtSlice{"svg"}, wantError: "cannot be converted: svg"},
+		{name: "unknown", types: models.ExtSlice{"bmp"}, wantError: "unsupported format: bmp"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig(t.TempDir())
+			cfg.ConvertibleTypes = tt.types
+
+			err := cfg.Validate()
+			if tt.wantError == "" {
+				if err != nil {
+					t.Errorf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Errorf("Validate() = %v, want %q", err, tt.wantError)
+			}
+		})
+	}
+}
+
+// validConfig returns a configuration that passes Validate, keeping its
+// directories below dir.
+func validConfig(dir string) *Config {
+	return &Config{
+		Path:               filepath.Join(dir, "data"),
+		CachePath:          filepath.Join(dir, "cache"),
+		UploadSessionPath:  filepath.Join(dir, "uploads"),
+		Port:               "5000",
+		Domain:             "http://localhost:5000",
+		AuthMode:           "basic",
+		Interpolator:       "catmullrom",
+		MaxConversions:     1,
+		MaxUploadSessions:  1,
+		StorageBackend:     "local",
+		CacheSweepInterval: time.Minute,
+	}
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// folderToken returns the token protecting the image name. When several
+// configured prefixes match, the longest one wins so a subfolder can have a
+// token of its own. An empty prefix protects every image.
+func (h *ImageHandler) folderToken(name string) (string, bool) {
+	var token, match string
+	found := false
+	for prefix, t := range h.config.FolderTokens {
+		prefix = strings.Trim(prefix, "/")
+		if prefix != "" && name != prefix && !strings.HasPrefix(name, prefix+"/") {
+			continue
+		}
+		if !found || len(prefix) > len(match) {
+			token, match, found = t, prefix, true
+		}
+	}
+	return token, found
+}
+
+// checkFolderToken rejects the request with 403 unless it carries the token
+// of the folder name is in, either in the X-Access-Token header or the token
+// query parameter.
+func (h *ImageHandler) checkFolderToken(c *gin.Context, name string) bool {
+	expected, _ := h.folderToken(name)
+
+	token := c.GetHeader("X-Access-Token")
+	if token == "" {
+		token = c.Query("token")
+	}
+
+	if token == "" {
+		respondError(c, http.StatusForbidden, CodeAccessDenied, "Access token required")
+		return false
+	}
+
+	// Hashes are compared so neither the content nor the length of the
+	// expected token leaks through timing
+	got, want := sha256.Sum256([]byte(token)), sha256.Sum256([]byte(expected))
+	if subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+		h.logger.Info("Rejected access token", "path", name)
+		respondError(c, http.StatusForbidden, CodeAccessDenied, "Invalid access token")
+		return false
+	}
+	return true
+}
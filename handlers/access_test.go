@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+	"testing/fstest"
+
+	"ImageServer/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestFolderToken(t *testing.T) {
+	tokens := map[string]string{
+		"private":        "secret",
+		"/private/inner": "inner",
+		"team/":          "team",
+	}
+
+	tests := []struct {
+		name   string
+		tokens map[string]string
+		path   string
+		header string
+		query  string
+		status int
+		// cacheControl is checked for successful requests
+		cacheControl string
+	}{
+		{name: "public", tokens: tokens, path: "/public/a.png", status: http.StatusOK, cacheControl: "public, max-age=31536000"},
+		{name: "missing token", tokens: tokens, path: "/private/a.png", status: http.StatusForbidden},
+		{name: "header", tokens: tokens, path: "/private/a.png", header: "secret", status: http.StatusOK, cacheControl: "private, max-age=31536000"},
+		{name: "query", tokens: tokens, path: "/private/a.png", query: "token=secret", status: http.StatusOK, cacheControl: "private, max-age=31536000"},
+		{name: "wrong token", tokens: tokens, path: "/private/a.png", header: "wrong", status: http.StatusForbidden},
+		{name: "prefix of token", tokens: tokens, path: "/private/a.png", header: "secre", status: http.StatusForbidden},
+		{name: "longest prefix wins", tokens: tokens, path: "/private/inner/a.png", header: "inner", status: http.StatusOK, cacheControl: "private, max-age=31536000"},
+		{name: "parent token rejected below longer prefix", tokens: tokens, path: "/private/inner/a.png", header: "secret", status: http.StatusForbidden},
+		{name: "slashes trimmed", tokens: tokens, path: "/team/a.png", header: "team", status: http.StatusOK, cacheControl: "private, max-age=31536000"},
+		{name: "similar folder is public", tokens: tokens, path: "/privateer/a.png", status: http.StatusOK, cacheControl: "public, max-age=31536000"},
+		{name: "folder itself", tokens: tokens, path: "/private", status: http.StatusForbidden},
+		{name: "empty prefix covers everything", tokens: map[string]string{"": "all"}, path: "/public/a.png", status: http.StatusForbidden},
+		{name: "empty prefix with token", tokens: map[string]string{"": "all"}, path: "/public/a.png", query: "token=all", status: http.StatusOK, cacheControl: "private, max-age=31536000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestImageHandler(&config.Config{FolderTokens: tt.tokens}, fstest.MapFS{
+				"public/a.png":        pngFile(2, 2),
+				"private/a.png":       pngFile(2, 2),
+				"private/inner/a.png": pngFile(2, 2),
+				"privateer/a.png":     pngFile(2, 2),
+				"team/a.png":          pngFile(2, 2),
+			})
+
+			target := tt.path
+			if tt.query != "" {
+				target += "?" + tt.query
+			}
+			w := serveWithHeader(h.ServeImage, target, "X-Access-Token", tt.header, gin.Param{Key: "filepath", Value: tt.path})
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.cacheControl != "" && w.Header().Get("Cache-Control") != tt.cacheControl {
+				t.Errorf("Cache-Control = %q, want %q", w.Header().Get("Cache-Control"), tt.cacheControl)
+			}
+		})
+	}
+}
@@ -1,18 +1,29 @@
 package handlers
 
 import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"image"
 	"io"
+	"log/slog"
+	"mime/multipart"
 	"net/http"
 	"net/url"
-	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
 	"ImageServer/config"
+	"ImageServer/metrics"
 	"ImageServer/models"
+	"ImageServer/storage"
 	"ImageServer/utils"
 
 	"github.com/gin-gonic/gin"
@@ -20,10 +31,26 @@ import (
 
 type APIHandler struct {
 	config *config.Config
+	store  storage.Storage
+	cache  storage.Storage
+	logger *slog.Logger
+
+	// fetcher downloads remote images for FetchImage
+	fetcher *http.Client
+	// usage caches the result of the last usage walk
+	usage usageCache
+	// sessions serializes requests to each resumable upload
+	sessions sessionLocks
 }
 
-func NewAPIHandler(cfg *config.Config) *APIHandler {
-	return &APIHandler{config: cfg}
+func NewAPIHandler(cfg *config.Config, store, cache storage.Storage, logger *slog.Logger) *APIHandler {
+	return &APIHandler{
+		config:  cfg,
+		store:   store,
+		cache:   cache,
+		logger:  logger,
+		fetcher: newFetchClient(cfg.FetchTimeout),
+	}
 }
 
 // ListDirectory handles GET /api/v1/files/*path?list=true
@@ -33,20 +60,33 @@ func (h *APIHandler) ListDirectory(c *gin.Context) {
 		dirPath = "/"
 	}
 
-	fullPath := filepath.Join(h.config.Path, dirPath)
+	name, err := utils.CleanName(dirPath)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidPath, "Invalid path")
+		return
+	}
 
-	files, err := os.ReadDir(fullPath)
+	files, err := h.store.ReadDir(name)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Directory not found"})
+		respondError(c, http.StatusNotFound, CodeNotFound, "Directory not found")
 		return
 	}
 
+	query := strings.ToLower(c.Query("q"))
+	exts := models.ParseExtSlice(c.Query("ext"))
+
 	var allFiles []models.FileInfo
 	for _, file := range files {
 		info, err := file.Info()
 		if err != nil {
 			continue
 		}
+		if query != "" && !strings.Contains(strings.ToLower(info.Name()), query) {
+			continue
+		}
+		if len(exts) > 0 && !exts.Has(strings.TrimPrefix(filepath.Ext(info.Name()), ".")) {
+			continue
+		}
 		if !utils.ContainsDotFile(info.Name()) {
 			allFiles = append(allFiles, models.FileInfo{
 				Name:    info.Name(),
@@ -58,6 +98,19 @@ func (h *APIHandler) ListDirectory(c *gin.Context) {
 		}
 	}
 
+	// Sort before paginating; ReadDir already returns entries by name
+	sortBy := c.DefaultQuery("sort", "name")
+	if sortBy != "name" && sortBy != "size" && sortBy != "modTime" {
+		respondError(c, http.StatusBadRequest, CodeInvalidParameter, "Invalid sort: "+sortBy)
+		return
+	}
+	order := c.DefaultQuery("order", "asc")
+	if order != "asc" && order != "desc" {
+		respondError(c, http.StatusBadRequest, CodeInvalidParameter, "Invalid order: "+order)
+		return
+	}
+	sortFiles(allFiles, sortBy, order == "desc", c.Query("dirsFirst") == "true")
+
 	// Get page size from query parameter
 	pageSize := 10 // Default page size
 	if size := c.Query("size"); size != "" {
@@ -74,9 +127,17 @@ func (h *APIHandler) ListDirectory(c *gin.Context) {
 		}
 	}
 
+	result := models.FileList{
+		Items:      []models.FileInfo{},
+		Page:       page,
+		Size:       pageSize,
+		TotalItems: len(allFiles),
+		TotalPages: (len(allFiles) + pageSize - 1) / pageSize,
+	}
+
 	start := page * pageSize
 	if start >= len(allFiles) {
-		c.JSON(http.StatusOK, []models.FileInfo{})
+		c.JSON(http.StatusOK, result)
 		return
 	}
 
@@ -85,125 +146,718 @@ func (h *APIHandler) ListDirectory(c *gin.Context) {
 		end = len(allFiles)
 	}
 
-	c.JSON(http.StatusOK, allFiles[start:end])
+	result.Items = allFiles[start:end]
+
+	// Metadata is only gathered for the returned page
+	if c.Query("meta") == "true" {
+		for i := range result.Items {
+			h.addMeta(&result.Items[i], path.Join(name, result.Items[i].Name), true)
+		}
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// StatFile handles GET /api/v1/stat/*path
+func (h *APIHandler) StatFile(c *gin.Context) {
+	filePath := c.Param("path")
+
+	name, err := utils.CleanName(filePath)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidPath, "Invalid path")
+		return
+	}
+
+	info, err := h.store.Stat(name)
+	if err != nil {
+		respondError(c, http.StatusNotFound, CodeNotFound, "File not found")
+		return
+	}
+
+	result := models.FileInfo{
+		Name:    info.Name(),
+		Path:    filePath,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		IsDir:   info.IsDir(),
+	}
+	h.addMeta(&result, name, c.Query("meta") == "true")
+
+	c.JSON(http.StatusOK, result)
+}
+
+// addMeta fills in the content type and, for images, the dimensions of a
+// file. blurHash also decodes the image to compute its BlurHash, which is
+// far more expensive. Directories are left untouched.
+func (h *APIHandler) addMeta(info *models.FileInfo, name string, blurHash bool) {
+	if info.IsDir {
+		return
+	}
+
+	info.ContentType = utils.ContentType(h.store, name)
+	if !strings.HasPrefix(info.ContentType, "image/") {
+		return
+	}
+
+	if width, height, err := utils.Dimensions(h.store, name); err == nil {
+		info.Width, info.Height = width, height
+	}
+
+	if blurHash {
+		if hash, err := utils.ImageBlurHash(h.store, name, defaultBlurHashX, defaultBlurHashY); err == nil {
+			info.BlurHash = hash
+		}
+	}
+}
+
+// sortFiles orders files by the given key. The sort is stable and falls back
+// to the name so equal keys keep a deterministic order across requests.
+func sortFiles(files []models.FileInfo, by string, desc, dirsFirst bool) {
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if dirsFirst && a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+
+		var order int
+		switch by {
+		case "size":
+			order = cmp.Compare(a.Size, b.Size)
+		case "modTime":
+			order = a.ModTime.Compare(b.ModTime)
+		}
+		if order == 0 {
+			order = strings.Compare(a.Name, b.Name)
+		}
+
+		if desc {
+			return order > 0
+		}
+		return order < 0
+	})
 }
 
 // CreateDirectory handles POST /api/v1/directories/*path
 func (h *APIHandler) CreateDirectory(c *gin.Context) {
 	dirPath := c.Param("path")
-	fullPath := filepath.Join(h.config.Path, dirPath)
+	name, err := utils.CleanName(dirPath)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidPath, "Invalid path")
+		return
+	}
 
-	if err := os.MkdirAll(fullPath, 0755); err != nil {
-		println(err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create directory"})
+	if err := h.store.MkdirAll(name); err != nil {
+		h.logger.Error("Failed to create directory", "error", err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Failed to create directory")
 		return
 	}
 
 	c.JSON(http.StatusCreated, gin.H{"message": "Directory created successfully"})
 }
 
+// parseUpload limits the request body and parses the whole multipart form up
+// front so an aborted upload is rejected before anything touches the disk.
+func (h *APIHandler) parseUpload(c *gin.Context) (*multipart.Form, error) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.config.MaxUploadBytes)
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		h.logger.Warn("Error parsing upload", "error", err)
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return nil, &apiError{http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "Upload exceeds size limit"}
+		}
+		return nil, &apiError{http.StatusBadRequest, CodeInvalidUpload, "Incomplete or malformed upload"}
+	}
+
+	return form, nil
+}
+
+var (
+	// validID allows only characters that are safe in a filename and a URL
+	validID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	// validFolder is like validID but allows slashes for nested folders
+	validFolder = regexp.MustCompile(`^[A-Za-z0-9_/-]+$`)
+)
+
+// validateUpload checks the fields used to name the stored file. The file is
+// stored as <id>.<format> and the returned URL uses the same name. An empty
+// id is allowed and means the content hash is used instead.
+func validateUpload(folder, id, format string) error {
+	if !validFolder.MatchString(folder) {
+		return &apiError{http.StatusBadRequest, CodeInvalidParameter, "Invalid folder"}
+	}
+
+	if id != "" && !validID.MatchString(id) {
+		return &apiError{http.StatusBadRequest, CodeInvalidParameter, "Invalid id"}
+	}
+
+	if !models.SupportedTypes.Has(format) {
+		return &apiError{http.StatusBadRequest, CodeUnsupportedFormat, "Unsupported format: " + format}
+	}
+
+	return nil
+}
+
+// folderAllowed reports whether uploads may target folder. Without a
+// configured allowlist every folder is allowed.
+func (h *APIHandler) folderAllowed(folder string) bool {
+	if len(h.config.UploadFolders) == 0 {
+		return true
+	}
+
+	folder = strings.Trim(folder, "/")
+	for _, prefix := range h.config.UploadFolders {
+		prefix = strings.Trim(prefix, "/")
+		if folder == prefix || strings.HasPrefix(folder, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// readUpload reads an uploaded file fully, rejecting truncated bodies.
+func (h *APIHandler) readUpload(fileHeader *multipart.FileHeader) ([]byte, error) {
+	if fileHeader.Size > h.config.MaxUploadBytes {
+		return nil, &apiError{http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "Upload exceeds size limit"}
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		h.logger.Error("Error opening file", "error", err)
+		return nil, errors.New("Error opening file")
+	}
+	defer file.Close()
+
+	fileBytes, err := io.ReadAll(file)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		h.logger.Warn("Incomplete upload", "error", err)
+		return nil, &apiError{http.StatusBadRequest, CodeInvalidUpload, "Incomplete upload"}
+	}
+	if err != nil {
+		h.logger.Error("Error reading uploaded file", "error", err)
+		return nil, errors.New("Error reading uploaded file")
+	}
+
+	// A short read means the client went away mid-upload
+	if int64(len(fileBytes)) != fileHeader.Size {
+		return nil, &apiError{http.StatusBadRequest, CodeInvalidUpload, "Incomplete upload"}
+	}
+
+	return fileBytes, nil
+}
+
+// streamUpload stores an upload that needs no processing straight from the
+// multipart file, so it is never held in memory as a whole. Content
+// addressed uploads are read twice: once for the hash, once to store them.
+func (h *APIHandler) streamUpload(folder, id, format string, fileHeader *multipart.FileHeader) (*models.UploadedImage, error) {
+	if fileHeader.Size > h.config.MaxUploadBytes {
+		return nil, &apiError{http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "Upload exceeds size limit"}
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		h.logger.Error("Error opening file", "error", err)
+		return nil, errors.New("Error opening file")
+	}
+	defer file.Close()
+
+	if err := checkPixels(file); err != nil {
+		return nil, err
+	}
+	if err := h.validateImage(file, format); err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		h.logger.Error("Error reading uploaded file", "error", err)
+		return nil, errors.New("Error reading uploaded file")
+	}
+
+	dedupe := id == ""
+	if dedupe {
+		hash := sha256.New()
+		if _, err := io.Copy(hash, file); err != nil {
+			h.logger.Error("Error reading uploaded file", "error", err)
+			return nil, errors.New("Error reading uploaded file")
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			h.logger.Error("Error reading uploaded file", "error", err)
+			return nil, errors.New("Error reading uploaded file")
+		}
+		id = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	width, height := imageSize(file)
+
+	uploaded, err := h.saveUpload(folder, id, format, file, fileHeader.Size, dedupe)
+	if err != nil {
+		return nil, err
+	}
+	uploaded.OriginalFormat = format
+	uploaded.Width, uploaded.Height = width, height
+	return uploaded, nil
+}
+
+// validateImage rejects uploads that do not decode, whatever their header
+// claims, and uploads whose content is another format than declared.
+func (h *APIHandler) validateImage(r io.Reader, format string) error {
+	err := utils.ValidateImage(r, format)
+	if errors.Is(err, utils.ErrFormatMismatch) {
+		h.logger.Warn("Upload does not match its format", "format", format)
+		return &apiError{http.StatusUnprocessableEntity, CodeInvalidImage, "Image content is not " + format}
+	}
+	if err != nil {
+		h.logger.Warn("Undecodable upload", "format", format, "error", err)
+		return &apiError{http.StatusUnprocessableEntity, CodeInvalidImage, "Image could not be decoded"}
+	}
+	return nil
+}
+
+// imageSize reads the dimensions from the header of an upload and rewinds
+// it. Formats without a decoder, such as SVG and AVIF, report zero.
+func imageSize(r io.ReadSeeker) (width, height int) {
+	config, _, err := image.DecodeConfig(r)
+	if _, seekErr := r.Seek(0, io.SeekStart); err != nil || seekErr != nil {
+		return 0, 0
+	}
+	return config.Width, config.Height
+}
+
+// checkPixels rejects uploads whose header declares more than MAX_PIXELS.
+func checkPixels(r io.Reader) error {
+	err := utils.CheckPixels(r)
+	if errors.Is(err, utils.ErrTooManyPixels) {
+		return &apiError{http.StatusBadRequest, CodeImageTooLarge, "Image dimensions exceed the limit"}
+	}
+	return err
+}
+
+// convertUpload reads the convert form field, which overrides
+// CONVERT_ON_UPLOAD for one request.
+func (h *APIHandler) convertUpload(value string) (bool, error) {
+	if value == "" {
+		return h.config.ConvertOnUpload, nil
+	}
+	convert, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, &apiError{http.StatusBadRequest, CodeInvalidParameter, "Invalid convert: " + value}
+	}
+	return convert, nil
+}
+
+// convertible reports whether uploads of format are turned into PNG when
+// conversion is on. GIFs would lose their animation and SVGs are vector
+// data, so both are kept as uploaded.
+func (h *APIHandler) convertible(format string) bool {
+	return format != "png" && format != "gif" && format != "svg" && h.config.ConvertibleTypes.Has(format)
+}
+
+// passthrough reports whether uploads of format are stored byte for byte,
+// with no sanitizing, orientation fix or metadata stripping in storeUpload.
+func (h *APIHandler) passthrough(format string) bool {
+	switch format {
+	case "gif", "webp", "avif":
+		return true
+	case "png":
+		return !h.config.StripMetadata
+	default:
+		return false
+	}
+}
+
+// saveUpload stores size bytes read from r as <folder>/<id>.<format>, with
+// the canonical spelling of format, and describes the stored file. With dedupe set an existing file is kept as is,
+// which is safe when id is the hash of the content.
+func (h *APIHandler) saveUpload(folder, id, format string, r io.Reader, size int64, dedupe bool) (*models.UploadedImage, error) {
+	format = models.CanonicalExt(format)
+
+	folderName, err := utils.CleanName(folder)
+	if err != nil {
+		return nil, &apiError{http.StatusBadRequest, CodeInvalidPath, "Invalid folder"}
+	}
+
+	name, err := utils.CleanName(path.Join(folderName, id+"."+format))
+	if err != nil {
+		return nil, &apiError{http.StatusBadRequest, CodeInvalidPath, "Invalid id"}
+	}
+
+	if dedupe {
+		if _, err := h.store.Stat(name); err == nil {
+			h.logger.Info("Duplicate upload", "path", name)
+			return h.uploaded(name, format, size)
+		}
+	}
+
+	// A re-upload only grows the storage by the difference
+	growth, replaced := size, false
+	if info, err := h.store.Stat(name); err == nil {
+		growth -= info.Size()
+		replaced = true
+	}
+	if err := h.checkQuota(growth); err != nil {
+		return nil, err
+	}
+
+	if err := h.store.MkdirAll(folderName); err != nil {
+		h.logger.Error("Error creating folder", "error", err)
+		return nil, errors.New("Error creating folder")
+	}
+
+	// Storage publishes the file only once it is complete, so re-uploads
+	// never expose a half-written original
+	w, err := h.store.Create(name)
+	if err != nil {
+		h.logger.Error("Error saving file", "error", err)
+		return nil, errors.New("Error saving file")
+	}
+	written, err := io.Copy(w, r)
+	if err != nil {
+		w.Abort()
+		h.logger.Error("Error saving file", "error", err)
+		return nil, errors.New("Error saving file")
+	}
+	// A short read means the client went away mid-upload
+	if written != size {
+		w.Abort()
+		return nil, &apiError{http.StatusBadRequest, CodeInvalidUpload, "Incomplete upload"}
+	}
+	if err := w.Close(); err != nil {
+		h.logger.Error("Error saving file", "error", err)
+		return nil, errors.New("Error saving file")
+	}
+	h.usage.add(name, growth, !replaced)
+
+	// A re-upload must not keep serving variants of the previous content
+	h.purgeVariants(name)
+
+	h.logger.Info("Uploaded file", "path", name)
+	metrics.Uploads.Inc()
+	metrics.UploadBytes.Add(float64(size))
+
+	return h.uploaded(name, format, size)
+}
+
+// uploaded describes the upload stored as name.
+func (h *APIHandler) uploaded(name, format string, size int64) (*models.UploadedImage, error) {
+	fileURL, err := h.fileURL(name)
+	if err != nil {
+		return nil, err
+	}
+	return &models.UploadedImage{
+		URL:          fileURL,
+		Path:         name,
+		Size:         size,
+		Format:       format,
+		StoredFormat: format,
+	}, nil
+}
+
+// fileURL returns the public URL of a stored file.
+func (h *APIHandler) fileURL(name string) (string, error) {
+	baseURL, err := url.Parse(h.config.Domain)
+	if err != nil {
+		h.logger.Error("Invalid domain configuration", "error", err)
+		return "", errors.New("Invalid domain configuration")
+	}
+
+	baseURL.Path = path.Join(baseURL.Path, name)
+	return baseURL.String(), nil
+}
+
+// purgeVariants drops the cached variants of a file that was replaced or
+// moved. Failures only leave stale cache entries behind, so they are logged
+// rather than failing the request.
+func (h *APIHandler) purgeVariants(name string) {
+	if err := utils.PurgeVariants(h.cache, name); err != nil {
+		h.logger.Warn("Error purging cached variants", "path", name, "error", err)
+	}
+}
+
+// uploadOne validates, reads and stores a single uploaded file.
+func (h *APIHandler) uploadOne(folder, id, format string, fileHeader *multipart.FileHeader, convert bool) (*models.UploadedImage, error) {
+	if err := h.checkUpload(folder, id, format); err != nil {
+		return nil, err
+	}
+
+	if h.passthrough(format) && !(convert && h.convertible(format)) {
+		return h.streamUpload(folder, id, format, fileHeader)
+	}
+
+	fileBytes, err := h.readUpload(fileHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.storeUpload(folder, id, format, fileBytes, convert)
+}
+
+// checkUpload validates the naming fields of an upload and makes sure the
+// target folder accepts uploads.
+func (h *APIHandler) checkUpload(folder, id, format string) error {
+	if err := validateUpload(folder, id, format); err != nil {
+		return err
+	}
+
+	if !h.folderAllowed(folder) {
+		return &apiError{http.StatusForbidden, CodeAccessDenied, "Uploads to this folder are not allowed"}
+	}
+	return nil
+}
+
+// storeUpload sanitizes, normalizes and stores the bytes of an image that
+// passed checkUpload. With convert set, formats that allow it are stored as
+// PNG under <id>.png.
+func (h *APIHandler) storeUpload(folder, id, format string, fileBytes []byte, convert bool) (*models.UploadedImage, error) {
+	if err := checkPixels(bytes.NewReader(fileBytes)); err != nil {
+		return nil, err
+	}
+	if err := h.validateImage(bytes.NewReader(fileBytes), format); err != nil {
+		return nil, err
+	}
+
+	originalFormat := format
+
+	var err error
+	if format == "svg" {
+		fileBytes, err = utils.SanitizeSVG(fileBytes)
+		if err != nil {
+			h.logger.Warn("Invalid SVG", "error", err)
+			return nil, &apiError{http.StatusBadRequest, CodeInvalidUpload, "Invalid SVG"}
+		}
+	}
+
+	fileBytes, err = utils.NormalizeOrientation(fileBytes, format)
+	if err != nil {
+		h.logger.Warn("Invalid image", "error", err)
+		return nil, &apiError{http.StatusBadRequest, CodeInvalidUpload, "Invalid image"}
+	}
+
+	if convert && h.convertible(format) {
+		fileBytes, err = utils.ConvertToPNG(fileBytes)
+		if err != nil {
+			h.logger.Warn("Error converting upload", "format", format, "error", err)
+			return nil, &apiError{http.StatusBadRequest, CodeInvalidUpload, "Invalid image"}
+		}
+		format = "png"
+	}
+
+	if h.config.StripMetadata {
+		fileBytes, err = utils.StripMetadata(fileBytes, format)
+		if err != nil {
+			h.logger.Warn("Invalid image", "error", err)
+			return nil, &apiError{http.StatusBadRequest, CodeInvalidUpload, "Invalid image"}
+		}
+	}
+
+	// Without an id the file is content addressed, so identical uploads
+	// share one stored file
+	dedupe := id == ""
+	if dedupe {
+		sum := sha256.Sum256(fileBytes)
+		id = hex.EncodeToString(sum[:])
+	}
+
+	uploaded, err := h.saveUpload(folder, id, format, bytes.NewReader(fileBytes), int64(len(fileBytes)), dedupe)
+	if err != nil {
+		return nil, err
+	}
+	uploaded.OriginalFormat = originalFormat
+	uploaded.Width, uploaded.Height = imageSize(bytes.NewReader(fileBytes))
+	return uploaded, nil
+}
+
 // UploadImage handles POST /api/v1/images
 func (h *APIHandler) UploadImage(c *gin.Context) {
+	if _, err := h.parseUpload(c); err != nil {
+		h.respondAPIError(c, err)
+		return
+	}
+
 	folder := c.PostForm("folder")
 	id := c.PostForm("id")
-	format := c.PostForm("format")
+	format := strings.ToLower(c.PostForm("format"))
 
-	if folder == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder"})
+	if err := validateUpload(folder, id, format); err != nil {
+		h.respondAPIError(c, err)
 		return
 	}
 
-	folderPath := filepath.Join(h.config.Path, folder)
-	err := os.MkdirAll(folderPath, 0755)
+	convert, err := h.convertUpload(c.PostForm("convert"))
 	if err != nil {
-		println(err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating folder: " + err.Error()})
+		h.respondAPIError(c, err)
 		return
 	}
 
 	fileHeader, err := c.FormFile("file")
 	if err != nil {
-		println(err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Error retrieving file: " + err.Error()})
+		h.logger.Warn("Missing file", "error", err)
+		respondError(c, http.StatusBadRequest, CodeInvalidUpload, "Missing file")
 		return
 	}
 
-	file, err := fileHeader.Open()
+	uploaded, err := h.uploadOne(folder, id, format, fileHeader, convert)
 	if err != nil {
-		println(err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error opening file"})
+		h.respondAPIError(c, err)
 		return
 	}
-	defer file.Close()
 
-	fileBytes, err := io.ReadAll(file)
+	c.JSON(http.StatusCreated, uploaded)
+}
+
+// UploadBatch handles POST /api/v1/images/batch
+//
+// Files are sent in the "files" field. Each file's id and format are taken
+// from the parallel "ids" and "formats" fields when given, otherwise from
+// the uploaded filename.
+func (h *APIHandler) UploadBatch(c *gin.Context) {
+	form, err := h.parseUpload(c)
 	if err != nil {
-		println(err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading uploaded file"})
+		h.respondAPIError(c, err)
 		return
 	}
 
-	filePath := filepath.Join(folderPath, id+"."+format)
-	outputFile, error := os.Create(filePath)
-	if error != nil {
-		println(error.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating file: " + error.Error()})
+	folder := c.PostForm("folder")
+	if folder == "" {
+		respondError(c, http.StatusBadRequest, CodeInvalidParameter, "Invalid folder")
 		return
 	}
-	defer outputFile.Close()
 
-	if _, err = outputFile.Write(fileBytes); err != nil {
-		println(err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving file"})
+	files := form.File["files"]
+	if len(files) == 0 {
+		respondError(c, http.StatusBadRequest, CodeInvalidUpload, "No files uploaded")
 		return
 	}
-	baseURL, error := url.Parse(h.config.Domain)
-	if error != nil {
-		println(error.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid domain configuration"})
+
+	convert, err := h.convertUpload(c.PostForm("convert"))
+	if err != nil {
+		h.respondAPIError(c, err)
 		return
 	}
 
-	baseURL.Path = path.Join(baseURL.Path, folder, id+"."+format)
-	c.JSON(http.StatusCreated, gin.H{"url": baseURL.String()})
+	ids := form.Value["ids"]
+	formats := form.Value["formats"]
 
-	println("Uploaded file: " + filePath)
+	results := make([]models.UploadResult, 0, len(files))
+	for i, fileHeader := range files {
+		ext := filepath.Ext(fileHeader.Filename)
+		id := strings.TrimSuffix(fileHeader.Filename, ext)
+		format := strings.TrimPrefix(ext, ".")
+		if i < len(ids) && ids[i] != "" {
+			id = ids[i]
+		}
+		if i < len(formats) && formats[i] != "" {
+			format = formats[i]
+		}
+		format = strings.ToLower(format)
+
+		result := models.UploadResult{ID: id}
+		uploaded, err := h.uploadOne(folder, id, format, fileHeader, convert)
+		if err != nil {
+			result.Error = h.clientMessage(err)
+		} else {
+			result.URL = uploaded.URL
+		}
+		results = append(results, result)
+	}
+
+	c.JSON(http.StatusOK, results)
 }
 
 // DeleteFile handles DELETE /api/v1/files/*path
 func (h *APIHandler) DeleteFile(c *gin.Context) {
 	filePath := c.Param("path")
-	fullPath := filepath.Join(h.config.Path, filePath)
-	filePathWithoutExt := strings.TrimSuffix(fullPath, filepath.Ext(fullPath))
+	if err := h.deleteOne(filePath, c.Query("purge") != "false"); err != nil {
+		h.respondAPIError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Successfully deleted: %s", filePath)})
+}
 
-	// Delete all file with prefix filePathWithoutExt
-	if err := os.RemoveAll(filePathWithoutExt + "*"); err != nil {
-		println(err.Error())
-		c.JSON(http.StatusOK, gin.H{"error": "Error deleting files: " + err.Error()})
+// maxBatchDelete bounds how many paths a single batch delete may name.
+const maxBatchDelete = 1000
+
+// BatchDelete handles POST /api/v1/files/batch-delete
+//
+// The body is a JSON array of paths. Each path is deleted independently and
+// reported in its own result, so one bad path does not stop the rest.
+func (h *APIHandler) BatchDelete(c *gin.Context) {
+	var paths []string
+	if err := c.ShouldBindJSON(&paths); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidParameter, "Expected a JSON array of paths")
+		return
+	}
+	if len(paths) > maxBatchDelete {
+		respondError(c, http.StatusBadRequest, CodeInvalidParameter, fmt.Sprintf("At most %d paths can be deleted at once", maxBatchDelete))
 		return
 	}
 
+	purge := c.Query("purge") != "false"
+	results := make([]models.DeleteResult, 0, len(paths))
+	for _, filePath := range paths {
+		result := models.DeleteResult{Path: filePath}
+		if err := h.deleteOne(filePath, purge); err != nil {
+			result.Error = h.clientMessage(err)
+		} else {
+			result.Deleted = true
+		}
+		results = append(results, result)
+	}
+
+	c.JSON(http.StatusOK, results)
+}
+
+// deleteOne removes a file or a directory with everything in it. The data
+// root itself is never deleted. With purge set the cached variants go too.
+func (h *APIHandler) deleteOne(filePath string, purge bool) error {
+	name, err := utils.CleanName(filePath)
+	if err != nil {
+		return &apiError{http.StatusBadRequest, CodeInvalidPath, "Invalid path"}
+	}
+
+	// An empty path or "/" resolves to the data root itself
+	if name == "." {
+		return &apiError{http.StatusBadRequest, CodeInvalidPath, "Refusing to delete the data root"}
+	}
+
 	// Get file info to check if it's a directory
-	info, err := os.Stat(fullPath)
+	info, err := h.store.Stat(name)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{"error": "File not found"})
-		return
+		return &apiError{http.StatusNotFound, CodeNotFound, "File not found"}
+	}
+
+	// Measured up front so the freed space counts against the quota at once
+	tree, measureErr := h.measureTree(name)
+	if measureErr != nil {
+		h.logger.Warn("Error measuring deleted files, recomputing usage", "path", name, "error", measureErr)
 	}
 
-	// Use RemoveAll for directories and Remove for files
-	if info.IsDir() {
-		if err := os.RemoveAll(fullPath); err != nil {
-			println(err.Error())
-			c.JSON(http.StatusOK, gin.H{"error": "Error deleting directory: " + err.Error()})
-			return
+	// Cached variants go with the original unless the caller keeps them
+	if purge {
+		if err := utils.PurgeVariants(h.cache, name); err != nil {
+			h.logger.Error("Error purging cached variants", "error", err)
+			return errors.New("Error deleting files")
 		}
-	} else {
-		if err := os.Remove(fullPath); err != nil {
-			println(err.Error())
-			c.JSON(http.StatusOK, gin.H{"error": "Error deleting file: " + err.Error()})
-			return
+	}
+
+	// Remove takes directories along with everything in them
+	if err := h.store.Remove(name); err != nil {
+		// Part of a tree may be gone, so nothing measured is reliable
+		h.usage.reset()
+		if info.IsDir() {
+			h.logger.Error("Error deleting directory", "error", err)
+			return errors.New("Error deleting directory")
 		}
+		h.logger.Error("Error deleting file", "error", err)
+		return errors.New("Error deleting file")
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Successfully deleted: %s", filePath)})
+	if measureErr != nil {
+		h.usage.reset()
+	} else {
+		h.usage.removeTree(name, tree)
+	}
+
+	h.logger.Info("Deleted", "path", name)
+	return nil
 }
@@ -0,0 +1,572 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"ImageServer/config"
+	"ImageServer/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// listDirectory runs ListDirectory for dir with the given query and decodes
+// the response.
+func listDirectory(t *testing.T, h *APIHandler, dir, query string) (int, models.FileList) {
+	t.Helper()
+
+	w := serve(h.ListDirectory, http.MethodGet, "/api/v1/files"+dir+"?"+query, "", gin.Param{Key: "path", Value: dir})
+	var list models.FileList
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, list
+}
+
+// itemNames joins the names of the listed files.
+func itemNames(list models.FileList) string {
+	names := make([]string, len(list.Items))
+	for i, item := range list.Items {
+		names[i] = item.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func TestListDirectoryPagination(t *testing.T) {
+	files := fstest.MapFS{}
+	for i := range 7 {
+		files[fmt.Sprintf("dir/%d.png", i)] = file("x")
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		items      string
+		page       int
+		size       int
+		totalPages int
+	}{
+		{name: "defaults", query: "", items: "0.png,1.png,2.png,3.png,4.png,5.png,6.png", page: 0, size: 10, totalPages: 1},
+		{name: "first page", query: "size=3", items: "0.png,1.png,2.png", page: 0, size: 3, totalPages: 3},
+		{name: "last partial page", query: "size=3&page=2", items: "6.png", page: 2, size: 3, totalPages: 3},
+		{name: "exact pages", query: "size=7", items: "0.png,1.png,2.png,3.png,4.png,5.png,6.png", page: 0, size: 7, totalPages: 1},
+		{name: "out of range", query: "size=3&page=5", items: "", page: 5, size: 3, totalPages: 3},
+		{name: "invalid values", query: "size=-1&page=x", items: "0.png,1.png,2.png,3.png,4.png,5.png,6.png", page: 0, size: 10, totalPages: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(nil, files)
+
+			status, list := listDirectory(t, h, "/dir", tt.query)
+			if status != http.StatusOK {
+				t.Fatalf("status = %d, want 200", status)
+			}
+			if list.Items == nil {
+				t.Error("items is null, want an array")
+			}
+			if got := itemNames(list); got != tt.items {
+				t.Errorf("items = %s, want %s", got, tt.items)
+			}
+			if list.TotalItems != 7 || list.Page != tt.page || list.Size != tt.size || list.TotalPages != tt.totalPages {
+				t.Errorf("page %d size %d of %d pages, %d items; want page %d size %d of %d pages, 7 items",
+					list.Page, list.Size, list.TotalPages, list.TotalItems, tt.page, tt.size, tt.totalPages)
+			}
+		})
+	}
+}
+
+func TestListDirectorySort(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(data string, minutes int) *fstest.MapFile {
+		return &fstest.MapFile{Data: []byte(data), ModTime: base.Add(time.Duration(minutes) * time.Minute), Mode: 0644}
+	}
+	files := fstest.MapFS{
+		"dir/b.png":     at("bbb", 1),
+		"dir/a.png":     at("a", 3),
+		"dir/c.png":     at("cc", 2),
+		"dir/d.png":     at("cc", 2),
+		"dir/sub/x.png": at("x", 0),
+	}
+
+	tests := []struct {
+		query string
+		items string
+	}{
+		{query: "", items: "a.png,b.png,c.png,d.png,sub"},
+		{query: "sort=name&order=desc", items: "sub,d.png,c.png,b.png,a.png"},
+		// Directory sizes and times depend on the storage, so these keep
+		// sub apart. Equal sizes and times fall back to the name
+		{query: "sort=size&dirsFirst=true", items: "sub,a.png,c.png,d.png,b.png"},
+		{query: "sort=size&order=desc&dirsFirst=true", items: "sub,b.png,d.png,c.png,a.png"},
+		{query: "sort=modTime&dirsFirst=true", items: "sub,b.png,c.png,d.png,a.png"},
+		{query: "sort=modTime&order=desc&dirsFirst=true", items: "sub,a.png,d.png,c.png,b.png"},
+		{query: "dirsFirst=true", items: "sub,a.png,b.png,c.png,d.png"},
+		{query: "dirsFirst=true&order=desc", items: "sub,d.png,c.png,b.png,a.png"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			h := newTestHandler(nil, files)
+
+			status, list := listDirectory(t, h, "/dir", tt.query)
+			if status != http.StatusOK {
+				t.Fatalf("status = %d, want 200", status)
+			}
+			if got := itemNames(list); got != tt.items {
+				t.Errorf("items = %s, want %s", got, tt.items)
+			}
+
+			// The same request must give the same order every time
+			for range 5 {
+				if _, again := listDirectory(t, h, "/dir", tt.query); itemNames(again) != itemNames(list) {
+					t.Fatalf("order changed between requests: %s, then %s", itemNames(list), itemNames(again))
+				}
+			}
+		})
+	}
+}
+
+func TestListDirectoryInvalidSort(t *testing.T) {
+	h := newTestHandler(nil, fstest.MapFS{"dir/a.png": file("a")})
+	for _, query := range []string{"sort=color", "order=up"} {
+		if status, _ := listDirectory(t, h, "/dir", query); status != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", query, status)
+		}
+	}
+}
+
+func TestListDirectoryFilter(t *testing.T) {
+	files := fstest.MapFS{
+		"dir/Cat.png":     file("x"),
+		"dir/cat.webp":    file("x"),
+		"dir/dog.JPG":     file("x"),
+		"dir/doge.jpeg":   file("x"),
+		"dir/bird.gif":    file("x"),
+		"dir/.cat.png":    file("x"),
+		"dir/catalog/a.b": file("x"),
+	}
+
+	tests := []struct {
+		query string
+		items string
+	}{
+		{query: "q=cat", items: "Cat.png,cat.webp,catalog"},
+		{query: "q=CAT", items: "Cat.png,cat.webp,catalog"},
+		{query: "q=zebra", items: ""},
+		{query: "ext=png,webp", items: "Cat.png,cat.webp"},
+		{query: "ext=.png,%20.webp", items: "Cat.png,cat.webp"},
+		// jpg and jpeg name the same format, in any case
+		{query: "ext=jpg", items: "dog.JPG,doge.jpeg"},
+		{query: "ext=tiff", items: ""},
+		{query: "q=dog&ext=jpeg", items: "dog.JPG,doge.jpeg"},
+		{query: "q=cat&ext=gif", items: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			h := newTestHandler(nil, files)
+
+			status, list := listDirectory(t, h, "/dir", tt.query+"&size=1")
+			if status != http.StatusOK {
+				t.Fatalf("status = %d, want 200", status)
+			}
+			// totalItems counts the filtered set, before pagination
+			want := 0
+			if tt.items != "" {
+				want = strings.Count(tt.items, ",") + 1
+			}
+			if list.TotalItems != want || list.TotalPages != want {
+				t.Errorf("totalItems = %d, totalPages = %d; want %d", list.TotalItems, list.TotalPages, want)
+			}
+			if list.Items == nil {
+				t.Error("items is null, want an array")
+			}
+
+			_, all := listDirectory(t, h, "/dir", tt.query+"&size=100")
+			if got := itemNames(all); got != tt.items {
+				t.Errorf("items = %s, want %s", got, tt.items)
+			}
+		})
+	}
+}
+
+// newTestUploadHandler returns an APIHandler accepting uploads of up to
+// maxBytes.
+func newTestUploadHandler(maxBytes int64, strip bool) *APIHandler {
+	return newTestHandler(&config.Config{
+		Domain:           "http://localhost",
+		MaxUploadBytes:   maxBytes,
+		StripMetadata:    strip,
+		ConvertibleTypes: models.ConverableTypes,
+	}, nil)
+}
+
+func TestUploadSize(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		status int
+	}{
+		{name: "3 bytes", data: []byte("abc"), status: http.StatusUnprocessableEntity},
+		{name: "empty", data: []byte{}, status: http.StatusUnprocessableEntity},
+		{name: "oversized", data: bytes.Repeat([]byte{0}, 4096), status: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		for _, strip := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s strip=%v", tt.name, strip), func(t *testing.T) {
+				h := newTestUploadHandler(1024, strip)
+
+				w := serveUpload(h.UploadImage, map[string]string{"folder": "a", "id": "x", "format": "png"}, tt.data)
+				if w.Code != tt.status {
+					t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+				}
+				if _, err := h.store.Stat("a/x.png"); err == nil {
+					t.Error("a rejected upload was stored")
+				}
+			})
+		}
+	}
+}
+
+func TestUploadSmallImage(t *testing.T) {
+	// Both well under the 512 bytes content sniffing looks at
+	var gifData bytes.Buffer
+	gif.Encode(&gifData, image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Black, color.White}), nil)
+
+	tests := []struct {
+		format string
+		data   []byte
+	}{
+		{format: "png", data: pngFile(1, 1).Data},
+		{format: "gif", data: gifData.Bytes()},
+	}
+
+	for _, tt := range tests {
+		for _, strip := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s strip=%v", tt.format, strip), func(t *testing.T) {
+				if len(tt.data) >= 512 {
+					t.Fatalf("fixture is %d bytes, want under 512", len(tt.data))
+				}
+				h := newTestUploadHandler(1<<20, strip)
+
+				w := serveUpload(h.UploadImage, map[string]string{"folder": "a", "id": "x", "format": tt.format}, tt.data)
+				if w.Code != http.StatusCreated {
+					t.Fatalf("status = %d, want 201: %s", w.Code, w.Body)
+				}
+				if _, err := h.store.Stat("a/x." + tt.format); err != nil {
+					t.Errorf("stored file: %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestDeleteRoot(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+	}{
+		{name: "empty", path: ""},
+		{name: "slash", path: "/"},
+		{name: "dot", path: "/."},
+		{name: "traversal", path: "/../.."},
+		{name: "traversal into data", path: "/a/../../a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(nil, fstest.MapFS{"a/one.png": file("x")})
+
+			w := serve(h.DeleteFile, http.MethodDelete, "/api/v1/files", "", gin.Param{Key: "path", Value: tt.path})
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400", w.Code)
+			}
+			if !strings.Contains(w.Body.String(), CodeInvalidPath) {
+				t.Errorf("body = %s, want %s", w.Body, CodeInvalidPath)
+			}
+			if _, err := h.store.Stat("a/one.png"); err != nil {
+				t.Errorf("file was deleted: %v", err)
+			}
+		})
+	}
+}
+
+func TestBatchDeleteRoot(t *testing.T) {
+	h := newTestHandler(nil, fstest.MapFS{"a/one.png": file("x")})
+
+	w := serve(h.BatchDelete, http.MethodPost, "/api/v1/files/batch-delete", `["", "/", "../a"]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	var results []models.DeleteResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		if result.Deleted || result.Error == "" {
+			t.Errorf("%q: deleted = %v, error = %q, want an error", result.Path, result.Deleted, result.Error)
+		}
+	}
+	if _, err := h.store.Stat("a/one.png"); err != nil {
+		t.Errorf("file was deleted: %v", err)
+	}
+}
+
+func TestPathTraversal(t *testing.T) {
+	h := newTestHandler(&config.Config{Domain: "http://localhost"}, fstest.MapFS{"a/one.png": pngFile(1, 1)})
+
+	paths := []string{"/../../etc/passwd", "/a/../../etc/passwd", "/..", `/..\..\etc\passwd`}
+	endpoints := []struct {
+		name    string
+		method  string
+		handler gin.HandlerFunc
+	}{
+		{"ListDirectory", http.MethodGet, h.ListDirectory},
+		{"StatFile", http.MethodGet, h.StatFile},
+		{"CreateDirectory", http.MethodPost, h.CreateDirectory},
+		{"DeleteFile", http.MethodDelete, h.DeleteFile},
+		{"VerifyImages", http.MethodGet, h.VerifyImages},
+		{"Archive", http.MethodGet, h.Archive},
+		{"ImageColors", http.MethodGet, h.ImageColors},
+		{"BlurHash", http.MethodGet, h.BlurHash},
+		{"Sprite", http.MethodGet, h.Sprite},
+	}
+
+	for _, endpoint := range endpoints {
+		for _, path := range paths {
+			t.Run(endpoint.name+" "+path, func(t *testing.T) {
+				w := serve(endpoint.handler, endpoint.method, "/api/v1/files", "", gin.Param{Key: "path", Value: path})
+				if w.Code != http.StatusBadRequest {
+					t.Errorf("status = %d, want 400: %s", w.Code, w.Body)
+				}
+			})
+		}
+	}
+
+	transfers := []struct {
+		name    string
+		handler gin.HandlerFunc
+	}{
+		{"MoveFile", h.MoveFile},
+		{"CopyFile", h.CopyFile},
+	}
+	for _, transfer := range transfers {
+		for _, body := range []string{
+			`{"from": "../../etc/passwd", "to": "a/passwd"}`,
+			`{"from": "a/one.png", "to": "../../tmp/one.png"}`,
+		} {
+			t.Run(transfer.name+" "+body, func(t *testing.T) {
+				w := serve(transfer.handler, http.MethodPost, "/api/v1/move", body)
+				if w.Code != http.StatusBadRequest {
+					t.Errorf("status = %d, want 400: %s", w.Code, w.Body)
+				}
+			})
+		}
+	}
+
+	if _, err := h.store.Stat("a/one.png"); err != nil {
+		t.Errorf("file was removed: %v", err)
+	}
+}
+
+func TestUploadNaming(t *testing.T) {
+	tests := []struct {
+		name   string
+		folder string
+		id     string
+		status int
+	}{
+		{name: "valid", folder: "a/b", id: "x_1-2", status: http.StatusCreated},
+		{name: "hash id", folder: "a", status: http.StatusCreated},
+		{name: "traversal id", folder: "a", id: "../../evil", status: http.StatusBadRequest},
+		{name: "traversal folder", folder: "../secret", id: "x", status: http.StatusBadRequest},
+		{name: "nested traversal folder", folder: "a/../../secret", id: "x", status: http.StatusBadRequest},
+		{name: "backslash folder", folder: `..\secret`, id: "x", status: http.StatusBadRequest},
+		{name: "dotted id", folder: "a", id: "x.png", status: http.StatusBadRequest},
+		{name: "id with slash", folder: "a", id: "b/x", status: http.StatusBadRequest},
+		{name: "empty folder", id: "x", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestUploadHandler(1<<20, false)
+
+			fields := map[string]string{"folder": tt.folder, "id": tt.id, "format": "png"}
+			w := serveUpload(h.UploadImage, fields, pngFile(1, 1).Data)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			var stored []string
+			fs.WalkDir(h.store, ".", func(name string, d fs.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					stored = append(stored, name)
+				}
+				return err
+			})
+			if wantStored := tt.status == http.StatusCreated; (len(stored) == 1) != wantStored {
+				t.Errorf("stored %v, want a file stored: %v", stored, wantStored)
+			}
+		})
+	}
+}
+
+func TestUploadAllowedFolders(t *testing.T) {
+	image := pngFile(1, 1).Data
+
+	tests := []struct {
+		name    string
+		allowed []string
+		folder  string
+		status  int
+	}{
+		{name: "unrestricted", folder: "anything", status: http.StatusCreated},
+		{name: "allowed", allowed: []string{"avatars", "/maps/"}, folder: "avatars", status: http.StatusCreated},
+		{name: "below allowed", allowed: []string{"avatars", "/maps/"}, folder: "maps/serpulo", status: http.StatusCreated},
+		{name: "disallowed", allowed: []string{"avatars", "/maps/"}, folder: "secret", status: http.StatusForbidden},
+		{name: "shared prefix", allowed: []string{"avatars", "/maps/"}, folder: "avatars-old", status: http.StatusForbidden},
+		{name: "parent of allowed", allowed: []string{"maps/serpulo"}, folder: "maps", status: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestUploadHandler(1<<20, false)
+			h.config.UploadFolders = tt.allowed
+
+			w := serveUpload(h.UploadImage, map[string]string{"folder": tt.folder, "id": "x", "format": "png"}, image)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			_, err := h.store.Stat(tt.folder + "/x.png")
+			if stored, want := err == nil, tt.status == http.StatusCreated; stored != want {
+				t.Errorf("stored = %v, want %v", stored, want)
+			}
+
+			// Base64 uploads go through the same check
+			body := fmt.Sprintf(`{"data": "data:image/png;base64,%s", "folder": %q, "id": "y"}`, base64.StdEncoding.EncodeToString(image), tt.folder)
+			if w := serve(h.UploadData, http.MethodPost, "/api/v1/images/data", body); w.Code != tt.status {
+				t.Errorf("data upload status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestInMemoryRoundTrip(t *testing.T) {
+	files := fstest.MapFS{
+		"maps/a.png":     pngFile(2, 2),
+		"maps/old/b.png": pngFile(2, 2),
+	}
+	h := newTestHandler(&config.Config{Domain: "http://localhost", MaxUploadBytes: 1 << 20}, files)
+
+	list := func(want string) {
+		t.Helper()
+		status, listed := listDirectory(t, h, "/maps", "dirsFirst=true")
+		if status != http.StatusOK {
+			t.Fatalf("list status = %d, want 200", status)
+		}
+		if got := itemNames(listed); got != want {
+			t.Errorf("listed %s, want %s", got, want)
+		}
+	}
+	list("old,a.png")
+
+	w := serveUpload(h.UploadImage, map[string]string{"folder": "maps", "id": "c", "format": "png"}, pngFile(3, 3).Data)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("upload status = %d, want 201: %s", w.Code, w.Body)
+	}
+	list("old,a.png,c.png")
+
+	w = serve(h.StatFile, http.MethodGet, "/api/v1/stat/maps/c.png", "", gin.Param{Key: "path", Value: "/maps/c.png"})
+	if w.Code != http.StatusOK {
+		t.Errorf("stat status = %d, want 200", w.Code)
+	}
+
+	for _, path := range []string{"/maps/a.png", "/maps/old"} {
+		w = serve(h.DeleteFile, http.MethodDelete, "/api/v1/files"+path, "", gin.Param{Key: "path", Value: path})
+		if w.Code != http.StatusOK {
+			t.Fatalf("delete %s status = %d, want 200", path, w.Code)
+		}
+	}
+	list("c.png")
+
+	w = serve(h.DeleteFile, http.MethodDelete, "/api/v1/files/maps/a.png", "", gin.Param{Key: "path", Value: "/maps/a.png"})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("deleting again = %d, want 404", w.Code)
+	}
+
+	// The fixture itself is never written to
+	if len(files) != 2 || files["maps/a.png"] == nil {
+		t.Errorf("fixture changed: %v", files)
+	}
+}
+
+// truncatedBody yields data and then fails as a dropped connection does.
+type truncatedBody struct {
+	r io.Reader
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func TestUploadTruncated(t *testing.T) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("folder", "a")
+	mw.WriteField("id", "x")
+	mw.WriteField("format", "png")
+	fw, _ := mw.CreateFormFile("file", "upload.png")
+	fw.Write(pngFile(64, 64).Data)
+	mw.Close()
+	full := body.Bytes()
+
+	tests := []struct {
+		name string
+		body io.Reader
+	}{
+		{name: "cut off", body: bytes.NewReader(full[:len(full)/2])},
+		{name: "connection dropped", body: &truncatedBody{bytes.NewReader(full[:len(full)-10])}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestUploadHandler(1<<20, false)
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/images", tt.body)
+			c.Request.Header.Set("Content-Type", mw.FormDataContentType())
+			c.Request.ContentLength = int64(len(full))
+			h.UploadImage(c)
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want 400: %s", w.Code, w.Body)
+			}
+			if _, err := h.store.Stat("a/x.png"); err == nil {
+				t.Error("a truncated upload was stored")
+			}
+		})
+	}
+}
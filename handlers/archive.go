@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"archive/zip"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"ImageServer/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Archive handles GET /api/v1/archive/*path
+//
+// Every file below path, dotfiles excluded, is streamed as a ZIP archive.
+// Entries are written as they are read, so the archive is never held in
+// memory; an error halfway through leaves the client with a truncated file.
+func (h *APIHandler) Archive(c *gin.Context) {
+	root, err := utils.CleanName(c.Param("path"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidPath, "Invalid path")
+		return
+	}
+	if utils.ContainsDotFile(root) && root != "." {
+		respondError(c, http.StatusNotFound, CodeNotFound, "Directory not found")
+		return
+	}
+	info, err := h.store.Stat(root)
+	if err != nil || !info.IsDir() {
+		respondError(c, http.StatusNotFound, CodeNotFound, "Directory not found")
+		return
+	}
+
+	archiveName := path.Base(root)
+	if root == "." {
+		archiveName = "images"
+	}
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": archiveName + ".zip"}))
+	c.Status(http.StatusOK)
+
+	zw := zip.NewWriter(c.Writer)
+	err = fs.WalkDir(h.store, root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == root {
+			return nil
+		}
+
+		entry := strings.TrimPrefix(name, root+"/")
+		if utils.ContainsDotFile(entry) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		return h.archiveFile(zw, name, entry)
+	})
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		h.logger.Error("Error writing archive", "path", root, "error", err)
+		c.Abort()
+	}
+}
+
+// archiveFile copies the stored file name into zw as entry. Images are
+// already compressed, so entries are stored rather than deflated.
+func (h *APIHandler) archiveFile(zw *zip.Writer, name, entry string) error {
+	file, err := h.store.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = entry
+	header.Method = zip.Store
+
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, file)
+	return err
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"strconv"
+
+	"ImageServer/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Default BlurHash components, also used for the listing metadata.
+const (
+	defaultBlurHashX = 4
+	defaultBlurHashY = 3
+)
+
+// BlurHash handles GET /api/v1/blurhash/*path
+//
+// x and y set the number of components on each axis (1-9, default 4x3).
+func (h *APIHandler) BlurHash(c *gin.Context) {
+	name, err := utils.CleanName(c.Param("path"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidPath, "Invalid path")
+		return
+	}
+
+	query := c.Request.URL.Query()
+	components := [2]int{defaultBlurHashX, defaultBlurHashY}
+	for i, key := range []string{"x", "y"} {
+		value := queryDefault(query, key, strconv.Itoa(components[i]))
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 9 {
+			respondError(c, http.StatusBadRequest, CodeInvalidParameter, "Invalid "+key+": "+value)
+			return
+		}
+		components[i] = n
+	}
+
+	if info, err := h.store.Stat(name); err != nil || info.IsDir() {
+		respondError(c, http.StatusNotFound, CodeNotFound, "File not found")
+		return
+	}
+
+	hash, err := utils.ImageBlurHash(h.store, name, components[0], components[1])
+	if errors.Is(err, fs.ErrNotExist) {
+		respondError(c, http.StatusNotFound, CodeNotFound, "File not found")
+		return
+	}
+	if errors.Is(err, utils.ErrTooManyPixels) {
+		respondError(c, http.StatusUnprocessableEntity, CodeImageTooLarge, "Image dimensions exceed the limit")
+		return
+	}
+	if err != nil {
+		h.logger.Warn("Error decoding image", "path", name, "error", err)
+		respondError(c, http.StatusUnsupportedMediaType, CodeUnsupportedFormat, "File is not a decodable image")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"blurhash": hash})
+}
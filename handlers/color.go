@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"strconv"
+
+	"ImageServer/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultPaletteSize = 5
+	maxPaletteSize     = 16
+)
+
+// ImageColors handles GET /api/v1/color/*path
+//
+// colors sets the palette size (1-16, default 5).
+func (h *APIHandler) ImageColors(c *gin.Context) {
+	name, err := utils.CleanName(c.Param("path"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidPath, "Invalid path")
+		return
+	}
+
+	colors := queryDefault(c.Request.URL.Query(), "colors", strconv.Itoa(defaultPaletteSize))
+	n, err := strconv.Atoi(colors)
+	if err != nil || n < 1 || n > maxPaletteSize {
+		respondError(c, http.StatusBadRequest, CodeInvalidParameter, "Invalid colors: "+colors)
+		return
+	}
+
+	if info, err := h.store.Stat(name); err != nil || info.IsDir() {
+		respondError(c, http.StatusNotFound, CodeNotFound, "File not found")
+		return
+	}
+
+	result, err := utils.ImageColors(h.store, name, n)
+	if errors.Is(err, fs.ErrNotExist) {
+		respondError(c, http.StatusNotFound, CodeNotFound, "File not found")
+		return
+	}
+	if errors.Is(err, utils.ErrTooManyPixels) {
+		respondError(c, http.StatusUnprocessableEntity, CodeImageTooLarge, "Image dimensions exceed the limit")
+		return
+	}
+	if err != nil {
+		h.logger.Warn("Error decoding image", "path", name, "error", err)
+		respondError(c, http.StatusUnsupportedMediaType, CodeUnsupportedFormat, "File is not a decodable image")
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
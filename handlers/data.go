@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"ImageServer/models"
+	"ImageServer/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UploadData handles POST /api/v1/images/data
+//
+// The image is sent as a base64 data URI in a JSON body, for clients such as
+// canvases that have no file to upload, and is then stored exactly like an
+// upload.
+func (h *APIHandler) UploadData(c *gin.Context) {
+	// Base64 takes four bytes for every three, plus room for the other fields
+	limit := h.config.MaxUploadBytes/3*4 + 4<<10
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+
+	var req models.DataUploadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			respondError(c, http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "Upload exceeds size limit")
+			return
+		}
+		respondError(c, http.StatusBadRequest, CodeInvalidParameter, "Expected JSON body with data and folder")
+		return
+	}
+
+	contentType, fileBytes, err := utils.ParseDataURI(req.Data)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidUpload, "Expected a base64 data URI")
+		return
+	}
+	if int64(len(fileBytes)) > h.config.MaxUploadBytes {
+		respondError(c, http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "Upload exceeds size limit")
+		return
+	}
+
+	format := strings.ToLower(req.Format)
+	if format == "" {
+		format = utils.ExtensionFor(contentType)
+	}
+	if format == "" {
+		respondError(c, http.StatusUnsupportedMediaType, CodeUnsupportedFormat, "Unsupported content type: "+contentType)
+		return
+	}
+	if err := h.checkUpload(req.Folder, req.ID, format); err != nil {
+		h.respondAPIError(c, err)
+		return
+	}
+
+	convert := h.config.ConvertOnUpload
+	if req.Convert != nil {
+		convert = *req.Convert
+	}
+
+	uploaded, err := h.storeUpload(req.Folder, req.ID, format, fileBytes, convert)
+	if err != nil {
+		h.respondAPIError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, uploaded)
+}
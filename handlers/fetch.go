@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"ImageServer/models"
+	"ImageServer/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errBlockedAddress is returned when a fetch would connect to a non-public
+// address.
+var errBlockedAddress = errors.New("address not allowed")
+
+// newFetchClient returns the HTTP client used to download remote images. It
+// refuses to connect to loopback, private, link-local and other non-public
+// addresses. The check runs on the resolved address of every connection,
+// redirects included, so DNS tricks cannot reach internal services.
+func newFetchClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil || !publicAddr(addrPort.Addr()) {
+				return errBlockedAddress
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			// A proxy would be dialed instead of the target, skipping the check
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return errBlockedAddress
+			}
+			return nil
+		},
+	}
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, which is not covered by
+// netip's IsPrivate.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// publicAddr reports whether addr is a globally routable unicast address.
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() &&
+		!addr.IsPrivate() &&
+		!sharedAddressSpace.Contains(addr)
+}
+
+// FetchImage handles POST /api/v1/images/fetch
+//
+// The remote image is downloaded and then stored like an upload, always
+// converted to PNG when CONVERTIBLE_TYPES allows it, whatever
+// CONVERT_ON_UPLOAD says. Its format is taken from the response
+// Content-Type unless the request names one.
+func (h *APIHandler) FetchImage(c *gin.Context) {
+	var req models.FetchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidParameter, "Expected JSON body with url and folder")
+		return
+	}
+
+	remote, err := url.Parse(req.URL)
+	if err != nil || (remote.Scheme != "http" && remote.Scheme != "https") || remote.Host == "" {
+		respondError(c, http.StatusBadRequest, CodeInvalidParameter, "Invalid url")
+		return
+	}
+
+	// Check the naming fields before spending a download on them; the
+	// format is checked again once it is known
+	if err := h.checkUpload(req.Folder, req.ID, "png"); err != nil {
+		h.respondAPIError(c, err)
+		return
+	}
+
+	fileBytes, contentType, err := h.download(c.Request.Context(), remote.String())
+	if err != nil {
+		h.respondAPIError(c, err)
+		return
+	}
+
+	format := strings.ToLower(req.Format)
+	if format == "" {
+		format = utils.ExtensionFor(contentType)
+	}
+	if format == "" {
+		respondError(c, http.StatusUnsupportedMediaType, CodeUnsupportedFormat, "Unsupported content type: "+contentType)
+		return
+	}
+	if err := h.checkUpload(req.Folder, req.ID, format); err != nil {
+		h.respondAPIError(c, err)
+		return
+	}
+
+	uploaded, err := h.storeUpload(req.Folder, req.ID, format, fileBytes, true)
+	if err != nil {
+		h.respondAPIError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, uploaded)
+}
+
+// download fetches a remote file of at most MaxUploadBytes, returning its
+// body and content type.
+func (h *APIHandler) download(ctx context.Context, remote string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, remote, nil)
+	if err != nil {
+		return nil, "", &apiError{http.StatusBadRequest, CodeInvalidParameter, "Invalid url"}
+	}
+
+	resp, err := h.fetcher.Do(req)
+	if err != nil {
+		h.logger.Warn("Error fetching remote image", "url", remote, "error", err)
+		var netErr net.Error
+		switch {
+		case errors.Is(err, errBlockedAddress):
+			return nil, "", &apiError{http.StatusBadRequest, CodeInvalidParameter, "URL resolves to a non-public address"}
+		case errors.As(err, &netErr) && netErr.Timeout():
+			return nil, "", &apiError{http.StatusGatewayTimeout, CodeTimeout, "Fetching the image took too long"}
+		}
+		return nil, "", &apiError{http.StatusBadGateway, CodeFetchFailed, "Error fetching image"}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", &apiError{http.StatusBadGateway, CodeFetchFailed, fmt.Sprintf("Remote server responded %d", resp.StatusCode)}
+	}
+
+	limit := h.config.MaxUploadBytes
+	if resp.ContentLength > limit {
+		return nil, "", &apiError{http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "Remote image exceeds size limit"}
+	}
+
+	// Read one byte past the limit to tell a full-sized file from a larger one
+	fileBytes, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		h.logger.Warn("Error reading remote image", "url", remote, "error", err)
+		return nil, "", &apiError{http.StatusBadGateway, CodeFetchFailed, "Error fetching image"}
+	}
+	if int64(len(fileBytes)) > limit {
+		return nil, "", &apiError{http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "Remote image exceeds size limit"}
+	}
+
+	return fileBytes, resp.Header.Get("Content-Type"), nil
+}
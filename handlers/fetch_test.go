@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ImageServer/config"
+	"ImageServer/models"
+)
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::1", false},
+		{"::", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:8.8.8.8", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := publicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Errorf("publicAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchBlocksPrivateAddresses(t *testing.T) {
+	var hits atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(pngFile(1, 1).Data)
+	}))
+	defer target.Close()
+	port := target.URL[strings.LastIndex(target.URL, ":"):]
+
+	tests := []struct {
+		name    string
+		url     string
+		status  int
+		message string
+	}{
+		{name: "loopback", url: target.URL + "/a.png", status: http.StatusBadRequest, message: "non-public"},
+		{name: "hostname resolving to loopback", url: "http://localhost" + port + "/a.png", status: http.StatusBadRequest, message: "non-public"},
+		{name: "ipv6 loopback", url: "http://[::1]" + port + "/a.png", status: http.StatusBadRequest, message: "non-public"},
+		{name: "private", url: "http://10.255.255.1/a.png", status: http.StatusBadRequest, message: "non-public"},
+		{name: "metadata service", url: "http://169.254.169.254/latest/meta-data/", status: http.StatusBadRequest, message: "non-public"},
+		{name: "file scheme", url: "file:///etc/passwd", status: http.StatusBadRequest, message: "Invalid url"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(&config.Config{FetchTimeout: 5 * time.Second, MaxUploadBytes: 1 << 20}, nil)
+			body := `{"url":"` + tt.url + `","folder":"fetched","id":"a"}`
+
+			w := serve(h.FetchImage, http.MethodPost, "/api/v1/images/fetch", body)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if !strings.Contains(w.Body.String(), tt.message) {
+				t.Errorf("body = %s, want %q", w.Body, tt.message)
+			}
+			if _, err := h.store.Stat("fetched"); err == nil {
+				t.Error("a blocked fetch stored a file")
+			}
+		})
+	}
+
+	if n := hits.Load(); n != 0 {
+		t.Errorf("the internal server was reached %d times", n)
+	}
+}
+
+func TestFetchImage(t *testing.T) {
+	var jpg bytes.Buffer
+	jpeg.Encode(&jpg, image.NewNRGBA(image.Rect(0, 0, 4, 4)), nil)
+	large := bytes.Repeat([]byte{0}, 2048)
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write(jpg.Bytes())
+		case "/a.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(pngFile(4, 4).Data)
+		case "/large.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(large)
+		case "/streamed.png":
+			// No Content-Length, so only reading tells the size
+			w.Header().Set("Content-Type", "image/png")
+			w.(http.Flusher).Flush()
+			w.Write(large)
+		case "/page":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html></html>"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer remote.Close()
+
+	tests := []struct {
+		name    string
+		path    string
+		convert bool
+		status  int
+		stored  string
+	}{
+		{name: "jpeg converted", path: "/a.jpg", status: http.StatusCreated, stored: "fetched/a.png"},
+		{name: "jpeg converted with CONVERT_ON_UPLOAD", path: "/a.jpg", convert: true, status: http.StatusCreated, stored: "fetched/a.png"},
+		{name: "png", path: "/a.png", status: http.StatusCreated, stored: "fetched/a.png"},
+		{name: "oversized", path: "/large.png", status: http.StatusRequestEntityTooLarge},
+		{name: "oversized without length", path: "/streamed.png", status: http.StatusRequestEntityTooLarge},
+		{name: "not an image", path: "/page", status: http.StatusUnsupportedMediaType},
+		{name: "missing", path: "/missing.png", status: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(&config.Config{
+				Domain:           "http://localhost",
+				MaxUploadBytes:   1024,
+				ConvertibleTypes: models.ConverableTypes,
+				ConvertOnUpload:  tt.convert,
+			}, nil)
+			// The test server is on loopback, which the real client refuses
+			h.fetcher = remote.Client()
+
+			body := `{"url":"` + remote.URL + tt.path + `","folder":"fetched","id":"a"}`
+			w := serve(h.FetchImage, http.MethodPost, "/api/v1/images/fetch", body)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			if tt.stored == "" {
+				if _, err := h.store.Stat("fetched"); err == nil {
+					t.Error("a failed fetch stored a file")
+				}
+				return
+			}
+			data, err := fs.ReadFile(h.store, tt.stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, format, err := image.Decode(bytes.NewReader(data)); err != nil || format != "png" {
+				t.Errorf("stored %s as %q, %v; want png", tt.stored, format, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"context"
+	"image"
+	"sync"
+	"time"
+)
+
+// flightGroup collapses concurrent generations of the same variant. Unlike
+// singleflight, it cancels a shared generation once every request waiting
+// for it has gone, so abandoned work does not keep a conversion slot.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is one generation and the requests waiting for it.
+type flight struct {
+	done    chan struct{}
+	img     image.Image
+	err     error
+	cancel  context.CancelFunc
+	waiters int
+}
+
+// join returns the running generation for key, starting fn in the
+// background when there is none. fn's context ends after timeout or once
+// every caller has left. Callers must either receive from done or leave.
+func (g *flightGroup) join(key string, timeout time.Duration, fn func(ctx context.Context) (image.Image, error)) *flight {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.flights == nil {
+		g.flights = map[string]*flight{}
+	}
+	if f := g.flights[key]; f != nil {
+		f.waiters++
+		return f
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	f := &flight{done: make(chan struct{}), cancel: cancel, waiters: 1}
+	g.flights[key] = f
+
+	go func() {
+		defer cancel()
+		f.img, f.err = fn(ctx)
+
+		g.mu.Lock()
+		if g.flights[key] == f {
+			delete(g.flights, key)
+		}
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	return f
+}
+
+// leave stops waiting for f, cancelling it when no caller is left. A
+// cancelled flight is forgotten at once, so later requests start afresh
+// instead of joining work that is being torn down.
+func (g *flightGroup) leave(key string, f *flight) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	f.waiters--
+	if f.waiters > 0 {
+		return
+	}
+	f.cancel()
+	if g.flights[key] == f {
+		delete(g.flights, key)
+	}
+}
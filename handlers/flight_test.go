@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"ImageServer/config"
+	"ImageServer/models"
+)
+
+func TestSingleGeneration(t *testing.T) {
+	h := newTestImageHandler(&config.Config{
+		ConvertibleTypes: models.ConverableTypes,
+		MaxConversions:   4,
+	}, fstest.MapFS{"a.png": pngFile(40, 40)})
+	// Slow enough that every request arrives while the variant is written
+	cache := &trackedCache{Storage: h.cache, delay: 100 * time.Millisecond}
+	h.cache = cache
+
+	targets := make([]string, 20)
+	for i := range targets {
+		targets[i] = "/a.png?width=10"
+	}
+	responses := serveConcurrently(h, targets)
+
+	for i, w := range responses {
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want 200: %s", i, w.Code, w.Body)
+		}
+		img, err := png.Decode(bytes.NewReader(w.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if img.Bounds().Dx() != 10 {
+			t.Errorf("request %d: width = %d, want 10", i, img.Bounds().Dx())
+		}
+		if !bytes.Equal(w.Body.Bytes(), responses[0].Body.Bytes()) {
+			t.Errorf("request %d got different bytes than request 0", i)
+		}
+	}
+
+	if len(cache.created) != 1 {
+		t.Errorf("wrote %v, want a single variant", cache.created)
+	}
+	for name, count := range cache.created {
+		if count != 1 {
+			t.Errorf("%s generated %d times, want once", name, count)
+		}
+	}
+}
+
+func TestFlightGroup(t *testing.T) {
+	var g flightGroup
+	started := make(chan struct{}, 2)
+	fn := func(ctx context.Context) (image.Image, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	first := g.join("a", time.Minute, fn)
+	second := g.join("a", time.Minute, fn)
+	if first != second {
+		t.Fatal("concurrent joins started separate flights")
+	}
+	<-started
+
+	// The flight keeps running while anyone waits for it
+	g.leave("a", first)
+	select {
+	case <-first.done:
+		t.Fatal("flight ended while a caller was still waiting")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// and is cancelled and forgotten once the last caller leaves
+	g.leave("a", second)
+	select {
+	case <-first.done:
+	case <-time.After(time.Second):
+		t.Fatal("flight kept running after every caller left")
+	}
+	if !errors.Is(first.err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", first.err)
+	}
+
+	errFresh := errors.New("fresh")
+	third := g.join("a", time.Minute, func(ctx context.Context) (image.Image, error) {
+		return nil, errFresh
+	})
+	<-third.done
+	if third == first || !errors.Is(third.err, errFresh) {
+		t.Errorf("join after cancel = %v, want a fresh flight", third.err)
+	}
+}
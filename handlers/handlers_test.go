@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing/fstest"
+	"time"
+
+	"ImageServer/config"
+	"ImageServer/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newTestHandler returns an APIHandler over in-memory storage seeded with
+// files.
+func newTestHandler(cfg *config.Config, files fstest.MapFS) *APIHandler {
+	if cfg == nil {
+		cfg = &config.Config{}
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return NewAPIHandler(cfg, storage.NewMemoryFrom(files), storage.NewMemory(), logger)
+}
+
+// newTestImageHandler returns an ImageHandler over in-memory storage seeded
+// with files.
+func newTestImageHandler(cfg *config.Config, files fstest.MapFS) *ImageHandler {
+	if cfg.MaxConversions == 0 {
+		cfg.MaxConversions = 1
+	}
+	if cfg.Interpolator == "" {
+		cfg.Interpolator = "catmullrom"
+	}
+	if cfg.ConversionTimeout == 0 {
+		cfg.ConversionTimeout = 10 * time.Second
+		cfg.ConversionWait = 10 * time.Second
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return NewImageHandler(cfg, storage.NewMemoryFrom(files), storage.NewMemory(), nil, nil, logger)
+}
+
+// serve runs handler on a request with the given method, target and body,
+// binding params as gin path parameters.
+func serve(handler gin.HandlerFunc, method, target, body string, params ...gin.Param) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(method, target, bytes.NewBufferString(body))
+	if body != "" {
+		c.Request.Header.Set("Content-Type", "application/json")
+	}
+	c.Params = params
+	handler(c)
+	// As gin's engine does, for handlers that only set a status
+	c.Writer.WriteHeaderNow()
+	return w
+}
+
+// serveWithHeader is serve for a GET request carrying one extra header.
+func serveWithHeader(handler gin.HandlerFunc, target, key, value string, params ...gin.Param) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, target, nil)
+	if value != "" {
+		c.Request.Header.Set(key, value)
+	}
+	c.Params = params
+	handler(c)
+	// As gin's engine does, for handlers that only set a status
+	c.Writer.WriteHeaderNow()
+	return w
+}
+
+// serveUpload runs handler on a multipart POST carrying fields and, unless
+// data is nil, a file in the "file" field.
+func serveUpload(handler gin.HandlerFunc, fields map[string]string, data []byte) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for key, value := range fields {
+		mw.WriteField(key, value)
+	}
+	if data != nil {
+		fw, _ := mw.CreateFormFile("file", "upload")
+		fw.Write(data)
+	}
+	mw.Close()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/images", &body)
+	c.Request.Header.Set("Content-Type", mw.FormDataContentType())
+	handler(c)
+	return w
+}
+
+// file returns a MapFile holding data.
+func file(data string) *fstest.MapFile {
+	return &fstest.MapFile{Data: []byte(data), Mode: 0644}
+}
+
+// pngFile returns a MapFile holding a blank PNG of the given size.
+func pngFile(width, height int) *fstest.MapFile {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, width, height)))
+	return &fstest.MapFile{Data: buf.Bytes(), Mode: 0644}
+}
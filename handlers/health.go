@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+
+	"ImageServer/config"
+	"ImageServer/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+type HealthHandler struct {
+	config *config.Config
+	store  storage.Storage
+	logger *slog.Logger
+}
+
+func NewHealthHandler(cfg *config.Config, store storage.Storage, logger *slog.Logger) *HealthHandler {
+	return &HealthHandler{config: cfg, store: store, logger: logger}
+}
+
+// Healthz handles GET /healthz. It only reports that the process is serving.
+func (h *HealthHandler) Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readyz handles GET /readyz. The server is ready when the storage root
+// exists and a file can be created in it.
+func (h *HealthHandler) Readyz(c *gin.Context) {
+	info, err := h.store.Stat(".")
+	if err != nil || !info.IsDir() {
+		h.logger.Warn("Storage unavailable", "backend", h.config.StorageBackend, "error", err)
+		respondError(c, http.StatusServiceUnavailable, CodeNotReady, "Storage unavailable")
+		return
+	}
+
+	// Dot-prefixed so a concurrent listing never shows it
+	if err := storage.WriteFile(h.store, ".readyz", nil); err != nil {
+		h.logger.Warn("Storage not writable", "backend", h.config.StorageBackend, "error", err)
+		respondError(c, http.StatusServiceUnavailable, CodeNotReady, "Storage not writable")
+		return
+	}
+	h.store.Remove(".readyz")
+
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
@@ -1,14 +1,30 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io/fs"
+	"log/slog"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"ImageServer/config"
+	"ImageServer/metrics"
+	"ImageServer/middleware"
 	"ImageServer/models"
+	"ImageServer/storage"
 	"ImageServer/utils"
 
 	"github.com/gin-gonic/gin"
@@ -16,170 +32,767 @@ import (
 
 type ImageHandler struct {
 	config *config.Config
+	store  storage.Storage
+	cache  storage.Storage
+	logger *slog.Logger
+
+	// conversions holds one token per variant being generated
+	conversions chan struct{}
+	// flights collapses concurrent requests for the same variant
+	flights flightGroup
+	// watermark is drawn by the watermark variant, nil when not configured
+	watermark *utils.Watermark
+	// decoded keeps recently decoded originals for further variants
+	decoded *utils.DecodedCache
+	// janitor learns which cached variants are used, nil without a budget
+	janitor *utils.CacheJanitor
+}
+
+func NewImageHandler(cfg *config.Config, store, cache storage.Storage, watermark *utils.Watermark, janitor *utils.CacheJanitor, logger *slog.Logger) *ImageHandler {
+	return &ImageHandler{
+		config:      cfg,
+		store:       store,
+		cache:       cache,
+		logger:      logger,
+		conversions: make(chan struct{}, cfg.MaxConversions),
+		watermark:   watermark,
+		decoded:     utils.NewDecodedCache(cfg.DecodedCacheBytes),
+		janitor:     janitor,
+	}
 }
 
-func NewImageHandler(cfg *config.Config) *ImageHandler {
-	return &ImageHandler{config: cfg}
+// errBusy is returned when no conversion slot frees up in time.
+var errBusy = errors.New("too many conversions in progress")
+
+// generate runs ReadImage once a conversion slot is available, waiting at
+// most ConversionWait for one. Concurrent calls for the same variantName
+// share a single generation. A caller whose ctx ends, or who waits longer
+// than ConversionTimeout, stops waiting; the generation itself is cancelled
+// when no caller is left or ConversionTimeout passes, and any partly written
+// variant is discarded.
+func (h *ImageHandler) generate(ctx context.Context, name string, variant utils.Variant, target, variantName string, opts utils.EncodeOptions) (image.Image, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.config.ConversionTimeout)
+	defer cancel()
+
+	f := h.flights.join(variantName, h.config.ConversionTimeout, func(ctx context.Context) (image.Image, error) {
+		timer := time.NewTimer(h.config.ConversionWait)
+		defer timer.Stop()
+
+		select {
+		case h.conversions <- struct{}{}:
+		case <-timer.C:
+			return nil, errBusy
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		defer func() { <-h.conversions }()
+
+		return utils.ReadImage(ctx, h.store, h.decoded, name, variant, target, h.cache, variantName, opts)
+	})
+
+	select {
+	case <-f.done:
+		return f.img, f.err
+	case <-ctx.Done():
+		h.flights.leave(variantName, f)
+		return nil, ctx.Err()
+	}
 }
 
 // ServeImage handles image serving at root level (e.g., /path/to/image.png)
 func (h *ImageHandler) ServeImage(c *gin.Context) {
+	metrics.ImageRequests.Inc()
+
 	imagePath := c.Param("filepath")
+	log := h.logger.With("path", imagePath, "request_id", c.GetString(middleware.RequestIDKey))
+
+	// Security: resolve the path inside the storage root, rejecting
+	// directory traversal attacks
+	name, err := utils.CleanName(imagePath)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidPath, "Invalid path")
+		return
+	}
+
+	if h.config.SignedURLsRequired && !h.checkSignature(c, name) {
+		return
+	}
+
+	_, protected := h.folderToken(name)
+	if protected && !h.checkFolderToken(c, name) {
+		return
+	}
+
+	query := c.Request.URL.Query()
 
-	// Security: Clean the path and prevent directory traversal attacks
-	cleanPath := filepath.Clean(imagePath)
-	
-	// Remove leading slash if present
-	if len(cleanPath) > 0 && cleanPath[0] == '/' {
-		cleanPath = cleanPath[1:]
+	// Shared caches must not hand protected images to clients without the
+	// token or signature, and a signed URL must stop working when it
+	// expires. The header is only sent with the image itself, see serveFile
+	maxAge := h.maxAge()
+	if h.config.SignedURLsRequired {
+		protected = true
+		maxAge = min(maxAge, signedMaxAge(query, time.Now()))
+	}
+	if protected {
+		c.Set(cacheControlKey, fmt.Sprintf("private, max-age=%d", maxAge))
+	} else {
+		c.Set(cacheControlKey, fmt.Sprintf("public, max-age=%d", maxAge))
 	}
-	
-	// Prevent directory traversal by checking for ".." components
-	if filepath.IsAbs(cleanPath) || containsPathTraversal(cleanPath) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
+
+	// variant=original and raw=true serve the stored bytes, whatever else
+	// the query asks for
+	if query.Get("variant") == "original" || query.Get("raw") == "true" {
+		h.serveOriginal(c, name)
 		return
 	}
 
-	// Get absolute path of the configured directory
-	baseDir, err := filepath.Abs(h.config.Path)
+	variant, err := h.parseVariant(query)
 	if err != nil {
-		println(err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server configuration error"})
+		respondError(c, http.StatusBadRequest, CodeInvalidParameter, err.Error())
 		return
 	}
+	log = log.With("variant", variant.Key())
 
-	// Join the cleaned path with the base directory
-	filePath := filepath.Join(baseDir, cleanPath)
-	
-	// Get absolute path of the requested file
-	absFilePath, err := filepath.Abs(filePath)
+	opts, err := h.parseEncodeOptions(query)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
+		respondError(c, http.StatusBadRequest, CodeInvalidParameter, err.Error())
 		return
 	}
-	
-	// Ensure the resolved path is still within the base directory
-	if !isWithinDirectory(absFilePath, baseDir) {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+	if variant.DPR > 1 {
+		c.Header("Content-DPR", strconv.Itoa(variant.DPR))
+	}
+
+	// a.jpeg and a.jpg name the same stored file
+	name = utils.ResolveAlias(h.store, name)
+	format := strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+
+	// Files stored without an extension are identified by their content
+	if format == "" {
+		format, err = utils.SniffExtension(h.store, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			h.imageNotFound(c)
+			return
+		}
+		if err != nil {
+			log.Error("Error reading image", "error", err)
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Error reading image")
+			return
+		}
+		if format == "" {
+			respondError(c, http.StatusUnsupportedMediaType, CodeUnsupportedFormat, "Not a supported image")
+			return
+		}
+	}
+
+	if !models.SupportedTypes.Has(format) {
+		respondError(c, http.StatusBadRequest, CodeUnsupportedFormat, "Unsupported format: "+format)
 		return
 	}
 
+	// Output format defaults to the requested extension, or to the best
+	// format the client accepts with AUTO_FORMAT
+	target := strings.ToLower(c.Query("format"))
+	if target == "" {
+		target = format
+		if h.negotiable(format) {
+			c.Writer.Header().Add("Vary", "Accept")
+			target = h.negotiateFormat(c.GetHeader("Accept"), format)
+		}
+	}
 
-	variant := c.Query("variant")
+	if models.CanonicalExt(target) == models.CanonicalExt(format) {
+		target = format
+	}
 
-	// Set caching headers
-	c.Header("Cache-Control", "public, max-age=31536000")
+	if !models.SupportedTypes.Has(target) {
+		respondError(c, http.StatusUnsupportedMediaType, CodeUnsupportedFormat, "Unsupported format: "+target)
+		return
+	}
+	// AVIF and SVG are stored and served but cannot be written, so asking
+	// for them as output fails here rather than after finding the original
+	if target != format && !utils.CanEncode(target) {
+		respondError(c, http.StatusUnsupportedMediaType, CodeUnsupportedFormat, notOutputFormat(target))
+		return
+	}
 
-	format := path.Ext(filePath)[1:]
-	// Get path without extension
+	// download=true saves the image under its own name, with the extension
+	// of the format it is sent in
+	if query.Get("download") == "true" {
+		base := path.Base(name)
+		filename := strings.TrimSuffix(base, path.Ext(base)) + "." + target
+		c.Set(dispositionKey, mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	}
 
-	if format != "" && !models.SupportedTypes.Has(format) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported format: " + format})
+	// generate=identicon stands in for missing avatars
+	if c.Query("generate") == "identicon" {
+		if file, err := utils.FindImage(h.store, name); err == nil {
+			file.Close()
+		} else {
+			h.serveIdenticon(c, imagePath, name, variant, target, opts)
+			return
+		}
+	}
+
+	// SVG is vector data: it is served as-is and variants do not apply
+	if format == "svg" {
+		if target != format {
+			respondError(c, http.StatusUnsupportedMediaType, CodeUnsupportedFormat, "SVG cannot be converted to "+target)
+			return
+		}
+		svgHeaders(c)
+		h.serveFile(c, h.store, name)
 		return
 	}
 
-	if !models.ConverableTypes.Has(format) {
-		c.File(filePath)
+	if !h.config.ConvertibleTypes.Has(format) && target == format {
+		h.serveFile(c, h.store, name)
 		return
 	}
 
-	if variant == "" {
-		if _, err = os.Stat(absFilePath); err == nil {
-			c.File(absFilePath)
+	// Originals larger than the configured cap are served as a capped variant
+	if cap := h.config.DefaultMaxDimension; cap > 0 && variant.Name == "" {
+		if width, height, err := utils.Dimensions(h.store, name); err == nil && (width > cap || height > cap) {
+			variant.Name = "resize"
+			variant.Width, variant.Height = cap, cap
+			log = log.With("variant", variant.Key())
+		}
+	}
+
+	if variant.Key() == "" && target == format && opts.Quality == 0 {
+		if _, err = h.store.Stat(name); err == nil {
+			h.serveFile(c, h.store, name)
 			return
 		} else {
-			println("Not found: " + absFilePath)
+			log.Debug("Original not found", "file", name)
 		}
 	}
 
+	// Anything past this point is generated and needs an encoder
+	if !h.config.ConvertibleTypes.Has(target) || !utils.CanEncode(target) {
+		respondError(c, http.StatusUnsupportedMediaType, CodeUnsupportedFormat, "Encoding to "+target+" is not available")
+		return
+	}
 
-	variantPath := filePath +  "." + variant + "." + format
+	variantName := h.variantName(name, variant, opts, target)
 
-	// If variantPath exists serve it directly
-	if _, err = os.Stat(variantPath); err == nil {
-		c.File(variantPath)
+	// If the variant is cached serve it directly
+	if h.cachedVariant(variantName) {
+		metrics.VariantCache.WithLabelValues("hit").Inc()
+		h.serveVariant(c, variantName)
 		return
 	} else {
-		println("Not found: " + variantPath)
+		log.Debug("Variant cache miss", "file", variantName)
+	}
+
+	// HEAD never generates variants, it answers from the original
+	if c.Request.Method == http.MethodHead {
+		h.headVariant(c, name, variantName)
+		return
+	}
+
+	metrics.VariantCache.WithLabelValues("miss").Inc()
+	log.Info("Generating variant", "file", variantName)
+
+	img, err := h.generate(c.Request.Context(), name, variant, target, variantName, opts)
+
+	if errors.Is(err, errBusy) {
+		log.Warn("Conversion queue full")
+		c.Header("Retry-After", "1")
+		respondError(c, http.StatusServiceUnavailable, CodeBusy, "Too many conversions in progress, retry later")
+		return
+	}
+
+	if errors.Is(err, context.Canceled) {
+		log.Info("Client went away during generation")
+		respondError(c, statusClientClosedRequest, CodeCanceled, "Request canceled")
+		return
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Warn("Variant generation timed out")
+		c.Header("Retry-After", "1")
+		respondError(c, http.StatusServiceUnavailable, CodeTimeout, "Generating the variant took too long, retry later")
+		return
 	}
 
-	println("Generate variant: " + variantPath)
-	
-	img, err := utils.ReadImage(absFilePath, variant, format, variantPath)
+	if errors.Is(err, utils.ErrEncoderUnavailable) {
+		respondError(c, http.StatusUnsupportedMediaType, CodeUnsupportedFormat, "Encoding to "+target+" is not available")
+		return
+	}
+
+	if errors.Is(err, utils.ErrTooManyPixels) {
+		log.Warn("Image exceeds pixel limit")
+		respondError(c, http.StatusUnprocessableEntity, CodeImageTooLarge, "Image dimensions exceed the limit")
+		return
+	}
 
 	if err != nil {
-		println(err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading image"})
+		log.Error("Error generating variant", "error", err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Error reading image")
 		return
 	}
 
 	if img == nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		h.imageNotFound(c)
 		return
 	}
 
-	if _, err = os.Stat(variantPath); err == nil {
-		c.File(variantPath)
-		return
-	} else {
-		println("Not found after create: " + variantPath)
+	if _, err = h.cache.Stat(variantName); err != nil {
+		log.Warn("Variant missing after generation", "file", variantName)
 	}
 
-	c.Status(http.StatusCreated)
-	c.File(variantPath)
+	h.serveVariant(c, variantName)
 }
 
-// containsPathTraversal checks if the path contains directory traversal sequences
-func containsPathTraversal(path string) bool {
-	// Check for various forms of path traversal
-	return filepath.Clean(path) != path || 
-		   filepath.IsAbs(path) ||
-		   filepath.VolumeName(path) != "" ||
-		   containsTraversalSequences(path)
+const (
+	// maxDimension bounds the width and height a variant may request.
+	maxDimension = 4096
+
+	defaultBlurRadius = 8
+	maxBlurRadius     = 64
+
+	defaultWatermarkPosition = "bottom-right"
+	defaultWatermarkOpacity  = 0.5
+
+	// maxDPR bounds the device pixel ratio multiplier.
+	maxDPR = 3
+)
+
+// notOutputFormat is the error message for a requested output format the
+// server cannot encode.
+func notOutputFormat(target string) string {
+	return target + " is not an output format, use one of " + strings.Join(utils.OutputFormats(), ", ")
 }
 
-// containsTraversalSequences checks for explicit traversal sequences
-func containsTraversalSequences(path string) bool {
-	// Normalize path separators to forward slashes
-	normalizedPath := filepath.ToSlash(path)
-	
-	// Split by forward slashes to get path components
-	parts := strings.Split(normalizedPath, "/")
-	
-	// Check each component for traversal sequences
-	for _, part := range parts {
-		if part == ".." {
-			return true
+// variantName returns the name the variant of an original is cached under.
+func (h *ImageHandler) variantName(name string, variant utils.Variant, opts utils.EncodeOptions, target string) string {
+	key := variant.Key()
+	if opts.Quality != 0 {
+		key += ".q" + strconv.Itoa(opts.Quality)
+	}
+	if opts.Progressive && (target == "jpg" || target == "jpeg") {
+		key += ".progressive"
+	}
+	return utils.VariantCacheName(name, key, target)
+}
+
+// queryDefault returns the query value for key, or def when it is absent.
+func queryDefault(query url.Values, key, def string) string {
+	if value := query.Get(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// negotiatedFormats are the formats AUTO_FORMAT may pick, best first. AVIF
+// belongs first once it can be encoded, see utils.CanEncode.
+var negotiatedFormats = []string{"webp"}
+
+// negotiable reports whether requests for originals of the given format
+// have their output picked from the Accept header. Animated GIFs and SVGs
+// are left alone.
+func (h *ImageHandler) negotiable(format string) bool {
+	return h.config.AutoFormat && format != "gif" && format != "svg" && h.config.ConvertibleTypes.Has(format)
+}
+
+// negotiateFormat returns the best format from negotiatedFormats that the
+// Accept header lists and the server can encode, or format when there is
+// none. Wildcards do not count since browsers always send them.
+func (h *ImageHandler) negotiateFormat(accept, format string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q <= 0 {
+			continue
 		}
+		accepted[mediaType] = true
 	}
-	
-	return false
+
+	for _, candidate := range negotiatedFormats {
+		if candidate == format {
+			return format
+		}
+		if accepted["image/"+candidate] && utils.CanEncode(candidate) && h.config.ConvertibleTypes.Has(candidate) {
+			return candidate
+		}
+	}
+	return format
+}
+
+// parseEncodeOptions reads the encoding query parameters.
+func (h *ImageHandler) parseEncodeOptions(query url.Values) (utils.EncodeOptions, error) {
+	opts := utils.EncodeOptions{Progressive: h.config.ProgressiveJPEG}
+	if quality := query.Get("quality"); quality != "" {
+		q, err := strconv.Atoi(quality)
+		if err != nil || q < 1 || q > 100 {
+			return opts, errors.New("Invalid quality: " + quality)
+		}
+		opts.Quality = q
+	}
+	if progressive := query.Get("progressive"); progressive != "" {
+		p, err := strconv.ParseBool(progressive)
+		if err != nil {
+			return opts, errors.New("Invalid progressive: " + progressive)
+		}
+		opts.Progressive = p
+	}
+	return opts, nil
 }
 
-// isWithinDirectory checks if the target path is within the base directory
-func isWithinDirectory(targetPath, baseDir string) bool {
-	// Convert both paths to absolute paths with consistent separators
-	targetAbs, err := filepath.Abs(targetPath)
+// parseVariant reads the variant query parameters.
+func (h *ImageHandler) parseVariant(query url.Values) (utils.Variant, error) {
+	variant := utils.Variant{
+		Name:      query.Get("variant"),
+		Grayscale: query.Get("grayscale") == "true",
+	}
+
+	blur := query.Get("blur")
+	tint := query.Get("tint")
+	watermark := query.Get("watermark") == "true"
+
+	switch variant.Name {
+	case "":
+		width, err := parseDimension(query, "width")
+		if err != nil {
+			return variant, err
+		}
+		height, err := parseDimension(query, "height")
+		if err != nil {
+			return variant, err
+		}
+		if width != 0 || height != 0 {
+			variant.Name = "resize"
+			variant.Width, variant.Height = width, height
+		}
+	case "preview":
+	case "grayscale", "bw":
+		variant.Name = ""
+		variant.Grayscale = true
+	case "blur":
+		variant.Name = ""
+		blur = queryDefault(query, "radius", strconv.Itoa(defaultBlurRadius))
+	case "watermark":
+		variant.Name = ""
+		watermark = true
+	case "tint":
+		variant.Name = ""
+		tint = query.Get("color")
+		if tint == "" {
+			return variant, errors.New("tint requires color")
+		}
+	case "crop":
+		width, err := parseDimension(query, "w")
+		if err != nil {
+			return variant, err
+		}
+		height, err := parseDimension(query, "h")
+		if err != nil {
+			return variant, err
+		}
+		if width == 0 && height == 0 {
+			return variant, errors.New("crop requires w or h")
+		}
+		// A single dimension crops to a square
+		if width == 0 {
+			width = height
+		}
+		if height == 0 {
+			height = width
+		}
+		variant.Width, variant.Height = width, height
+
+		variant.Gravity = queryDefault(query, "gravity", "center")
+		if !slices.Contains(utils.Gravities, variant.Gravity) {
+			return variant, errors.New("Invalid gravity: " + variant.Gravity)
+		}
+	default:
+		return variant, errors.New("Unknown variant: " + variant.Name)
+	}
+
+	// dpr multiplies explicitly requested dimensions for high density displays
+	if dpr := query.Get("dpr"); dpr != "" && (variant.Width != 0 || variant.Height != 0) {
+		n, err := strconv.Atoi(dpr)
+		if err != nil || n < 1 {
+			return variant, errors.New("Invalid dpr: " + dpr)
+		}
+		n = min(n, maxDPR)
+		if variant.Width*n > maxDimension || variant.Height*n > maxDimension {
+			return variant, errors.New("Dimensions too large for dpr: " + dpr)
+		}
+		if n > 1 {
+			variant.Width *= n
+			variant.Height *= n
+			variant.DPR = n
+		}
+	}
+
+	if blur != "" {
+		radius, err := strconv.Atoi(blur)
+		if err != nil || radius < 1 || radius > maxBlurRadius {
+			return variant, errors.New("Invalid blur radius: " + blur)
+		}
+		variant.BlurRadius = radius
+	}
+
+	if tint != "" {
+		c, err := utils.ParseHexColor(tint)
+		if err != nil {
+			return variant, errors.New("Invalid color: " + tint)
+		}
+		variant.Tint = c
+	}
+
+	variant.Interp = queryDefault(query, "interp", h.config.Interpolator)
+	if _, ok := utils.Interpolators[variant.Interp]; !ok {
+		return variant, errors.New("Invalid interp: " + variant.Interp)
+	}
+
+	if watermark {
+		if h.watermark == nil {
+			return variant, errors.New("Watermark is not configured")
+		}
+		variant.Watermark = h.watermark
+
+		variant.WatermarkPosition = queryDefault(query, "pos", defaultWatermarkPosition)
+		if !slices.Contains(utils.WatermarkPositions, variant.WatermarkPosition) {
+			return variant, errors.New("Invalid pos: " + variant.WatermarkPosition)
+		}
+
+		opacity := queryDefault(query, "opacity", strconv.FormatFloat(defaultWatermarkOpacity, 'g', -1, 64))
+		o, err := strconv.ParseFloat(opacity, 64)
+		if err != nil || !(o > 0 && o <= 1) {
+			return variant, errors.New("Invalid opacity: " + opacity)
+		}
+		variant.WatermarkOpacity = o
+	}
+
+	if rotate := query.Get("rotate"); rotate != "" {
+		degrees, err := strconv.Atoi(rotate)
+		if err != nil || !slices.Contains(utils.Rotations, degrees) {
+			return variant, errors.New("Invalid rotate: " + rotate)
+		}
+		variant.Rotate = degrees
+	}
+
+	if flip := query.Get("flip"); flip != "" {
+		if !slices.Contains(utils.Flips, flip) {
+			return variant, errors.New("Invalid flip: " + flip)
+		}
+		variant.Flip = flip
+	}
+
+	return variant, nil
+}
+
+// parseDimension reads an optional pixel size, returning 0 when absent.
+func parseDimension(query url.Values, key string) (int, error) {
+	value := query.Get(key)
+	if value == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > maxDimension {
+		return 0, fmt.Errorf("Invalid %s: %s", key, value)
+	}
+	return n, nil
+}
+
+// serveOriginal serves the stored file behind name byte for byte, found
+// with the same extension fallbacks as any image. No variant, format
+// negotiation or size cap applies.
+func (h *ImageHandler) serveOriginal(c *gin.Context, name string) {
+	found, err := utils.FindImageName(h.store, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		h.imageNotFound(c)
+		return
+	}
 	if err != nil {
-		return false
+		h.logger.Error("Error reading image", "path", name, "error", err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Error reading image")
+		return
+	}
+
+	if c.Query("download") == "true" {
+		c.Set(dispositionKey, mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(found)}))
 	}
-	
-	baseAbs, err := filepath.Abs(baseDir)
+	// The bytes are sent unexamined, so an SVG, even one stored without its
+	// extension, must not be able to run scripts
+	svgHeaders(c)
+	h.serveFile(c, h.store, found)
+}
+
+// svgHeaders keeps scripts in a served SVG from running, should one slip
+// past upload sanitizing.
+func svgHeaders(c *gin.Context) {
+	c.Header("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src data:")
+	c.Header("X-Content-Type-Options", "nosniff")
+}
+
+// cachedVariant reports whether variantName is cached and younger than
+// VARIANT_TTL. Expired variants are regenerated, replacing the old file.
+func (h *ImageHandler) cachedVariant(variantName string) bool {
+	info, err := h.cache.Stat(variantName)
 	if err != nil {
 		return false
 	}
-	
-	// Ensure both paths end with separator for proper comparison
-	if !filepath.IsAbs(targetAbs) || !filepath.IsAbs(baseAbs) {
-		return false
+	return h.config.VariantTTL <= 0 || time.Since(info.ModTime()) < h.config.VariantTTL
+}
+
+// maxAge is how many seconds clients may cache served images: a year, or
+// VARIANT_TTL when set so browsers pick up regenerated variants.
+func (h *ImageHandler) maxAge() int {
+	if h.config.VariantTTL > 0 {
+		return int(h.config.VariantTTL.Seconds())
 	}
-	
-	// Check if target path starts with base directory path
-	rel, err := filepath.Rel(baseAbs, targetAbs)
+	return 31536000
+}
+
+// serveVariant serves a cached variant, marking it recently used so the
+// janitor evicts it last.
+func (h *ImageHandler) serveVariant(c *gin.Context, variantName string) {
+	h.janitor.Touch(variantName)
+	h.serveFile(c, h.cache, variantName)
+}
+
+// cacheControlKey and dispositionKey hold the Cache-Control and
+// Content-Disposition headers ServeImage picked for the request. serveFile
+// applies them, so error responses never carry them.
+const (
+	cacheControlKey = "cacheControl"
+	dispositionKey  = "disposition"
+)
+
+// serveFile writes the file with an explicit Content-Type so files stored
+// without an extension are not served as application/octet-stream. The ETag
+// is derived from size and modification time; http.ServeContent then answers
+// Range and If-Range requests with 206, If-None-Match and If-Modified-Since
+// with 304, and sets Last-Modified.
+func (h *ImageHandler) serveFile(c *gin.Context, fsys fs.FS, name string) {
+	file, err := fsys.Open(name)
 	if err != nil {
-		return false
+		h.imageNotFound(c)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		h.imageNotFound(c)
+		return
+	}
+
+	content, err := storage.ReadSeeker(file)
+	if err != nil {
+		h.logger.Error("Error reading file", "path", name, "error", err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Error reading image")
+		return
+	}
+
+	h.servedHeaders(c)
+	c.Header("ETag", fmt.Sprintf("\"%x-%x\"", info.Size(), info.ModTime().UnixNano()))
+	c.Header("Content-Type", utils.ContentType(fsys, name))
+	http.ServeContent(c.Writer, c.Request, info.Name(), info.ModTime(), content)
+}
+
+// servedHeaders applies the Cache-Control and Content-Disposition headers
+// ServeImage picked for the request.
+func (h *ImageHandler) servedHeaders(c *gin.Context) {
+	if cacheControl := c.GetString(cacheControlKey); cacheControl != "" && c.Writer.Header().Get("Cache-Control") == "" {
+		c.Header("Cache-Control", cacheControl)
+	}
+	if disposition := c.GetString(dispositionKey); disposition != "" {
+		c.Header("Content-Disposition", disposition)
+	}
+}
+
+// headVariant answers a HEAD request for a variant that is not cached yet.
+// The image exists when its original does; Content-Length and ETag are left
+// out since they are only known once the variant is generated.
+func (h *ImageHandler) headVariant(c *gin.Context, name, variantName string) {
+	file, err := utils.FindImage(h.store, name)
+	if err != nil {
+		h.imageNotFound(c)
+		return
+	}
+	info, err := file.Stat()
+	file.Close()
+	if err != nil || info.IsDir() {
+		h.imageNotFound(c)
+		return
+	}
+
+	h.servedHeaders(c)
+	c.Header("Content-Type", utils.ContentType(h.cache, variantName))
+	c.Header("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	c.Status(http.StatusOK)
+}
+
+// defaultIdenticonSize is used when the request has no width or height.
+const defaultIdenticonSize = 256
+
+// serveIdenticon serves, generating and caching on first use, an identicon
+// seeded by the requested path.
+func (h *ImageHandler) serveIdenticon(c *gin.Context, imagePath, name string, variant utils.Variant, target string, opts utils.EncodeOptions) {
+	if !utils.CanEncode(target) {
+		respondError(c, http.StatusUnsupportedMediaType, CodeUnsupportedFormat, "Encoding to "+target+" is not available")
+		return
+	}
+
+	size := max(variant.Width, variant.Height)
+	if size == 0 {
+		size = defaultIdenticonSize
+	}
+
+	identicon := utils.Variant{Name: "identicon", Width: size, Height: size}
+	variantName := h.variantName(name, identicon, opts, target)
+
+	if _, err := h.cache.Stat(variantName); err != nil {
+		seed := path.Clean("/" + imagePath)
+		if err := utils.SaveIdenticon(h.cache, variantName, seed, size, target, opts); err != nil {
+			h.logger.Error("Error generating identicon", "path", imagePath, "error", err)
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Error generating identicon")
+			return
+		}
 	}
-	
-	// If the relative path starts with "..", it's outside the base directory
-	return !filepath.IsAbs(rel) && !containsTraversalSequences(rel)
+
+	// A real image may be uploaded later, so clients revalidate
+	c.Header("Cache-Control", "no-cache")
+	h.serveVariant(c, variantName)
+}
+
+// transparentPNG is the fallback served when no FALLBACK_IMAGE is configured.
+var transparentPNG = func() []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 1, 1)))
+	return buf.Bytes()
+}()
+
+// imageNotFound answers a request for a missing image. With fallback=true
+// the placeholder image is sent with the 404 so <img> tags still render;
+// otherwise the usual error envelope is returned.
+func (h *ImageHandler) imageNotFound(c *gin.Context) {
+	if c.Query("fallback") != "true" {
+		respondError(c, http.StatusNotFound, CodeNotFound, "Image not found")
+		return
+	}
+
+	// The image may still appear, so the placeholder must not be cached
+	c.Header("Cache-Control", "no-store")
+
+	if fallback := h.config.FallbackImage; fallback != "" {
+		if data, err := os.ReadFile(fallback); err == nil {
+			c.Data(http.StatusNotFound, utils.ContentType(os.DirFS(filepath.Dir(fallback)), filepath.Base(fallback)), data)
+			c.Abort()
+			return
+		} else {
+			h.logger.Warn("Error reading fallback image", "path", fallback, "error", err)
+		}
+	}
+
+	c.Data(http.StatusNotFound, "image/png", transparentPNG)
+	c.Abort()
 }
@@ -0,0 +1,456 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"ImageServer/config"
+	"ImageServer/models"
+	"ImageServer/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestOutputFormat(t *testing.T) {
+	avif := &fstest.MapFile{Data: []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00mif1"), Mode: 0644}
+
+	tests := []struct {
+		name        string
+		path        string
+		query       string
+		accept      string
+		status      int
+		contentType string
+		message     string
+	}{
+		{name: "webp", path: "/a.png", query: "format=webp", status: http.StatusOK, contentType: "image/webp"},
+		{name: "avif output", path: "/a.png", query: "format=avif", status: http.StatusUnsupportedMediaType, message: "avif is not an output format, use one of gif, jpeg, jpg, png, webp"},
+		{name: "avif output of missing image", path: "/missing.png", query: "format=avif", status: http.StatusUnsupportedMediaType, message: "avif is not an output format"},
+		{name: "svg output", path: "/a.png", query: "format=svg", status: http.StatusUnsupportedMediaType, message: "svg is not an output format"},
+		{name: "avif original", path: "/b.avif", status: http.StatusOK, contentType: "image/avif"},
+		{name: "negotiated webp", path: "/a.png", accept: "image/avif,image/webp,*/*", status: http.StatusOK, contentType: "image/webp"},
+		{name: "negotiated avif only", path: "/a.png", accept: "image/avif,*/*", status: http.StatusOK, contentType: "image/png"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestImageHandler(&config.Config{
+				AutoFormat:       true,
+				ConvertibleTypes: models.ConverableTypes,
+			}, fstest.MapFS{
+				"a.png":  pngFile(4, 4),
+				"b.avif": avif,
+			})
+
+			target := tt.path
+			if tt.query != "" {
+				target += "?" + tt.query
+			}
+			w := serveWithHeader(h.ServeImage, target, "Accept", tt.accept, gin.Param{Key: "filepath", Value: tt.path})
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.contentType != "" && w.Header().Get("Content-Type") != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", w.Header().Get("Content-Type"), tt.contentType)
+			}
+			if !strings.Contains(w.Body.String(), tt.message) {
+				t.Errorf("body = %s, want %q", w.Body, tt.message)
+			}
+			// A rejected format must not leave anything in the cache
+			if cached := cachedFiles(t, h); tt.status != http.StatusOK && cached != "" {
+				t.Errorf("cached %s after a rejected request", cached)
+			}
+		})
+	}
+}
+
+// cachedFiles joins the names of the files in the variant cache.
+func cachedFiles(t *testing.T, h *ImageHandler) string {
+	t.Helper()
+
+	var names []string
+	err := fs.WalkDir(h.cache, ".", func(name string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			names = append(names, name)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestHead(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		query       string
+		accept      string
+		cfg         config.Config
+		status      int
+		contentType string
+		// length is the expected Content-Length, or -1 when there is none
+		length int
+	}{
+		{name: "original", path: "/a.png", status: http.StatusOK, contentType: "image/png", length: len(pngFile(40, 20).Data)},
+		{name: "missing", path: "/missing.png", status: http.StatusNotFound, length: -1},
+		{name: "missing variant", path: "/missing.png", query: "width=10", status: http.StatusNotFound, length: -1},
+		{name: "uncached variant", path: "/a.png", query: "width=10", status: http.StatusOK, contentType: "image/png", length: -1},
+		{name: "uncached format", path: "/a.png", query: "format=webp", status: http.StatusOK, contentType: "image/webp", length: -1},
+		{name: "default max dimension", path: "/a.png", cfg: config.Config{DefaultMaxDimension: 10}, status: http.StatusOK, contentType: "image/png", length: -1},
+		{name: "auto format", path: "/a.png", accept: "image/webp", cfg: config.Config{AutoFormat: true}, status: http.StatusOK, contentType: "image/webp", length: -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.ConvertibleTypes = models.ConverableTypes
+			h := newTestImageHandler(&cfg, fstest.MapFS{"a.png": pngFile(40, 20)})
+
+			target := tt.path
+			if tt.query != "" {
+				target += "?" + tt.query
+			}
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodHead, target, nil)
+			if tt.accept != "" {
+				c.Request.Header.Set("Accept", tt.accept)
+			}
+			c.Params = gin.Params{{Key: "filepath", Value: tt.path}}
+			h.ServeImage(c)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.contentType != "" && w.Header().Get("Content-Type") != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", w.Header().Get("Content-Type"), tt.contentType)
+			}
+			if got := w.Header().Get("Content-Length"); tt.length >= 0 && got != strconv.Itoa(tt.length) {
+				t.Errorf("Content-Length = %q, want %d", got, tt.length)
+			}
+			if tt.status == http.StatusOK && w.Header().Get("Cache-Control") == "" {
+				t.Error("no Cache-Control on a served image")
+			}
+
+			// HEAD never generates variants
+			entries, _ := h.cache.ReadDir(".")
+			if len(entries) != 0 {
+				t.Errorf("cache holds %d entries after HEAD, want none", len(entries))
+			}
+		})
+	}
+}
+
+// serveImage runs ServeImage for a GET of target with the given headers.
+func serveImage(h *ImageHandler, target string, headers map[string]string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, target, nil)
+	for key, value := range headers {
+		c.Request.Header.Set(key, value)
+	}
+	filePath, _, _ := strings.Cut(target, "?")
+	c.Params = gin.Params{{Key: "filepath", Value: filePath}}
+	h.ServeImage(c)
+	c.Writer.WriteHeaderNow()
+	return w
+}
+
+func TestConditionalGet(t *testing.T) {
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	original := pngFile(20, 20)
+	original.ModTime = modTime
+
+	for _, target := range []string{"/a.png", "/a.png?width=10"} {
+		t.Run(target, func(t *testing.T) {
+			h := newTestImageHandler(&config.Config{ConvertibleTypes: models.ConverableTypes}, fstest.MapFS{"a.png": original})
+
+			first := serveImage(h, target, nil)
+			if first.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", first.Code, first.Body)
+			}
+			etag := first.Header().Get("ETag")
+			lastModified := first.Header().Get("Last-Modified")
+			if !strings.HasPrefix(etag, `"`) {
+				t.Fatalf("ETag = %q, want a strong validator", etag)
+			}
+			if lastModified == "" {
+				t.Fatal("no Last-Modified")
+			}
+
+			tests := []struct {
+				name    string
+				headers map[string]string
+				status  int
+			}{
+				{name: "matching etag", headers: map[string]string{"If-None-Match": etag}, status: http.StatusNotModified},
+				{name: "etag in list", headers: map[string]string{"If-None-Match": `"other", ` + etag}, status: http.StatusNotModified},
+				{name: "stale etag", headers: map[string]string{"If-None-Match": `"stale"`}, status: http.StatusOK},
+				{name: "not modified since", headers: map[string]string{"If-Modified-Since": lastModified}, status: http.StatusNotModified},
+				{name: "modified since", headers: map[string]string{"If-Modified-Since": "Mon, 01 Jan 2001 00:00:00 GMT"}, status: http.StatusOK},
+				// If-None-Match wins over If-Modified-Since
+				{name: "stale etag, not modified since", headers: map[string]string{"If-None-Match": `"stale"`, "If-Modified-Since": lastModified}, status: http.StatusOK},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					w := serveImage(h, target, tt.headers)
+					if w.Code != tt.status {
+						t.Fatalf("status = %d, want %d", w.Code, tt.status)
+					}
+					if tt.status == http.StatusNotModified && w.Body.Len() != 0 {
+						t.Errorf("304 with a %d byte body", w.Body.Len())
+					}
+					if tt.status == http.StatusOK && !bytes.Equal(w.Body.Bytes(), first.Body.Bytes()) {
+						t.Error("body differs from the first response")
+					}
+					if w.Header().Get("ETag") != etag {
+						t.Errorf("ETag = %q, want %q", w.Header().Get("ETag"), etag)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestRange(t *testing.T) {
+	large := pngFile(200, 200)
+	files := fstest.MapFS{
+		"a.png": large,
+		// Stored without an extension, identified by content
+		"noext": large,
+	}
+
+	tests := []struct {
+		name   string
+		target string
+	}{
+		{name: "original", target: "/a.png"},
+		{name: "without extension", target: "/noext"},
+		{name: "variant", target: "/a.png?width=150"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestImageHandler(&config.Config{ConvertibleTypes: models.ConverableTypes}, files)
+
+			full := serveImage(h, tt.target, nil)
+			if full.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", full.Code, full.Body)
+			}
+			if full.Header().Get("Accept-Ranges") != "bytes" {
+				t.Errorf("Accept-Ranges = %q, want bytes", full.Header().Get("Accept-Ranges"))
+			}
+			size := full.Body.Len()
+			if size <= 100 {
+				t.Fatalf("fixture is %d bytes, want more than 100", size)
+			}
+
+			w := serveImage(h, tt.target, map[string]string{"Range": "bytes=0-99"})
+			if w.Code != http.StatusPartialContent {
+				t.Fatalf("status = %d, want 206", w.Code)
+			}
+			if got, want := w.Header().Get("Content-Range"), fmt.Sprintf("bytes 0-99/%d", size); got != want {
+				t.Errorf("Content-Range = %q, want %q", got, want)
+			}
+			if w.Header().Get("Content-Type") != "image/png" {
+				t.Errorf("Content-Type = %q, want image/png", w.Header().Get("Content-Type"))
+			}
+			if !bytes.Equal(w.Body.Bytes(), full.Body.Bytes()[:100]) {
+				t.Error("partial body is not the first 100 bytes")
+			}
+
+			// Resuming with a matching If-Range gets the rest
+			w = serveImage(h, tt.target, map[string]string{"Range": "bytes=100-", "If-Range": full.Header().Get("ETag")})
+			if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), full.Body.Bytes()[100:]) {
+				t.Errorf("resumed status = %d with %d bytes, want 206 with %d", w.Code, w.Body.Len(), size-100)
+			}
+
+			// A stale If-Range gets the whole image
+			w = serveImage(h, tt.target, map[string]string{"Range": "bytes=100-", "If-Range": `"stale"`})
+			if w.Code != http.StatusOK || w.Body.Len() != size {
+				t.Errorf("stale If-Range status = %d with %d bytes, want 200 with %d", w.Code, w.Body.Len(), size)
+			}
+
+			w = serveImage(h, tt.target, map[string]string{"Range": fmt.Sprintf("bytes=%d-", size+10)})
+			if w.Code != http.StatusRequestedRangeNotSatisfiable {
+				t.Errorf("unsatisfiable range status = %d, want 416", w.Code)
+			}
+		})
+	}
+}
+
+func TestImagePathTraversal(t *testing.T) {
+	h := newTestImageHandler(&config.Config{
+		Domain:     "http://localhost",
+		SigningKey: "secret",
+	}, fstest.MapFS{"a/one.png": pngFile(1, 1)})
+
+	for _, path := range []string{"/../../etc/passwd", "/a/../../etc/passwd", `/..\..\etc\passwd`} {
+		t.Run("ServeImage "+path, func(t *testing.T) {
+			w := serve(h.ServeImage, http.MethodGet, "/image.png", "", gin.Param{Key: "filepath", Value: path})
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400", w.Code)
+			}
+		})
+
+		body := fmt.Sprintf(`{"path": %q, "variants": [{"width": 10}]}`, path)
+		t.Run("Warm "+path, func(t *testing.T) {
+			if w := serve(h.Warm, http.MethodPost, "/api/v1/warm", body); w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400", w.Code)
+			}
+		})
+		t.Run("Sign "+path, func(t *testing.T) {
+			if w := serve(h.Sign, http.MethodPost, "/api/v1/sign", body); w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400", w.Code)
+			}
+		})
+	}
+}
+
+// trackedCache counts the variants written to a cache and how many writes
+// overlap. Each write is held open for delay so concurrent ones overlap.
+type trackedCache struct {
+	storage.Storage
+	delay time.Duration
+
+	mu      sync.Mutex
+	created map[string]int
+	active  int
+	peak    int
+}
+
+func (s *trackedCache) Create(name string) (storage.Writer, error) {
+	s.mu.Lock()
+	if s.created == nil {
+		s.created = map[string]int{}
+	}
+	s.created[name]++
+	s.active++
+	s.peak = max(s.peak, s.active)
+	s.mu.Unlock()
+
+	time.Sleep(s.delay)
+	w, err := s.Storage.Create(name)
+	if err != nil {
+		s.done()
+		return nil, err
+	}
+	return &trackedWriter{Writer: w, cache: s}, nil
+}
+
+func (s *trackedCache) done() {
+	s.mu.Lock()
+	s.active--
+	s.mu.Unlock()
+}
+
+// trackedWriter ends its write in trackedCache when closed or aborted.
+type trackedWriter struct {
+	storage.Writer
+	cache *trackedCache
+}
+
+func (w *trackedWriter) Close() error {
+	defer w.cache.done()
+	return w.Writer.Close()
+}
+
+func (w *trackedWriter) Abort() error {
+	defer w.cache.done()
+	return w.Writer.Abort()
+}
+
+// serveConcurrently requests every target from its own goroutine at once.
+func serveConcurrently(h *ImageHandler, targets []string) []*httptest.ResponseRecorder {
+	responses := make([]*httptest.ResponseRecorder, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i] = serveImage(h, target, nil)
+		}()
+	}
+	wg.Wait()
+	return responses
+}
+
+func TestConversionLimit(t *testing.T) {
+	h := newTestImageHandler(&config.Config{
+		ConvertibleTypes: models.ConverableTypes,
+		MaxConversions:   2,
+	}, fstest.MapFS{"a.png": pngFile(40, 40)})
+	cache := &trackedCache{Storage: h.cache, delay: 20 * time.Millisecond}
+	h.cache = cache
+
+	var targets []string
+	for width := 10; width < 18; width++ {
+		for range 3 {
+			targets = append(targets, fmt.Sprintf("/a.png?width=%d", width))
+		}
+	}
+
+	for i, w := range serveConcurrently(h, targets) {
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status = %d, want 200: %s", targets[i], w.Code, w.Body)
+			continue
+		}
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Errorf("%s: %v", targets[i], err)
+			continue
+		}
+		var width int
+		fmt.Sscanf(targets[i], "/a.png?width=%d", &width)
+		if got := img.Bounds().Dx(); got != width {
+			t.Errorf("%s: width = %d, want %d", targets[i], got, width)
+		}
+	}
+
+	if cache.peak > h.config.MaxConversions {
+		t.Errorf("%d conversions ran at once, want at most %d", cache.peak, h.config.MaxConversions)
+	}
+	if len(h.conversions) != 0 {
+		t.Errorf("%d conversion slots still held", len(h.conversions))
+	}
+}
+
+func TestConversionBusy(t *testing.T) {
+	h := newTestImageHandler(&config.Config{
+		ConvertibleTypes:  models.ConverableTypes,
+		ConversionTimeout: 10 * time.Second,
+		ConversionWait:    10 * time.Millisecond,
+	}, fstest.MapFS{"a.png": pngFile(20, 20)})
+
+	// Hold the only conversion slot
+	h.conversions <- struct{}{}
+
+	w := serveImage(h, "/a.png?width=10", nil)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503: %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), CodeBusy) {
+		t.Errorf("body = %s, want %s", w.Body, CodeBusy)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After")
+	}
+
+	// Once the slot frees up the variant is generated
+	<-h.conversions
+	if w := serveImage(h, "/a.png?width=10", nil); w.Code != http.StatusOK {
+		t.Errorf("status after the slot freed = %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"ImageServer/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Error codes returned in the error envelope. Clients should branch on the
+// code; the message is for humans and may change.
+const (
+	CodeInvalidPath       = "INVALID_PATH"
+	CodeInvalidParameter  = "INVALID_PARAMETER"
+	CodeInvalidUpload     = "INVALID_UPLOAD"
+	CodeUnsupportedFormat = "UNSUPPORTED_FORMAT"
+	CodePayloadTooLarge   = "PAYLOAD_TOO_LARGE"
+	CodeAccessDenied      = "ACCESS_DENIED"
+	CodeNotFound          = "NOT_FOUND"
+	CodeMethodNotAllowed  = "METHOD_NOT_ALLOWED"
+	CodeConflict          = "CONFLICT"
+	CodeInternal          = "INTERNAL_ERROR"
+	CodeNotReady          = "NOT_READY"
+	CodeBusy              = "BUSY"
+	CodeTimeout           = "TIMEOUT"
+	CodeFetchFailed       = "FETCH_FAILED"
+	CodeQuotaExceeded     = "QUOTA_EXCEEDED"
+	CodeImageTooLarge     = "IMAGE_TOO_LARGE"
+	CodeInvalidImage      = "INVALID_IMAGE"
+	CodeCanceled          = "CANCELED"
+)
+
+// statusClientClosedRequest is the nginx convention for requests the client
+// abandoned before a response was ready. Nobody reads the body; the status
+// keeps such requests apart from server errors in logs and metrics.
+const statusClientClosedRequest = 499
+
+// ErrorBody is the payload of every error response:
+//
+//	{"error": {"code": "NOT_FOUND", "message": "Image not found"}}
+type ErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// RequestID matches the X-Request-ID response header and the logs
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// respondError aborts the request with the standard error envelope. Internal
+// error details must be logged by the caller, never passed as the message.
+// Errors are never cached, so a missing image that is uploaded later is not
+// hidden behind a stale 404.
+func respondError(c *gin.Context, status int, code, message string) {
+	c.Header("Cache-Control", "no-store")
+	c.AbortWithStatusJSON(status, gin.H{"error": ErrorBody{
+		Code:      code,
+		Message:   message,
+		RequestID: c.GetString(middleware.RequestIDKey),
+	}})
+}
+
+// apiError is an error that knows how it should be reported to the client.
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+// respondAPIError reports err with its own status and code when it is an
+// *apiError, and as an internal error otherwise. The text of other errors
+// can name paths or storage endpoints, so it is logged rather than sent.
+func (h *APIHandler) respondAPIError(c *gin.Context, err error) {
+	var aerr *apiError
+	if errors.As(err, &aerr) {
+		respondError(c, aerr.status, aerr.code, aerr.message)
+		return
+	}
+	respondError(c, http.StatusInternalServerError, CodeInternal, h.clientMessage(err))
+}
+
+// internalErrorMessage is all clients learn about errors that are not an
+// *apiError.
+const internalErrorMessage = "Internal error"
+
+// clientMessage returns the message of err that a client may see, logging
+// the error when it is not an *apiError. Batch endpoints report it per item.
+func (h *APIHandler) clientMessage(err error) string {
+	var aerr *apiError
+	if errors.As(err, &aerr) {
+		return aerr.message
+	}
+	h.logger.Error("Internal error", "error", err)
+	return internalErrorMessage
+}
+
+// NotFound responds with a NOT_FOUND error envelope.
+func NotFound(c *gin.Context) {
+	respondError(c, http.StatusNotFound, CodeNotFound, "Not found")
+}
+
+// MethodNotAllowed responds with 405 and an Allow header listing the
+// methods the resource supports.
+func MethodNotAllowed(c *gin.Context, allowed ...string) {
+	c.Header("Allow", strings.Join(allowed, ", "))
+	respondError(c, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+}
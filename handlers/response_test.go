@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRespondAPIError(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		status  int
+		code    string
+		message string
+	}{
+		{
+			name:    "api error",
+			err:     &apiError{http.StatusConflict, CodeConflict, "Destination already exists"},
+			status:  http.StatusConflict,
+			code:    CodeConflict,
+			message: "Destination already exists",
+		},
+		{
+			name:    "wrapped api error",
+			err:     fmt.Errorf("moving: %w", &apiError{http.StatusNotFound, CodeNotFound, "Source not found"}),
+			status:  http.StatusNotFound,
+			code:    CodeNotFound,
+			message: "Source not found",
+		},
+		{
+			name:    "internal error",
+			err:     &fs.PathError{Op: "open", Path: "/var/lib/images/secret.png", Err: fs.ErrPermission},
+			status:  http.StatusInternalServerError,
+			code:    CodeInternal,
+			message: internalErrorMessage,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(nil, nil)
+			w := serve(func(c *gin.Context) { h.respondAPIError(c, tt.err) }, http.MethodGet, "/", "")
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			var body struct {
+				Error ErrorBody `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error.Code != tt.code || body.Error.Message != tt.message {
+				t.Errorf("error = %s %q, want %s %q", body.Error.Code, body.Error.Message, tt.code, tt.message)
+			}
+			if strings.Contains(w.Body.String(), "/var/lib") {
+				t.Errorf("response leaks the path: %s", w.Body)
+			}
+		})
+	}
+}
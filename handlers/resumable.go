@@ -0,0 +1,407 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ImageServer/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Resumable uploads are kept on local disk under UPLOAD_SESSION_PATH, one
+// "<id>.json" with the session and one "<id>.part" with the bytes received
+// so far. The offset of a session is the size of its part file, so a chunk
+// cut off mid-transfer keeps what arrived and the client resumes from there.
+
+// validSessionID matches the ids handed out by CreateUpload.
+var validSessionID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// sessionLocks keeps two requests from using one session at once.
+type sessionLocks struct {
+	mu   sync.Mutex
+	busy map[string]bool
+
+	// create serializes counting open sessions with adding one, so
+	// concurrent requests cannot push past MAX_UPLOAD_SESSIONS
+	create sync.Mutex
+}
+
+// lock claims a session, reporting false when another request holds it.
+func (l *sessionLocks) lock(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.busy == nil {
+		l.busy = map[string]bool{}
+	}
+	if l.busy[id] {
+		return false
+	}
+	l.busy[id] = true
+	return true
+}
+
+func (l *sessionLocks) unlock(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.busy, id)
+}
+
+// sessionFile returns the path of one of a session's files.
+func (h *APIHandler) sessionFile(id, ext string) string {
+	return filepath.Join(h.config.UploadSessionPath, id+ext)
+}
+
+// saveSession writes the session state, refreshing its expiry.
+func (h *APIHandler) saveSession(session *models.UploadSession) error {
+	session.Expires = time.Now().Add(h.config.UploadSessionTTL)
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(h.sessionFile(session.ID, ".json"), data, 0644)
+}
+
+// loadSession reads a session and its current offset. Expired sessions are
+// removed and reported as missing.
+func (h *APIHandler) loadSession(id string) (*models.UploadSession, error) {
+	if !validSessionID.MatchString(id) {
+		return nil, &apiError{http.StatusNotFound, CodeNotFound, "Upload not found"}
+	}
+
+	data, err := os.ReadFile(h.sessionFile(id, ".json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, &apiError{http.StatusNotFound, CodeNotFound, "Upload not found"}
+	}
+	if err != nil {
+		h.logger.Error("Error reading upload session", "id", id, "error", err)
+		return nil, errors.New("Error reading upload session")
+	}
+
+	var session models.UploadSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		h.logger.Error("Invalid upload session", "id", id, "error", err)
+		return nil, errors.New("Error reading upload session")
+	}
+
+	if time.Now().After(session.Expires) {
+		h.removeSession(id)
+		return nil, &apiError{http.StatusNotFound, CodeNotFound, "Upload not found"}
+	}
+
+	info, err := os.Stat(h.sessionFile(id, ".part"))
+	if err != nil {
+		h.logger.Error("Error reading upload session", "id", id, "error", err)
+		return nil, errors.New("Error reading upload session")
+	}
+	session.Offset = info.Size()
+	return &session, nil
+}
+
+// removeSession deletes both files of a session.
+func (h *APIHandler) removeSession(id string) {
+	for _, ext := range []string{".part", ".json"} {
+		if err := os.Remove(h.sessionFile(id, ext)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			h.logger.Warn("Error removing upload session", "id", id, "error", err)
+		}
+	}
+}
+
+// sweepSessions removes sessions that expired without being completed and
+// returns how many remain open.
+func (h *APIHandler) sweepSessions() (int, error) {
+	names, err := filepath.Glob(h.sessionFile("*", ".json"))
+	if err != nil {
+		return 0, err
+	}
+	open := 0
+	for _, name := range names {
+		id := strings.TrimSuffix(filepath.Base(name), ".json")
+		if !h.sessions.lock(id) {
+			// In use, so certainly not expired
+			open++
+			continue
+		}
+		// loadSession drops the session when it has expired
+		if _, err := h.loadSession(id); err == nil {
+			open++
+		}
+		h.sessions.unlock(id)
+	}
+	return open, nil
+}
+
+// CreateUpload handles POST /api/v1/uploads
+//
+// The body names the file like a regular upload and gives its total size,
+// which may not exceed MAX_UPLOAD_BYTES.
+func (h *APIHandler) CreateUpload(c *gin.Context) {
+	var req models.UploadSessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidParameter, "Expected JSON body with folder, format and size")
+		return
+	}
+
+	req.Format = strings.ToLower(req.Format)
+	if err := h.checkUpload(req.Folder, req.ID, req.Format); err != nil {
+		h.respondAPIError(c, err)
+		return
+	}
+
+	if req.Size < 1 {
+		respondError(c, http.StatusBadRequest, CodeInvalidParameter, "Invalid size")
+		return
+	}
+	if req.Size > h.config.MaxUploadBytes {
+		respondError(c, http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "Upload exceeds size limit")
+		return
+	}
+	if err := h.checkQuota(req.Size); err != nil {
+		h.respondAPIError(c, err)
+		return
+	}
+
+	h.sessions.create.Lock()
+	defer h.sessions.create.Unlock()
+
+	open, err := h.sweepSessions()
+	if err != nil {
+		h.logger.Error("Error listing upload sessions", "error", err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Error creating upload")
+		return
+	}
+	if open >= h.config.MaxUploadSessions {
+		h.logger.Warn("Too many upload sessions", "open", open, "limit", h.config.MaxUploadSessions)
+		respondError(c, http.StatusTooManyRequests, CodeBusy, "Too many uploads in progress, finish or cancel one first")
+		return
+	}
+
+	var raw [16]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		h.logger.Error("Error creating upload id", "error", err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Error creating upload")
+		return
+	}
+
+	session := &models.UploadSession{
+		ID:     hex.EncodeToString(raw[:]),
+		Folder: req.Folder,
+		FileID: req.ID,
+		Format: req.Format,
+		Size:   req.Size,
+	}
+
+	if err := os.WriteFile(h.sessionFile(session.ID, ".part"), nil, 0644); err != nil {
+		h.logger.Error("Error creating upload", "error", err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Error creating upload")
+		return
+	}
+	if err := h.saveSession(session); err != nil {
+		h.logger.Error("Error creating upload", "error", err)
+		h.removeSession(session.ID)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Error creating upload")
+		return
+	}
+
+	c.Header("Location", "/api/v1/uploads/"+session.ID)
+	c.JSON(http.StatusCreated, session)
+}
+
+// UploadStatus handles GET /api/v1/uploads/:id
+//
+// Clients use the returned offset to resume an interrupted upload. While a
+// chunk is being written the offset is still moving, so that gets 409.
+func (h *APIHandler) UploadStatus(c *gin.Context) {
+	id := c.Param("id")
+	if !h.sessions.lock(id) {
+		respondError(c, http.StatusConflict, CodeConflict, "Upload is busy")
+		return
+	}
+	defer h.sessions.unlock(id)
+
+	session, err := h.loadSession(id)
+	if err != nil {
+		h.respondAPIError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, session)
+}
+
+// parseContentRange parses a "bytes <start>-<end>/<total>" header. total is
+// -1 when given as "*".
+func parseContentRange(header string) (start, end, total int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes ")
+	if !found {
+		return 0, 0, 0, false
+	}
+	span, size, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, 0, false
+	}
+	first, last, found := strings.Cut(span, "-")
+	if !found {
+		return 0, 0, 0, false
+	}
+
+	var err error
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil || start < 0 {
+		return 0, 0, 0, false
+	}
+	if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+		return 0, 0, 0, false
+	}
+	total = -1
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil || total <= end {
+			return 0, 0, 0, false
+		}
+	}
+	return start, end, total, true
+}
+
+// AppendUpload handles PATCH /api/v1/uploads/:id
+//
+// The body is the chunk described by the Content-Range header. A chunk must
+// start at the session's current offset; anything else gets 409 so the
+// client can look up the offset and resume.
+func (h *APIHandler) AppendUpload(c *gin.Context) {
+	id := c.Param("id")
+	if !h.sessions.lock(id) {
+		respondError(c, http.StatusConflict, CodeConflict, "Upload is busy")
+		return
+	}
+	defer h.sessions.unlock(id)
+
+	session, err := h.loadSession(id)
+	if err != nil {
+		h.respondAPIError(c, err)
+		return
+	}
+
+	start, end, total, ok := parseContentRange(c.GetHeader("Content-Range"))
+	if !ok {
+		respondError(c, http.StatusBadRequest, CodeInvalidParameter, "Invalid Content-Range")
+		return
+	}
+	if (total != -1 && total != session.Size) || end >= session.Size {
+		respondError(c, http.StatusBadRequest, CodeInvalidParameter, "Content-Range does not match the upload size")
+		return
+	}
+	if start != session.Offset {
+		respondError(c, http.StatusConflict, CodeConflict, "Chunk must start at offset "+strconv.FormatInt(session.Offset, 10))
+		return
+	}
+
+	length := end - start + 1
+	if c.Request.ContentLength >= 0 && c.Request.ContentLength != length {
+		respondError(c, http.StatusBadRequest, CodeInvalidParameter, "Content-Length does not match Content-Range")
+		return
+	}
+
+	part, err := os.OpenFile(h.sessionFile(id, ".part"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		h.logger.Error("Error opening upload", "id", id, "error", err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Error writing upload")
+		return
+	}
+
+	// Whatever arrives before a dropped connection is kept
+	written, copyErr := io.Copy(part, io.LimitReader(c.Request.Body, length))
+	if err := part.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	session.Offset += written
+
+	if err := h.saveSession(session); err != nil {
+		h.logger.Error("Error saving upload session", "id", id, "error", err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Error writing upload")
+		return
+	}
+
+	if copyErr != nil || written != length {
+		h.logger.Warn("Incomplete chunk", "id", id, "received", written, "expected", length, "error", copyErr)
+		respondError(c, http.StatusBadRequest, CodeInvalidUpload, "Incomplete chunk, resume at offset "+strconv.FormatInt(session.Offset, 10))
+		return
+	}
+
+	c.JSON(http.StatusOK, session)
+}
+
+// CompleteUpload handles POST /api/v1/uploads/:id/complete
+//
+// Once every byte has arrived the file is validated and stored like a
+// regular upload, and the session is removed.
+func (h *APIHandler) CompleteUpload(c *gin.Context) {
+	id := c.Param("id")
+	if !h.sessions.lock(id) {
+		respondError(c, http.StatusConflict, CodeConflict, "Upload is busy")
+		return
+	}
+	defer h.sessions.unlock(id)
+
+	session, err := h.loadSession(id)
+	if err != nil {
+		h.respondAPIError(c, err)
+		return
+	}
+
+	if session.Offset != session.Size {
+		respondError(c, http.StatusConflict, CodeConflict, "Upload is incomplete")
+		return
+	}
+
+	// The upload rules may have changed since the session started
+	if err := h.checkUpload(session.Folder, session.FileID, session.Format); err != nil {
+		h.respondAPIError(c, err)
+		return
+	}
+
+	fileBytes, err := os.ReadFile(h.sessionFile(id, ".part"))
+	if err != nil {
+		h.logger.Error("Error reading upload", "id", id, "error", err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Error reading upload")
+		return
+	}
+
+	uploaded, err := h.storeUpload(session.Folder, session.FileID, session.Format, fileBytes, h.config.ConvertOnUpload)
+	if err != nil {
+		h.respondAPIError(c, err)
+		return
+	}
+
+	h.removeSession(id)
+	c.JSON(http.StatusCreated, uploaded)
+}
+
+// CancelUpload handles DELETE /api/v1/uploads/:id
+func (h *APIHandler) CancelUpload(c *gin.Context) {
+	id := c.Param("id")
+	if !h.sessions.lock(id) {
+		respondError(c, http.StatusConflict, CodeConflict, "Upload is busy")
+		return
+	}
+	defer h.sessions.unlock(id)
+
+	if _, err := h.loadSession(id); err != nil {
+		h.respondAPIError(c, err)
+		return
+	}
+
+	h.removeSession(id)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"ImageServer/config"
+	"ImageServer/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestSessionHandler returns an APIHandler keeping resumable uploads in a
+// temporary directory.
+func newTestSessionHandler(t *testing.T, maxSessions int) *APIHandler {
+	return newTestHandler(&config.Config{
+		Domain:            "http://localhost",
+		MaxUploadBytes:    1 << 20,
+		UploadSessionPath: t.TempDir(),
+		UploadSessionTTL:  time.Hour,
+		MaxUploadSessions: maxSessions,
+	}, nil)
+}
+
+// createSession starts a resumable upload and returns its id, or "" when
+// the request failed.
+func createSession(t *testing.T, h *APIHandler, wantStatus int) string {
+	t.Helper()
+
+	w := serve(h.CreateUpload, http.MethodPost, "/api/v1/uploads", `{"folder":"a","id":"x","format":"png","size":10}`)
+	if w.Code != wantStatus {
+		t.Fatalf("create = %d, want %d: %s", w.Code, wantStatus, w.Body)
+	}
+	var session models.UploadSession
+	json.Unmarshal(w.Body.Bytes(), &session)
+	return session.ID
+}
+
+func TestUploadSessionLimit(t *testing.T) {
+	h := newTestSessionHandler(t, 2)
+
+	first := createSession(t, h, http.StatusCreated)
+	createSession(t, h, http.StatusCreated)
+	createSession(t, h, http.StatusTooManyRequests)
+
+	// Finishing or cancelling a session frees its slot
+	w := serve(h.CancelUpload, http.MethodDelete, "/api/v1/uploads/"+first, "", gin.Param{Key: "id", Value: first})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("cancel = %d: %s", w.Code, w.Body)
+	}
+	createSession(t, h, http.StatusCreated)
+}
+
+func TestUploadSessionLimitExpired(t *testing.T) {
+	h := newTestSessionHandler(t, 1)
+	h.config.UploadSessionTTL = -time.Second
+
+	// Sessions that expired do not count
+	createSession(t, h, http.StatusCreated)
+	createSession(t, h, http.StatusCreated)
+}
+
+func TestUploadStatusWhileBusy(t *testing.T) {
+	h := newTestSessionHandler(t, 1)
+	id := createSession(t, h, http.StatusCreated)
+	status := func() int {
+		return serve(h.UploadStatus, http.MethodGet, "/api/v1/uploads/"+id, "", gin.Param{Key: "id", Value: id}).Code
+	}
+
+	// A chunk being appended holds the session
+	if !h.sessions.lock(id) {
+		t.Fatal("session already locked")
+	}
+	if code := status(); code != http.StatusConflict {
+		t.Errorf("status while busy = %d, want 409", code)
+	}
+	h.sessions.unlock(id)
+
+	if code := status(); code != http.StatusOK {
+		t.Errorf("status = %d, want 200", code)
+	}
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"ImageServer/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultSignedTTL is how long a signed URL stays valid without expiresIn.
+	defaultSignedTTL = time.Hour
+	// maxSignedTTL bounds the lifetime a signed URL may be given.
+	maxSignedTTL = 365 * 24 * time.Hour
+)
+
+// SignRequest asks for a time-limited URL of one image. Query takes the same
+// parameters as the image URL, e.g. {"width": 200}; the signed URL is only
+// valid with exactly these parameters.
+type SignRequest struct {
+	Path string `json:"path" binding:"required"`
+	// ExpiresIn is the lifetime in seconds
+	ExpiresIn int64          `json:"expiresIn"`
+	Query     map[string]any `json:"query"`
+}
+
+// Sign handles POST /api/v1/sign
+func (h *ImageHandler) Sign(c *gin.Context) {
+	if h.config.SigningKey == "" {
+		respondError(c, http.StatusServiceUnavailable, CodeNotReady, "Signed URLs are not configured")
+		return
+	}
+
+	var req SignRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidParameter, "Expected JSON body with path")
+		return
+	}
+	if req.ExpiresIn < 0 || req.ExpiresIn > int64(maxSignedTTL/time.Second) {
+		respondError(c, http.StatusBadRequest, CodeInvalidParameter, "Invalid expiresIn")
+		return
+	}
+
+	name, err := utils.CleanName(req.Path)
+	if err != nil || name == "." {
+		respondError(c, http.StatusBadRequest, CodeInvalidPath, "Invalid path")
+		return
+	}
+
+	ttl := defaultSignedTTL
+	if req.ExpiresIn > 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+	}
+
+	query := url.Values{}
+	for key, value := range req.Query {
+		query.Set(key, fmt.Sprint(value))
+	}
+
+	expires := time.Now().Add(ttl)
+	signed := utils.SignQuery([]byte(h.config.SigningKey), "/"+name, query, expires)
+
+	c.JSON(http.StatusOK, gin.H{"url": h.imageURL("/"+name, signed), "expires": expires.Unix()})
+}
+
+// checkSignature rejects the request with 403 unless it carries a valid,
+// unexpired signature for the image name.
+func (h *ImageHandler) checkSignature(c *gin.Context, name string) bool {
+	err := utils.VerifyQuery([]byte(h.config.SigningKey), "/"+name, c.Request.URL.Query(), time.Now())
+	if err == nil {
+		return true
+	}
+
+	h.logger.Info("Rejected signed URL", "path", name, "error", err)
+	if errors.Is(err, utils.ErrSignatureExpired) {
+		respondError(c, http.StatusForbidden, CodeAccessDenied, "Signed URL expired")
+	} else {
+		respondError(c, http.StatusForbidden, CodeAccessDenied, "Invalid signature")
+	}
+	return false
+}
+
+// signedMaxAge returns the seconds left until the signed URL query expires.
+// The signature has been checked, so expires can be trusted.
+func signedMaxAge(query url.Values, now time.Time) int {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return int(max(0, expires-now.Unix()))
+}
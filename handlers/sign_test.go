@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"ImageServer/config"
+	"ImageServer/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSignedURLs(t *testing.T) {
+	const key = "secret"
+	now := time.Now()
+	sign := func(name string, query url.Values, expires time.Time) url.Values {
+		return utils.SignQuery([]byte(key), name, query, expires)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		query  url.Values
+		status int
+		// cacheControl is checked for successful requests
+		cacheControl string
+	}{
+		{
+			name:         "valid",
+			path:         "/a.png",
+			query:        sign("/a.png", nil, now.Add(time.Hour)),
+			status:       http.StatusOK,
+			cacheControl: "private, max-age=3600",
+		},
+		{
+			name:         "valid beyond max age",
+			path:         "/a.png",
+			query:        sign("/a.png", nil, now.Add(2*365*24*time.Hour)),
+			status:       http.StatusOK,
+			cacheControl: "private, max-age=31536000",
+		},
+		{
+			name:   "expired",
+			path:   "/a.png",
+			query:  sign("/a.png", nil, now.Add(-time.Minute)),
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "unsigned",
+			path:   "/a.png",
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "other path",
+			path:   "/b.png",
+			query:  sign("/a.png", nil, now.Add(time.Hour)),
+			status: http.StatusForbidden,
+		},
+		{
+			name: "tampered parameter",
+			path: "/a.png",
+			query: func() url.Values {
+				q := sign("/a.png", url.Values{"width": {"10"}}, now.Add(time.Hour))
+				q.Set("width", "20")
+				return q
+			}(),
+			status: http.StatusForbidden,
+		},
+		{
+			name: "extended expiry",
+			path: "/a.png",
+			query: func() url.Values {
+				q := sign("/a.png", nil, now.Add(time.Minute))
+				q.Set("expires", "99999999999")
+				return q
+			}(),
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestImageHandler(&config.Config{SigningKey: key, SignedURLsRequired: true}, fstest.MapFS{
+				"a.png": pngFile(4, 4),
+				"b.png": pngFile(4, 4),
+			})
+
+			target := tt.path
+			if tt.query != nil {
+				target += "?" + tt.query.Encode()
+			}
+			w := serve(h.ServeImage, http.MethodGet, target, "", gin.Param{Key: "filepath", Value: tt.path})
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			cacheControl := w.Header().Get("Cache-Control")
+			if w.Code != http.StatusOK {
+				if cacheControl != "no-store" {
+					t.Errorf("Cache-Control = %q on an error, want no-store", cacheControl)
+				}
+				return
+			}
+			// A second may pass between signing and serving
+			if cacheControl != tt.cacheControl && cacheControl != decrementMaxAge(tt.cacheControl) {
+				t.Errorf("Cache-Control = %q, want %q", cacheControl, tt.cacheControl)
+			}
+		})
+	}
+}
+
+func TestUnsignedCacheControl(t *testing.T) {
+	h := newTestImageHandler(&config.Config{VariantTTL: time.Hour}, fstest.MapFS{"a.png": pngFile(4, 4)})
+
+	w := serve(h.ServeImage, http.MethodGet, "/a.png", "", gin.Param{Key: "filepath", Value: "/a.png"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "public, max-age=3600" {
+		t.Errorf("Cache-Control = %q, want public, max-age=3600", got)
+	}
+}
+
+// decrementMaxAge returns cacheControl with max-age one second lower.
+func decrementMaxAge(cacheControl string) string {
+	var private string
+	var maxAge int
+	if _, err := fmt.Sscanf(cacheControl, "%s max-age=%d", &private, &maxAge); err != nil {
+		return cacheControl
+	}
+	return fmt.Sprintf("%s max-age=%d", private, maxAge-1)
+}
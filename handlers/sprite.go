@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"ImageServer/models"
+	"ImageServer/storage"
+	"ImageServer/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Sprite sheet limits. The largest sheet is maxSpriteImages cells of
+// maxSpriteSize pixels square.
+const (
+	defaultSpriteCols = 5
+	maxSpriteCols     = 20
+	defaultSpriteSize = 128
+	maxSpriteSize     = 256
+	maxSpriteImages   = 100
+)
+
+// Sprite handles GET /api/v1/sprite/*path
+//
+// The images directly in path are scaled to fit size×size cells and packed
+// into a PNG grid cols cells wide. The response maps each file name to its
+// tile; output=image returns the sheet itself. Both are cached under a key
+// derived from the directory listing, so changing the directory builds a
+// new sheet.
+func (h *APIHandler) Sprite(c *gin.Context) {
+	root, err := utils.CleanName(c.Param("path"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidPath, "Invalid path")
+		return
+	}
+
+	query := c.Request.URL.Query()
+	cols, err := spriteParam(query, "cols", defaultSpriteCols, maxSpriteCols)
+	if err != nil {
+		h.respondAPIError(c, err)
+		return
+	}
+	size, err := spriteParam(query, "size", defaultSpriteSize, maxSpriteSize)
+	if err != nil {
+		h.respondAPIError(c, err)
+		return
+	}
+	output := queryDefault(query, "output", "json")
+	if output != "json" && output != "image" {
+		respondError(c, http.StatusBadRequest, CodeInvalidParameter, "Invalid output: "+output)
+		return
+	}
+
+	entries, err := h.store.ReadDir(root)
+	if err != nil || (utils.ContainsDotFile(root) && root != ".") {
+		respondError(c, http.StatusNotFound, CodeNotFound, "Directory not found")
+		return
+	}
+
+	// The key covers every input of the sheet, so a cached sheet is only
+	// reused while the directory is unchanged
+	var names []string
+	sum := sha256.New()
+	fmt.Fprintf(sum, "%d %d\n", cols, size)
+	for _, entry := range entries {
+		ext := strings.TrimPrefix(path.Ext(entry.Name()), ".")
+		if entry.IsDir() || utils.ContainsDotFile(entry.Name()) || ext == "svg" || !models.SupportedTypes.Has(ext) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		names = append(names, path.Join(root, entry.Name()))
+		fmt.Fprintf(sum, "%s %d %d\n", entry.Name(), info.Size(), info.ModTime().UnixNano())
+	}
+	if len(names) == 0 {
+		respondError(c, http.StatusNotFound, CodeNotFound, "Directory has no images")
+		return
+	}
+	if len(names) > maxSpriteImages {
+		respondError(c, http.StatusBadRequest, CodeInvalidParameter, fmt.Sprintf("Sprites hold at most %d images", maxSpriteImages))
+		return
+	}
+
+	key := "sprite:" + hex.EncodeToString(sum.Sum(nil))
+	imageName := utils.VariantCacheName(root, key, "png")
+	mapName := utils.VariantCacheName(root, key, "json")
+
+	// The janitor may evict the sheet and its map independently
+	sprite, err := h.cachedSprite(mapName)
+	if err == nil {
+		_, err = h.cache.Stat(imageName)
+	}
+	if err != nil {
+		sheet, built, err := utils.BuildSprite(c.Request.Context(), h.store, names, cols, size, utils.Interpolators[h.config.Interpolator])
+		if err != nil {
+			respondError(c, statusClientClosedRequest, CodeCanceled, "Request canceled")
+			return
+		}
+		if len(built.Tiles) == 0 {
+			respondError(c, http.StatusNotFound, CodeNotFound, "Directory has no decodable images")
+			return
+		}
+		if err := utils.SaveSprite(c.Request.Context(), h.cache, imageName, mapName, sheet, built); errors.Is(err, context.Canceled) {
+			respondError(c, statusClientClosedRequest, CodeCanceled, "Request canceled")
+			return
+		} else if err != nil {
+			h.logger.Error("Error saving sprite", "path", root, "error", err)
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Error saving sprite")
+			return
+		}
+		sprite = built
+	}
+
+	if output == "image" {
+		h.serveSprite(c, imageName)
+		return
+	}
+
+	query.Set("output", "image")
+	sprite.URL = h.spriteURL(root, query)
+	c.JSON(http.StatusOK, sprite)
+}
+
+// spriteParam reads an optional positive integer no larger than max.
+func spriteParam(query url.Values, key string, def, max int) (int, error) {
+	value := queryDefault(query, key, strconv.Itoa(def))
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > max {
+		return 0, &apiError{http.StatusBadRequest, CodeInvalidParameter, fmt.Sprintf("Invalid %s: %s (1-%d)", key, value, max)}
+	}
+	return n, nil
+}
+
+// spriteURL builds the URL serving the sheet of root with the given query.
+func (h *APIHandler) spriteURL(root string, query url.Values) string {
+	baseURL, err := url.Parse(h.config.Domain)
+	if err != nil {
+		return ""
+	}
+	baseURL.Path = path.Join(baseURL.Path, "/api/v1/sprite", root)
+	baseURL.RawQuery = query.Encode()
+	return baseURL.String()
+}
+
+// cachedSprite reads a tile map stored by utils.SaveSprite.
+func (h *APIHandler) cachedSprite(mapName string) (*models.Sprite, error) {
+	file, err := h.cache.Open(mapName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var sprite models.Sprite
+	if err := json.NewDecoder(file).Decode(&sprite); err != nil {
+		return nil, err
+	}
+	return &sprite, nil
+}
+
+// serveSprite writes a cached sprite sheet, answering conditional requests
+// like serveFile does for images.
+func (h *APIHandler) serveSprite(c *gin.Context, imageName string) {
+	file, err := h.cache.Open(imageName)
+	if err != nil {
+		h.logger.Error("Error opening sprite", "path", imageName, "error", err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Error reading sprite")
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Error reading sprite")
+		return
+	}
+	content, err := storage.ReadSeeker(file)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Error reading sprite")
+		return
+	}
+
+	c.Header("Content-Type", "image/png")
+	c.Header("ETag", fmt.Sprintf("\"%x-%x\"", info.Size(), info.ModTime().UnixNano()))
+	http.ServeContent(c.Writer, c.Request, path.Base(imageName), info.ModTime(), content)
+}
@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+
+	"ImageServer/models"
+	"ImageServer/storage"
+	"ImageServer/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// resolveTransfer validates both paths of a move or copy request and returns
+// their storage names. Neither may be the data root.
+func (h *APIHandler) resolveTransfer(req models.TransferRequest) (string, string, error) {
+	from, err := utils.CleanName(req.From)
+	if err != nil || from == "." {
+		return "", "", &apiError{http.StatusBadRequest, CodeInvalidPath, "Invalid source path"}
+	}
+
+	to, err := utils.CleanName(req.To)
+	if err != nil || to == "." {
+		return "", "", &apiError{http.StatusBadRequest, CodeInvalidPath, "Invalid destination path"}
+	}
+
+	if to == from || isSubPath(to, from) {
+		return "", "", &apiError{http.StatusBadRequest, CodeInvalidPath, "Destination is inside the source"}
+	}
+	// Overwriting an ancestor of the source would delete the source with it
+	if isSubPath(from, to) {
+		return "", "", &apiError{http.StatusBadRequest, CodeInvalidPath, "Source is inside the destination"}
+	}
+
+	return from, to, nil
+}
+
+// isSubPath reports whether name lies strictly below dir.
+func isSubPath(name, dir string) bool {
+	return strings.HasPrefix(name, dir+"/")
+}
+
+// prepareDestination makes sure the destination's parent exists and that the
+// destination is free or may be overwritten, reporting whether it exists.
+// Nothing is removed here; see transfer.
+func (h *APIHandler) prepareDestination(to string, overwrite bool) (bool, error) {
+	exists := false
+	if _, err := h.store.Stat(to); err == nil {
+		if !overwrite {
+			return false, &apiError{http.StatusConflict, CodeConflict, "Destination already exists"}
+		}
+		exists = true
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+
+	return exists, h.store.MkdirAll(path.Dir(to))
+}
+
+// transfer runs a move or copy into to. An existing destination is only
+// replaced once the new content is complete: run writes to a hidden staging
+// name next to to, which is then swapped in. When the swap cannot start,
+// restore undoes run, so a failed request leaves both paths as they were.
+func (h *APIHandler) transfer(to string, exists bool, run, restore func(dst string) error) error {
+	if !exists {
+		return run(to)
+	}
+
+	var raw [8]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return err
+	}
+	staging := path.Join(path.Dir(to), ".transfer-"+hex.EncodeToString(raw[:]))
+
+	if err := run(staging); err != nil {
+		if err := h.store.Remove(staging); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			h.logger.Error("Error removing staged transfer", "path", staging, "error", err)
+		}
+		return err
+	}
+
+	if err := h.store.Remove(to); err != nil {
+		if err := restore(staging); err != nil {
+			h.logger.Error("Error restoring staged transfer", "path", staging, "error", err)
+		}
+		return err
+	}
+	if err := storage.Rename(h.store, staging, to); err != nil {
+		h.logger.Error("Error swapping in staged transfer, content left at staging path", "path", staging, "to", to, "error", err)
+		return err
+	}
+	return nil
+}
+
+// measureTransfer measures the source of a move or copy and, when it
+// exists, the destination it replaces.
+func (h *APIHandler) measureTransfer(from, to string, exists bool) (treeUsage, treeUsage, error) {
+	source, err := h.measureTree(from)
+	if err != nil || !exists {
+		return source, treeUsage{}, err
+	}
+
+	replaced, err := h.measureTree(to)
+	return source, replaced, err
+}
+
+// respondTransferError reports a failed preparation step, logging errors
+// that are not meant for the client.
+func (h *APIHandler) respondTransferError(c *gin.Context, err error, message string) {
+	var aerr *apiError
+	if errors.As(err, &aerr) {
+		h.respondAPIError(c, err)
+		return
+	}
+	h.logger.Error(message, "error", err)
+	respondError(c, http.StatusInternalServerError, CodeInternal, message)
+}
+
+// MoveFile handles POST /api/v1/move
+func (h *APIHandler) MoveFile(c *gin.Context) {
+	var req models.TransferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidParameter, "Expected JSON body with from and to")
+		return
+	}
+
+	from, to, err := h.resolveTransfer(req)
+	if err != nil {
+		h.respondAPIError(c, err)
+		return
+	}
+
+	if _, err := h.store.Stat(from); err != nil {
+		respondError(c, http.StatusNotFound, CodeNotFound, "Source not found")
+		return
+	}
+
+	exists, err := h.prepareDestination(to, req.Overwrite)
+	if err != nil {
+		h.respondTransferError(c, err, "Error preparing destination")
+		return
+	}
+
+	source, replaced, err := h.measureTransfer(from, to, exists)
+	if err != nil {
+		h.respondTransferError(c, err, "Error computing move size")
+		return
+	}
+
+	err = h.transfer(to, exists,
+		func(dst string) error { return storage.Rename(h.store, from, dst) },
+		func(staging string) error { return storage.Rename(h.store, staging, from) },
+	)
+	if err != nil {
+		h.logger.Error("Error moving file", "from", from, "to", to, "error", err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Error moving file")
+		return
+	}
+	h.purgeVariants(from)
+	h.purgeVariants(to)
+
+	h.usage.removeTree(to, replaced)
+	h.usage.removeTree(from, source)
+	h.usage.addTree(to, source)
+
+	c.JSON(http.StatusOK, gin.H{"from": req.From, "to": req.To})
+}
+
+// CopyFile handles POST /api/v1/copy
+func (h *APIHandler) CopyFile(c *gin.Context) {
+	var req models.TransferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidParameter, "Expected JSON body with from and to")
+		return
+	}
+
+	from, to, err := h.resolveTransfer(req)
+	if err != nil {
+		h.respondAPIError(c, err)
+		return
+	}
+
+	if _, err := h.store.Stat(from); err != nil {
+		respondError(c, http.StatusNotFound, CodeNotFound, "Source not found")
+		return
+	}
+
+	exists, err := h.prepareDestination(to, req.Overwrite)
+	if err != nil {
+		h.respondTransferError(c, err, "Error preparing destination")
+		return
+	}
+
+	source, replaced, err := h.measureTransfer(from, to, exists)
+	if err != nil {
+		h.respondTransferError(c, err, "Error computing copy size")
+		return
+	}
+	if err := h.checkQuota(source.bytes - replaced.bytes); err != nil {
+		h.respondAPIError(c, err)
+		return
+	}
+
+	// Files are reported under to even when they were staged first
+	var copied []string
+	err = h.transfer(to, exists,
+		func(dst string) error {
+			names, err := storage.CopyTree(h.store, from, dst)
+			for _, name := range names {
+				copied = append(copied, path.Join(to, strings.TrimPrefix(name, dst)))
+			}
+			return err
+		},
+		h.store.Remove,
+	)
+	if err != nil {
+		h.logger.Error("Error copying file", "from", from, "to", to, "error", err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Error copying file")
+		return
+	}
+	h.purgeVariants(to)
+
+	h.usage.removeTree(to, replaced)
+	h.usage.addTree(to, source)
+
+	paths := make([]string, 0, len(copied))
+	for _, name := range copied {
+		paths = append(paths, "/"+name)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"from": req.From, "to": req.To, "paths": paths})
+}
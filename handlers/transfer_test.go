@@ -0,0 +1,332 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"ImageServer/config"
+	"ImageServer/models"
+)
+
+func TestTransfer(t *testing.T) {
+	seed := fstest.MapFS{
+		"a/b.png":     file("b"),
+		"a/keep.png":  file("keep"),
+		"a/sub/c.png": file("c"),
+		"d.png":       file("d"),
+	}
+
+	tests := []struct {
+		name   string
+		copy   bool
+		body   string
+		status int
+		// want maps names to their content after the request; "" means the
+		// name must not exist
+		want map[string]string
+	}{
+		{
+			name:   "move",
+			body:   `{"from":"d.png","to":"e/d.png"}`,
+			status: http.StatusOK,
+			want:   map[string]string{"d.png": "", "e/d.png": "d"},
+		},
+		{
+			name:   "move conflict",
+			body:   `{"from":"d.png","to":"a/b.png"}`,
+			status: http.StatusConflict,
+			want:   map[string]string{"d.png": "d", "a/b.png": "b"},
+		},
+		{
+			name:   "move overwrite",
+			body:   `{"from":"d.png","to":"a/b.png","overwrite":true}`,
+			status: http.StatusOK,
+			want:   map[string]string{"d.png": "", "a/b.png": "d", "a/keep.png": "keep"},
+		},
+		{
+			name:   "move directory overwrite",
+			body:   `{"from":"a/sub","to":"d.png","overwrite":true}`,
+			status: http.StatusOK,
+			want:   map[string]string{"a/sub/c.png": "", "d.png/c.png": "c"},
+		},
+		{
+			name:   "move into itself",
+			body:   `{"from":"a","to":"a/sub/a"}`,
+			status: http.StatusBadRequest,
+			want:   map[string]string{"a/b.png": "b"},
+		},
+		{
+			name:   "move onto own ancestor",
+			body:   `{"from":"a/b.png","to":"a","overwrite":true}`,
+			status: http.StatusBadRequest,
+			want:   map[string]string{"a/b.png": "b", "a/keep.png": "keep"},
+		},
+		{
+			name:   "move onto same path",
+			body:   `{"from":"d.png","to":"d.png","overwrite":true}`,
+			status: http.StatusBadRequest,
+			want:   map[string]string{"d.png": "d"},
+		},
+		{
+			name:   "move missing source",
+			body:   `{"from":"x.png","to":"y.png"}`,
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "copy",
+			copy:   true,
+			body:   `{"from":"a","to":"z"}`,
+			status: http.StatusOK,
+			want:   map[string]string{"a/b.png": "b", "z/b.png": "b", "z/sub/c.png": "c"},
+		},
+		{
+			name:   "copy conflict",
+			copy:   true,
+			body:   `{"from":"d.png","to":"a/b.png"}`,
+			status: http.StatusConflict,
+			want:   map[string]string{"a/b.png": "b"},
+		},
+		{
+			name:   "copy overwrite",
+			copy:   true,
+			body:   `{"from":"d.png","to":"a/b.png","overwrite":true}`,
+			status: http.StatusOK,
+			want:   map[string]string{"d.png": "d", "a/b.png": "d", "a/keep.png": "keep"},
+		},
+		{
+			name:   "copy into itself",
+			copy:   true,
+			body:   `{"from":"a","to":"a/sub/a"}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "copy onto own ancestor",
+			copy:   true,
+			body:   `{"from":"a/sub/c.png","to":"a","overwrite":true}`,
+			status: http.StatusBadRequest,
+			want:   map[string]string{"a/b.png": "b", "a/keep.png": "keep", "a/sub/c.png": "c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(nil, seed)
+			handler, target := h.MoveFile, "/api/v1/move"
+			if tt.copy {
+				handler, target = h.CopyFile, "/api/v1/copy"
+			}
+
+			w := serve(handler, http.MethodPost, target, tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			for name, want := range tt.want {
+				data, err := readStored(h, name)
+				if want == "" {
+					if err == nil {
+						t.Errorf("%s exists, want it gone", name)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("%s: %v", name, err)
+				} else if data != want {
+					t.Errorf("%s = %q, want %q", name, data, want)
+				}
+			}
+
+			assertNoStaging(t, h)
+		})
+	}
+}
+
+func TestCopyReportsDestinationPaths(t *testing.T) {
+	h := newTestHandler(nil, fstest.MapFS{
+		"a/b.png": file("b"),
+		"z/old":   file("old"),
+	})
+
+	w := serve(h.CopyFile, http.MethodPost, "/api/v1/copy", `{"from":"a","to":"z","overwrite":true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	var resp struct {
+		Paths []string `json:"paths"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Paths) != 1 || resp.Paths[0] != "/z/b.png" {
+		t.Errorf("paths = %q, want [/z/b.png]", resp.Paths)
+	}
+	if _, err := h.store.Stat("z/old"); err == nil {
+		t.Error("z/old survived the overwrite")
+	}
+}
+
+func readStored(h *APIHandler, name string) (string, error) {
+	data, err := fs.ReadFile(h.store, name)
+	return string(data), err
+}
+
+// assertNoStaging fails when a staged transfer was left behind.
+func assertNoStaging(t *testing.T, h *APIHandler) {
+	t.Helper()
+	for _, dir := range []string{".", "a", "e", "z"} {
+		entries, _ := h.store.ReadDir(dir)
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), ".transfer-") {
+				t.Errorf("staging %s/%s left behind", dir, entry.Name())
+			}
+		}
+	}
+}
+
+func TestCopyQuota(t *testing.T) {
+	seed := fstest.MapFS{
+		"a/b.png":   file("0123456789"),
+		"a/c.png":   file("0123456789"),
+		"z/old.png": file("01234"),
+	}
+
+	tests := []struct {
+		name      string
+		limit     int64
+		body      string
+		status    int
+		wantBytes int64
+		wantFiles int
+		// wantFolder is the usage of folder z after the request
+		wantFolder models.FolderUsage
+	}{
+		{
+			name:       "within quota",
+			limit:      45,
+			body:       `{"from":"a","to":"y"}`,
+			status:     http.StatusOK,
+			wantBytes:  45,
+			wantFiles:  5,
+			wantFolder: models.FolderUsage{Name: "z", Bytes: 5, Files: 1},
+		},
+		{
+			name:       "over quota",
+			limit:      44,
+			body:       `{"from":"a","to":"y"}`,
+			status:     http.StatusInsufficientStorage,
+			wantBytes:  25,
+			wantFiles:  3,
+			wantFolder: models.FolderUsage{Name: "z", Bytes: 5, Files: 1},
+		},
+		{
+			name:       "overwrite counts replaced bytes",
+			limit:      40,
+			body:       `{"from":"a","to":"z","overwrite":true}`,
+			status:     http.StatusOK,
+			wantBytes:  40,
+			wantFiles:  4,
+			wantFolder: models.FolderUsage{Name: "z", Bytes: 20, Files: 2},
+		},
+		{
+			name:       "file into folder",
+			limit:      35,
+			body:       `{"from":"a/b.png","to":"z/b.png"}`,
+			status:     http.StatusOK,
+			wantBytes:  35,
+			wantFiles:  4,
+			wantFolder: models.FolderUsage{Name: "z", Bytes: 15, Files: 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(&config.Config{MaxStorageBytes: tt.limit, UsageCacheTTL: time.Hour}, seed)
+			if _, err := h.currentUsage(); err != nil {
+				t.Fatal(err)
+			}
+
+			w := serve(h.CopyFile, http.MethodPost, "/api/v1/copy", tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			usage, err := h.currentUsage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if usage.Bytes != tt.wantBytes || usage.Files != tt.wantFiles {
+				t.Errorf("usage = %d bytes in %d files, want %d in %d", usage.Bytes, usage.Files, tt.wantBytes, tt.wantFiles)
+			}
+			for _, folder := range usage.Folders {
+				if folder.Name == "z" && folder != tt.wantFolder {
+					t.Errorf("folder z = %+v, want %+v", folder, tt.wantFolder)
+				}
+			}
+
+			// The cached figure must match a fresh walk
+			walked, err := h.computeUsage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if walked.Bytes != usage.Bytes || walked.Files != usage.Files {
+				t.Errorf("walk = %d bytes in %d files, cache says %d in %d", walked.Bytes, walked.Files, usage.Bytes, usage.Files)
+			}
+		})
+	}
+}
+
+func TestMoveUsage(t *testing.T) {
+	seed := fstest.MapFS{
+		"a/b.png":   file("0123456789"),
+		"a/c.png":   file("0123456789"),
+		"z/old.png": file("01234"),
+		"root.png":  file("012"),
+	}
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "folder", body: `{"from":"a","to":"y"}`},
+		{name: "overwrite folder", body: `{"from":"a","to":"z","overwrite":true}`},
+		{name: "file between folders", body: `{"from":"a/b.png","to":"z/b.png"}`},
+		{name: "file onto folder", body: `{"from":"root.png","to":"z","overwrite":true}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(&config.Config{UsageCacheTTL: time.Hour}, seed)
+			if _, err := h.currentUsage(); err != nil {
+				t.Fatal(err)
+			}
+
+			w := serve(h.MoveFile, http.MethodPost, "/api/v1/move", tt.body)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			// The cached figure must match a fresh walk, folder by folder
+			usage, err := h.currentUsage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			walked, err := h.computeUsage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if usage.Bytes != walked.Bytes || usage.Files != walked.Files {
+				t.Errorf("cache = %d bytes in %d files, walk %d in %d", usage.Bytes, usage.Files, walked.Bytes, walked.Files)
+			}
+			if got, want := fmt.Sprint(usage.Folders), fmt.Sprint(walked.Folders); got != want {
+				t.Errorf("cached folders = %s, walk %s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"ImageServer/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// usageCache remembers the last storage walk so repeated usage requests do
+// not walk the whole tree each time.
+type usageCache struct {
+	mu    sync.Mutex
+	usage *models.Usage
+}
+
+// add accounts for a stored file in the cached usage until the next walk
+// picks it up.
+func (u *usageCache) add(name string, bytes int64, newFile bool) {
+	files := 0
+	if newFile {
+		files = 1
+	}
+	u.addFiles(name, bytes, files)
+}
+
+// addFiles is add for several files at once, all below the top-level folder
+// of name.
+func (u *usageCache) addFiles(name string, bytes int64, files int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.usage == nil {
+		return
+	}
+
+	u.usage.Bytes += bytes
+	u.usage.Files += files
+
+	top, _, ok := strings.Cut(name, "/")
+	if !ok {
+		return
+	}
+	for i := range u.usage.Folders {
+		if u.usage.Folders[i].Name == top {
+			u.usage.Folders[i].Bytes += bytes
+			u.usage.Folders[i].Files += files
+			// A walk only lists folders that still hold files
+			if u.usage.Folders[i].Files <= 0 {
+				u.usage.Folders = append(u.usage.Folders[:i], u.usage.Folders[i+1:]...)
+			}
+			return
+		}
+	}
+	if files <= 0 {
+		return
+	}
+	u.usage.Folders = append(u.usage.Folders, models.FolderUsage{Name: top, Bytes: bytes, Files: files})
+	sort.Slice(u.usage.Folders, func(i, j int) bool { return u.usage.Folders[i].Name < u.usage.Folders[j].Name })
+}
+
+// addTree accounts for a tree measured by measureTree now being stored at
+// name. A directory counts towards its own top-level folder.
+func (u *usageCache) addTree(name string, tree treeUsage) {
+	if tree.dir {
+		name += "/"
+	}
+	u.addFiles(name, tree.bytes, tree.files)
+}
+
+// removeTree accounts for the tree at name having been removed.
+func (u *usageCache) removeTree(name string, tree treeUsage) {
+	u.addTree(name, treeUsage{bytes: -tree.bytes, files: -tree.files, dir: tree.dir})
+}
+
+// reset drops the cached usage, so the next request walks the storage.
+func (u *usageCache) reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.usage = nil
+}
+
+// checkQuota rejects storing growth more bytes once MAX_STORAGE_BYTES would
+// be exceeded. It relies on the cached usage, so the limit is approximate
+// when files change outside the API.
+func (h *APIHandler) checkQuota(growth int64) error {
+	if h.config.MaxStorageBytes <= 0 || growth <= 0 {
+		return nil
+	}
+
+	usage, err := h.currentUsage()
+	if err != nil {
+		h.logger.Error("Error computing usage", "error", err)
+		return errors.New("Error computing usage")
+	}
+
+	if usage.Bytes+growth > h.config.MaxStorageBytes {
+		h.logger.Warn("Storage quota exceeded", "used", usage.Bytes, "size", growth, "limit", h.config.MaxStorageBytes)
+		return &apiError{http.StatusInsufficientStorage, CodeQuotaExceeded, "Storage quota exceeded"}
+	}
+	return nil
+}
+
+// Usage handles GET /api/v1/usage
+//
+// folders=true adds a breakdown per top-level folder.
+func (h *APIHandler) Usage(c *gin.Context) {
+	usage, err := h.currentUsage()
+	if err != nil {
+		h.logger.Error("Error computing usage", "error", err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Error computing usage")
+		return
+	}
+
+	if c.Query("folders") != "true" {
+		usage.Folders = nil
+	}
+	c.JSON(http.StatusOK, usage)
+}
+
+// currentUsage returns the storage usage, walking the storage again once the
+// cached figure is older than USAGE_CACHE_TTL. Callers get a copy they may
+// modify.
+func (h *APIHandler) currentUsage() (models.Usage, error) {
+	h.usage.mu.Lock()
+	defer h.usage.mu.Unlock()
+
+	if h.usage.usage == nil || time.Since(h.usage.usage.ComputedAt) > h.config.UsageCacheTTL {
+		usage, err := h.computeUsage()
+		if err != nil {
+			return models.Usage{}, err
+		}
+		h.usage.usage = &usage
+	}
+
+	usage := *h.usage.usage
+	usage.Folders = append([]models.FolderUsage(nil), usage.Folders...)
+	return usage, nil
+}
+
+// treeUsage is the size of a file or of a directory and everything in it.
+type treeUsage struct {
+	bytes int64
+	files int
+	dir   bool
+}
+
+// measureTree adds up the size and number of the files at or below name.
+func (h *APIHandler) measureTree(name string) (treeUsage, error) {
+	info, err := h.store.Stat(name)
+	if err != nil {
+		return treeUsage{}, err
+	}
+
+	tree := treeUsage{dir: info.IsDir()}
+	err = fs.WalkDir(h.store, name, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		tree.bytes += info.Size()
+		tree.files++
+		return nil
+	})
+	return tree, err
+}
+
+// computeUsage walks the storage and adds up the size of every file.
+func (h *APIHandler) computeUsage() (models.Usage, error) {
+	usage := models.Usage{}
+	folders := map[string]*models.FolderUsage{}
+
+	err := fs.WalkDir(h.store, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		usage.Bytes += info.Size()
+		usage.Files++
+
+		// Files in the root only count towards the total
+		if top, _, ok := strings.Cut(name, "/"); ok {
+			folder := folders[top]
+			if folder == nil {
+				folder = &models.FolderUsage{Name: top}
+				folders[top] = folder
+			}
+			folder.Bytes += info.Size()
+			folder.Files++
+		}
+		return nil
+	})
+	if err != nil {
+		return usage, err
+	}
+
+	usage.Folders = make([]models.FolderUsage, 0, len(folders))
+	for _, folder := range folders {
+		usage.Folders = append(usage.Folders, *folder)
+	}
+	sort.Slice(usage.Folders, func(i, j int) bool { return usage.Folders[i].Name < usage.Folders[j].Name })
+
+	usage.ComputedAt = time.Now()
+	return usage, nil
+}
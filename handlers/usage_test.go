@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"ImageServer/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestDeleteFreesQuota(t *testing.T) {
+	image := pngFile(4, 4).Data
+
+	tests := []struct {
+		name   string
+		delete func(h *APIHandler) int
+	}{
+		{"file", func(h *APIHandler) int {
+			return serve(h.DeleteFile, http.MethodDelete, "/api/v1/files/a/one.png", "", gin.Param{Key: "path", Value: "/a/one.png"}).Code
+		}},
+		{"folder", func(h *APIHandler) int {
+			return serve(h.DeleteFile, http.MethodDelete, "/api/v1/files/a", "", gin.Param{Key: "path", Value: "/a"}).Code
+		}},
+		{"batch", func(h *APIHandler) int {
+			return serve(h.BatchDelete, http.MethodPost, "/api/v1/files/batch-delete", `["a/one.png"]`).Code
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(&config.Config{
+				Domain:          "http://localhost",
+				MaxUploadBytes:  1 << 20,
+				MaxStorageBytes: int64(len(image)),
+				UsageCacheTTL:   time.Hour,
+			}, fstest.MapFS{})
+
+			upload := func(id string) int {
+				return serveUpload(h.UploadImage, map[string]string{"folder": "a", "id": id, "format": "png"}, image).Code
+			}
+			if code := upload("one"); code != http.StatusCreated {
+				t.Fatalf("first upload = %d, want 201", code)
+			}
+			if code := upload("two"); code != http.StatusInsufficientStorage {
+				t.Fatalf("upload over quota = %d, want 507", code)
+			}
+
+			if code := tt.delete(h); code != http.StatusOK {
+				t.Fatalf("delete = %d, want 200", code)
+			}
+			// The usage cache is still fresh, so only the delete can free space
+			if code := upload("two"); code != http.StatusCreated {
+				t.Errorf("upload after delete = %d, want 201", code)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+
+	"ImageServer/models"
+	"ImageServer/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// VerifyImages handles GET /api/v1/verify/*path
+//
+// Every stored image below path is decoded (header only, or completely with
+// full=true) and the ones that fail are reported.
+func (h *APIHandler) VerifyImages(c *gin.Context) {
+	dirPath := c.Param("path")
+
+	root, err := utils.CleanName(dirPath)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidPath, "Invalid path")
+		return
+	}
+	if _, err := h.store.Stat(root); err != nil {
+		respondError(c, http.StatusNotFound, CodeNotFound, "Directory not found")
+		return
+	}
+
+	full := c.Query("full") == "true"
+	result := models.VerifyResult{Corrupt: []models.CorruptFile{}}
+
+	err = fs.WalkDir(h.store, root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && name != root {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		ext := strings.TrimPrefix(path.Ext(name), ".")
+		if !models.SupportedTypes.Has(ext) {
+			return nil
+		}
+
+		result.Checked++
+		if err := utils.VerifyImage(h.store, name, full); err != nil {
+			result.Corrupt = append(result.Corrupt, models.CorruptFile{
+				Path:  "/" + name,
+				Error: err.Error(),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		h.logger.Error("Error walking directory", "path", root, "error", err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Error walking directory")
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// FixExtensions handles POST /api/v1/maintenance/fix-extensions
+func (h *APIHandler) FixExtensions(c *gin.Context) {
+	renamed, err := utils.FixAllFiles(h.store)
+	if err != nil {
+		h.logger.Error("Error fixing file extensions", "error", err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Error fixing file extensions")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"renamed": renamed})
+}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+
+	"ImageServer/models"
+	"ImageServer/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxWarmVariants bounds how many variants a single warm request may ask for.
+const maxWarmVariants = 32
+
+// WarmRequest lists the variants to pre-generate for one image. Each spec
+// takes the same parameters as the image URL query, e.g. {"width": 200} or
+// {"variant": "preview", "format": "webp"}.
+type WarmRequest struct {
+	Path     string           `json:"path" binding:"required"`
+	Variants []map[string]any `json:"variants" binding:"required"`
+}
+
+// WarmResult reports the outcome for one spec of a warm request.
+type WarmResult struct {
+	URL    string `json:"url"`
+	Cached bool   `json:"cached"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Warm handles POST /api/v1/warm
+func (h *ImageHandler) Warm(c *gin.Context) {
+	var req WarmRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidParameter, "Expected JSON body with path and variants")
+		return
+	}
+	if len(req.Variants) > maxWarmVariants {
+		respondError(c, http.StatusBadRequest, CodeInvalidParameter, fmt.Sprintf("At most %d variants can be warmed at once", maxWarmVariants))
+		return
+	}
+
+	name, err := utils.CleanName(req.Path)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidPath, "Invalid path")
+		return
+	}
+	if info, err := h.store.Stat(name); err != nil || info.IsDir() {
+		respondError(c, http.StatusNotFound, CodeNotFound, "Image not found")
+		return
+	}
+
+	results := make([]WarmResult, len(req.Variants))
+	sem := make(chan struct{}, runtime.NumCPU())
+	var wg sync.WaitGroup
+
+	for i, spec := range req.Variants {
+		query := url.Values{}
+		for key, value := range spec {
+			query.Set(key, fmt.Sprint(value))
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			results[i] = h.warmOne(c.Request.Context(), req.Path, name, query)
+		}()
+	}
+	wg.Wait()
+
+	c.JSON(http.StatusOK, results)
+}
+
+// warmOne generates a single variant unless it is already cached.
+func (h *ImageHandler) warmOne(ctx context.Context, imagePath, name string, query url.Values) WarmResult {
+	result := WarmResult{URL: h.imageURL(imagePath, query)}
+
+	variant, err := h.parseVariant(query)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	opts, err := h.parseEncodeOptions(query)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	name = utils.ResolveAlias(h.store, name)
+	format := strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+	target := strings.ToLower(queryDefault(query, "format", format))
+	if models.CanonicalExt(target) == models.CanonicalExt(format) {
+		target = format
+	}
+
+	if !models.SupportedTypes.Has(target) {
+		result.Error = "Unsupported format: " + target
+		return result
+	}
+	if target != format && !utils.CanEncode(target) {
+		result.Error = notOutputFormat(target)
+		return result
+	}
+	if !h.config.ConvertibleTypes.Has(format) || !h.config.ConvertibleTypes.Has(target) || !utils.CanEncode(target) {
+		result.Error = "Variants of " + format + " as " + target + " are not available"
+		return result
+	}
+
+	variantName := h.variantName(name, variant, opts, target)
+
+	if h.cachedVariant(variantName) {
+		h.janitor.Touch(variantName)
+		result.Cached = true
+		return result
+	}
+
+	img, err := h.generate(ctx, name, variant, target, variantName, opts)
+	if errors.Is(err, errBusy) {
+		result.Error = "Too many conversions in progress"
+		return result
+	}
+	if errors.Is(err, context.Canceled) {
+		result.Error = "Request canceled"
+		return result
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		result.Error = "Generating the variant took too long"
+		return result
+	}
+	if errors.Is(err, utils.ErrEncoderUnavailable) {
+		result.Error = "Encoding to " + target + " is not available"
+		return result
+	}
+	if err != nil || img == nil {
+		h.logger.Error("Error warming variant", "path", imagePath, "variant", variant.Key(), "error", err)
+		result.Error = "Error generating variant"
+	}
+	return result
+}
+
+// imageURL builds the public URL of an image with the given query.
+func (h *ImageHandler) imageURL(imagePath string, query url.Values) string {
+	baseURL, err := url.Parse(h.config.Domain)
+	if err != nil {
+		return ""
+	}
+	baseURL.Path = path.Join(baseURL.Path, imagePath)
+	baseURL.RawQuery = query.Encode()
+	return baseURL.String()
+}
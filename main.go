@@ -1,16 +1,24 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 
 	"ImageServer/config"
 	"ImageServer/handlers"
 	"ImageServer/middleware"
+	"ImageServer/storage"
 	"ImageServer/utils"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
@@ -18,64 +26,214 @@ func main() {
 	// Load configuration
 	cfg := config.Load()
 
-	utils.FixAllFiles(cfg)
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: cfg.LogLevel}))
+	slog.SetDefault(logger)
 
-	// Ensure data directory exists
-	dirname, err := filepath.Abs(cfg.Path)
+	// Refuse to start on bad configuration; this also creates the data and
+	// cache directories
+	if err := cfg.Validate(); err != nil {
+		logger.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+
+	store, err := newStorage(cfg)
+	if err != nil {
+		logger.Error("Could not open storage", "backend", cfg.StorageBackend, "error", err)
+		os.Exit(1)
+	}
+
+	// Variants are always cached on local disk
+	cache, err := storage.NewLocal(cfg.CachePath)
 	if err != nil {
-		log.Fatalf("Could not get absolute path: %s\n", err)
+		logger.Error("Could not open cache", "path", cfg.CachePath, "error", err)
+		os.Exit(1)
+	}
+
+	// Walking a whole bucket on every start is too slow; the maintenance
+	// endpoint covers the S3 backend
+	if cfg.StorageBackend == "local" {
+		if _, err := utils.FixAllFiles(store); err != nil {
+			logger.Error("Error fixing file extensions", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	utils.MaxPixels = cfg.MaxPixels
+	utils.FindExtensions = cfg.FindExtensions
+
+	var watermark *utils.Watermark
+	if cfg.WatermarkPath != "" {
+		watermark, err = utils.LoadWatermark(cfg.WatermarkPath)
+		if err != nil {
+			logger.Error("Could not load watermark", "path", cfg.WatermarkPath, "error", err)
+			os.Exit(1)
+		}
 	}
 
-	dirPath := filepath.Dir(cfg.Path)
-	if err := os.MkdirAll(dirPath, 0755); err != nil {
-		log.Fatalf("Cannot make dir %s: %s\n", cfg.Path, err)
+	dirname, err := filepath.Abs(cfg.Path)
+	if err != nil {
+		logger.Error("Could not get absolute path", "error", err)
+		os.Exit(1)
 	}
 
-	// Create Gin router
-	r := gin.Default()
+	// Create Gin router. Requests are logged by AccessLog, with their ID,
+	// instead of gin's default logger
+	r := gin.New()
+	r.Use(gin.Recovery())
+
+	// Only X-Forwarded-For headers set by TRUSTED_PROXIES count towards the
+	// client IP that requests are rate limited and logged by
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		logger.Error("Invalid TRUSTED_PROXIES", "error", err)
+		os.Exit(1)
+	}
 
 	// Add middleware
-	r.Use(middleware.CORS())
+	r.Use(middleware.RequestID())
+	r.Use(middleware.AccessLog(logger))
+	r.Use(middleware.CORS(middleware.CORSOptions{
+		AllowedOrigins:   cfg.CORS.AllowedOrigins,
+		AllowedMethods:   cfg.CORS.AllowedMethods,
+		AllowedHeaders:   cfg.CORS.AllowedHeaders,
+		AllowCredentials: cfg.CORS.AllowCredentials,
+	}))
+	r.Use(middleware.Gzip())
+
+	// Keep the variant cache within CACHE_MAX_BYTES until shutdown
+	janitor := utils.NewCacheJanitor(cache, cfg.CacheMaxBytes)
+	janitorCtx, stopJanitor := context.WithCancel(context.Background())
+	defer stopJanitor()
+	go janitor.Run(janitorCtx, cfg.CacheSweepInterval)
 
 	// Create handlers
-	imageHandler := handlers.NewImageHandler(cfg)
-	apiHandler := handlers.NewAPIHandler(cfg)
+	imageHandler := handlers.NewImageHandler(cfg, store, cache, watermark, janitor, logger)
+	apiHandler := handlers.NewAPIHandler(cfg, store, cache, logger)
+	healthHandler := handlers.NewHealthHandler(cfg, store, logger)
+
+	// Liveness and readiness probes, unauthenticated
+	r.GET("/healthz", healthHandler.Healthz)
+	r.GET("/readyz", healthHandler.Readyz)
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
 	// REST API routes with /api/v1 prefix
 	api := r.Group("/api/v1")
 	{
 		// Protected routes requiring authentication
 		protected := api.Group("/")
-		protected.Use(middleware.BasicAuth(cfg.Username, cfg.Password))
+		if cfg.AuthMode == "bearer" {
+			protected.Use(middleware.BearerAuth(cfg.APIKeys))
+		} else {
+			protected.Use(middleware.BasicAuth(cfg.Username, cfg.Password))
+		}
 		{
 			// File operations
 			protected.GET("/files/*path", apiHandler.ListDirectory)
 			protected.DELETE("/files/*path", apiHandler.DeleteFile)
+			protected.POST("/files/batch-delete", apiHandler.BatchDelete)
+			protected.GET("/stat/*path", apiHandler.StatFile)
+			protected.GET("/verify/*path", apiHandler.VerifyImages)
+			protected.GET("/archive/*path", apiHandler.Archive)
+			protected.GET("/usage", apiHandler.Usage)
+			protected.GET("/color/*path", apiHandler.ImageColors)
+			protected.GET("/blurhash/*path", apiHandler.BlurHash)
+			protected.GET("/sprite/*path", apiHandler.Sprite)
+			protected.POST("/maintenance/fix-extensions", apiHandler.FixExtensions)
+
+			protected.POST("/move", apiHandler.MoveFile)
+			protected.POST("/copy", apiHandler.CopyFile)
 
 			// Directory operations
 			protected.POST("/directories/*path", apiHandler.CreateDirectory)
 
 			// Image upload
-			protected.POST("/images", apiHandler.UploadImage)
+			uploadLimit := middleware.RateLimit(cfg.RateLimitRPS, cfg.RateLimitBurst)
+			protected.POST("/images", uploadLimit, apiHandler.UploadImage)
+			protected.POST("/images/batch", uploadLimit, apiHandler.UploadBatch)
+			protected.POST("/images/fetch", uploadLimit, apiHandler.FetchImage)
+			protected.POST("/images/data", uploadLimit, apiHandler.UploadData)
+
+			// Resumable uploads
+			protected.POST("/uploads", uploadLimit, apiHandler.CreateUpload)
+			protected.GET("/uploads/:id", apiHandler.UploadStatus)
+			protected.PATCH("/uploads/:id", apiHandler.AppendUpload)
+			protected.POST("/uploads/:id/complete", apiHandler.CompleteUpload)
+			protected.DELETE("/uploads/:id", apiHandler.CancelUpload)
+			protected.POST("/warm", imageHandler.Warm)
+			protected.POST("/sign", imageHandler.Sign)
 		}
 	}
 
 	// Handle all other routes as image serving (fallback for unmatched routes)
-	r.NoRoute(func(c *gin.Context) {
-		// Only handle GET requests for image serving
-		if c.Request.Method == "GET" {
+	// Image serving gets its own rate limit budget, separate from uploads
+	r.NoRoute(middleware.RateLimit(cfg.RateLimitRPS, cfg.RateLimitBurst), func(c *gin.Context) {
+		// Only handle GET and HEAD requests for image serving
+		if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
 			// Set the filepath parameter for the image handler
 			c.Params = append(c.Params, gin.Param{Key: "filepath", Value: c.Request.URL.Path})
 			imageHandler.ServeImage(c)
+		} else if strings.HasPrefix(c.Request.URL.Path, "/api/") {
+			// Unknown API routes are not image paths
+			handlers.NotFound(c)
 		} else {
-			c.JSON(404, gin.H{"error": "Not found"})
+			handlers.MethodNotAllowed(c, http.MethodGet, http.MethodHead)
 		}
 	})
 
-	log.Printf("Serving %s on port %s\n", dirname, cfg.Port)
+	if cfg.StorageBackend == "s3" {
+		logger.Info("Serving", "bucket", cfg.S3.Bucket, "port", cfg.Port)
+	} else {
+		logger.Info("Serving", "path", dirname, "port", cfg.Port)
+	}
+
+	srv := &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           r,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
 
 	// Start server
-	if err := r.Run(":" + cfg.Port); err != nil {
-		log.Fatalf("Could not start server: %s\n", err)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Could not start server", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	// Wait for a termination signal, then let in-flight requests finish
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	logger.Info("Shutting down", "timeout", cfg.ShutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Error("Forced shutdown", "error", err)
+		os.Exit(1)
+	}
+}
+
+// newStorage opens the backend originals are stored in.
+func newStorage(cfg *config.Config) (storage.Storage, error) {
+	switch cfg.StorageBackend {
+	case "memory":
+		return storage.NewMemory(), nil
+	case "s3":
+		return storage.NewS3(storage.S3Options{
+			Endpoint:  cfg.S3.Endpoint,
+			Bucket:    cfg.S3.Bucket,
+			AccessKey: cfg.S3.AccessKey,
+			SecretKey: cfg.S3.SecretKey,
+			Region:    cfg.S3.Region,
+			UseSSL:    cfg.S3.UseSSL,
+			Prefix:    cfg.S3.Prefix,
+		})
+	default:
+		return storage.NewLocal(cfg.Path)
 	}
 }
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// ImageRequests counts requests handled by the public image route.
+	ImageRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "imageserver_image_requests_total",
+		Help: "Total number of image requests.",
+	})
+
+	// VariantCache counts variant lookups by result, "hit" or "miss".
+	VariantCache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "imageserver_variant_cache_total",
+		Help: "Variant cache lookups by result.",
+	}, []string{"result"})
+
+	// CacheEvictions counts cached variants removed to stay within
+	// CACHE_MAX_BYTES.
+	CacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "imageserver_cache_evictions_total",
+		Help: "Cached variants evicted to keep the cache within its size budget.",
+	})
+
+	// DecodedCache counts lookups of decoded originals by result, "hit" or
+	// "miss".
+	DecodedCache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "imageserver_decoded_cache_total",
+		Help: "Decoded original cache lookups by result.",
+	}, []string{"result"})
+
+	// VariantGeneration observes how long generating a variant takes.
+	VariantGeneration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "imageserver_variant_generation_seconds",
+		Help:    "Time spent decoding, transforming and encoding a variant.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	})
+
+	// Uploads counts stored uploads.
+	Uploads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "imageserver_uploads_total",
+		Help: "Total number of stored uploads.",
+	})
+
+	// UploadBytes counts the bytes written by uploads.
+	UploadBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "imageserver_upload_bytes_total",
+		Help: "Total bytes written by uploads.",
+	})
+)
@@ -1,28 +1,63 @@
 package middleware
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
+// BasicAuth accepts requests carrying the configured username and password.
+// Both are checked in constant time, regardless of which one is wrong.
 func BasicAuth(username, password string) gin.HandlerFunc {
-	return gin.BasicAuth(gin.Accounts{
-		username: password,
-	})
+	return func(c *gin.Context) {
+		user, pass, _ := c.Request.BasicAuth()
+
+		// Evaluate both comparisons so the timing doesn't tell which failed
+		userOK := secureCompare(user, username)
+		passOK := secureCompare(pass, password)
+		if !userOK || !passOK {
+			c.Header("WWW-Authenticate", `Basic realm="Authorization Required"`)
+			abortWithError(c, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid credentials")
+			return
+		}
+
+		c.Set(gin.AuthUserKey, user)
+		c.Next()
+	}
 }
 
-func CORS() gin.HandlerFunc {
+// BearerAuth accepts requests carrying "Authorization: Bearer <key>" for
+// any of the given keys.
+func BearerAuth(keys []string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Authorization, Content-Type")
-
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(http.StatusOK)
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || !validKey(token, keys) {
+			c.Header("WWW-Authenticate", "Bearer")
+			abortWithError(c, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid or missing API key")
 			return
 		}
 
 		c.Next()
 	}
-}
\ No newline at end of file
+}
+
+// validKey compares token against every key in constant time.
+func validKey(token string, keys []string) bool {
+	valid := false
+	for _, key := range keys {
+		valid = secureCompare(token, key) || valid
+	}
+	return token != "" && valid
+}
+
+// secureCompare reports whether a and b are equal in constant time. Hashes
+// are compared rather than the raw values so the expected length does not
+// leak either.
+func secureCompare(a, b string) bool {
+	aHash := sha256.Sum256([]byte(a))
+	bHash := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(aHash[:], bHash[:]) == 1
+}
@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// runAuth sends a request with the given Authorization header through auth
+// and returns the response.
+func runAuth(auth gin.HandlerFunc, header string) *httptest.ResponseRecorder {
+	r := gin.New()
+	r.Use(auth)
+	r.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if header != "" {
+		req.Header.Set("Authorization", header)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestBearerAuth(t *testing.T) {
+	auth := BearerAuth([]string{"key-one", "key-two"})
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{name: "first key", header: "Bearer key-one", status: http.StatusOK},
+		{name: "second key", header: "Bearer key-two", status: http.StatusOK},
+		{name: "wrong key", header: "Bearer key-three", status: http.StatusUnauthorized},
+		{name: "prefix of a key", header: "Bearer key-", status: http.StatusUnauthorized},
+		{name: "empty key", header: "Bearer ", status: http.StatusUnauthorized},
+		{name: "missing header", status: http.StatusUnauthorized},
+		{name: "other scheme", header: "Basic a2V5LW9uZTo=", status: http.StatusUnauthorized},
+		{name: "lowercase scheme", header: "bearer key-one", status: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := runAuth(auth, tt.header)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("WWW-Authenticate = %q, want Bearer", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestBearerAuthWithoutKeys(t *testing.T) {
+	// No configured key may let an empty token through
+	if w := runAuth(BearerAuth(nil), "Bearer "); w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", w.Code)
+	}
+	if w := runAuth(BearerAuth([]string{""}), "Bearer "); w.Code != http.StatusUnauthorized {
+		t.Errorf("empty key: status = %d, want 401", w.Code)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		noAuth   bool
+		status   int
+	}{
+		{name: "correct", user: "admin", password: "secret", status: http.StatusOK},
+		{name: "wrong user", user: "root", password: "secret", status: http.StatusUnauthorized},
+		{name: "wrong password", user: "admin", password: "secret2", status: http.StatusUnauthorized},
+		{name: "both wrong", user: "root", password: "guess", status: http.StatusUnauthorized},
+		{name: "empty credentials", status: http.StatusUnauthorized},
+		{name: "missing header", noAuth: true, status: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var authUser string
+			r := gin.New()
+			r.Use(BasicAuth("admin", "secret"))
+			r.GET("/", func(c *gin.Context) {
+				authUser = c.GetString(gin.AuthUserKey)
+				c.Status(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if !tt.noAuth {
+				req.SetBasicAuth(tt.user, tt.password)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.status == http.StatusOK {
+				if authUser != tt.user {
+					t.Errorf("%s = %q, want %q", gin.AuthUserKey, authUser, tt.user)
+				}
+				return
+			}
+			if got := w.Header().Get("WWW-Authenticate"); got != `Basic realm="Authorization Required"` {
+				t.Errorf("WWW-Authenticate = %q", got)
+			}
+		})
+	}
+}
+
+func TestSecureCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"secret", "secret", true},
+		{"", "", true},
+		{"secret", "Secret", false},
+		{"secret", "secret1", false},
+		{"secret", "", false},
+	}
+
+	for _, tt := range tests {
+		if got := secureCompare(tt.a, tt.b); got != tt.want {
+			t.Errorf("secureCompare(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
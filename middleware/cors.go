@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CORSOptions configures the CORS middleware.
+type CORSOptions struct {
+	// AllowedOrigins is the origin allowlist. When empty any origin is
+	// allowed through a wildcard.
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+}
+
+// CORS answers cross-origin requests. An allowed request origin is echoed
+// back; origins missing from a configured allowlist get no CORS headers, so
+// browsers block them. Preflight requests are answered with 204.
+func CORS(opts CORSOptions) gin.HandlerFunc {
+	methods := strings.Join(opts.AllowedMethods, ", ")
+	headers := strings.Join(opts.AllowedHeaders, ", ")
+
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+
+		switch {
+		case len(opts.AllowedOrigins) == 0:
+			// Credentials are never allowed with a wildcard origin
+			c.Header("Access-Control-Allow-Origin", "*")
+		case origin != "" && slices.Contains(opts.AllowedOrigins, origin):
+			c.Header("Access-Control-Allow-Origin", origin)
+			c.Header("Vary", "Origin")
+			if opts.AllowCredentials {
+				c.Header("Access-Control-Allow-Credentials", "true")
+			}
+		default:
+			c.Header("Vary", "Origin")
+			if c.Request.Method == http.MethodOptions {
+				c.AbortWithStatus(http.StatusNoContent)
+				return
+			}
+			c.Next()
+			return
+		}
+
+		c.Header("Access-Control-Allow-Methods", methods)
+		c.Header("Access-Control-Allow-Headers", headers)
+		c.Header("Access-Control-Expose-Headers", RequestIDHeader)
+
+		if c.Request.Method == http.MethodOptions {
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+
+		c.Next()
+	}
+}
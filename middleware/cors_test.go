@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCORS(t *testing.T) {
+	allowlist := CORSOptions{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		AllowedMethods:   []string{"GET", "POST"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowCredentials: true,
+	}
+	wildcard := allowlist
+	wildcard.AllowedOrigins = nil
+
+	tests := []struct {
+		name        string
+		opts        CORSOptions
+		method      string
+		origin      string
+		status      int
+		allowOrigin string
+		vary        string
+		credentials string
+		methods     string
+	}{
+		{
+			name: "allowed origin", opts: allowlist, method: http.MethodGet, origin: "https://app.example.com",
+			status: http.StatusOK, allowOrigin: "https://app.example.com", vary: "Origin", credentials: "true", methods: "GET, POST",
+		},
+		{
+			name: "allowed preflight", opts: allowlist, method: http.MethodOptions, origin: "https://app.example.com",
+			status: http.StatusNoContent, allowOrigin: "https://app.example.com", vary: "Origin", credentials: "true", methods: "GET, POST",
+		},
+		{
+			name: "disallowed origin", opts: allowlist, method: http.MethodGet, origin: "https://evil.example.com",
+			status: http.StatusOK, vary: "Origin",
+		},
+		{
+			name: "disallowed preflight", opts: allowlist, method: http.MethodOptions, origin: "https://evil.example.com",
+			status: http.StatusNoContent, vary: "Origin",
+		},
+		{
+			name: "no origin", opts: allowlist, method: http.MethodGet,
+			status: http.StatusOK, vary: "Origin",
+		},
+		{
+			name: "wildcard", opts: wildcard, method: http.MethodGet, origin: "https://app.example.com",
+			status: http.StatusOK, allowOrigin: "*", methods: "GET, POST",
+		},
+		{
+			name: "wildcard preflight", opts: wildcard, method: http.MethodOptions, origin: "https://evil.example.com",
+			status: http.StatusNoContent, allowOrigin: "*", methods: "GET, POST",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.Use(CORS(tt.opts))
+			r.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			req := httptest.NewRequest(tt.method, "/", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			headers := map[string]string{
+				"Access-Control-Allow-Origin":      tt.allowOrigin,
+				"Vary":                             tt.vary,
+				"Access-Control-Allow-Credentials": tt.credentials,
+				"Access-Control-Allow-Methods":     tt.methods,
+			}
+			for key, want := range headers {
+				if got := w.Header().Get(key); got != want {
+					t.Errorf("%s = %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
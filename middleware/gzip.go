@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// compressibleTypes are the text based content types worth compressing.
+// Raster images are already compressed and are passed through untouched.
+var compressibleTypes = map[string]bool{
+	"image/svg+xml":          true,
+	"application/json":       true,
+	"application/xml":        true,
+	"application/javascript": true,
+}
+
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return compressibleTypes[mediaType] || strings.HasPrefix(mediaType, "text/")
+}
+
+// gzipWriter decides when the headers are sent whether the response is
+// compressed, based on its status and Content-Type. WriteHeader only records
+// the status, as handlers such as c.JSON call it before setting the type.
+type gzipWriter struct {
+	gin.ResponseWriter
+	gz       *gzip.Writer
+	decided  bool
+	compress bool
+}
+
+func (w *gzipWriter) decide() {
+	if w.decided {
+		return
+	}
+	w.decided = true
+
+	header := w.Header()
+	if w.Status() != http.StatusOK || header.Get("Content-Encoding") != "" || !compressible(header.Get("Content-Type")) {
+		return
+	}
+
+	w.compress = true
+	header.Del("Content-Length")
+	header.Set("Content-Encoding", "gzip")
+	header.Add("Vary", "Accept-Encoding")
+	// The compressed bytes differ from the stored ones, so a strong ETag
+	// would no longer be byte-for-byte accurate
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+	w.gz = gzip.NewWriter(w.ResponseWriter)
+}
+
+func (w *gzipWriter) WriteHeaderNow() {
+	w.decide()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *gzipWriter) Write(data []byte) (int, error) {
+	w.WriteHeaderNow()
+	if w.compress {
+		return w.gz.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *gzipWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *gzipWriter) Flush() {
+	if w.compress {
+		w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// Gzip compresses text based responses such as SVG and JSON for clients that
+// accept gzip. Partial (206) and other non-200 responses are left alone.
+func Gzip() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !strings.Contains(c.GetHeader("Accept-Encoding"), "gzip") || c.Request.Method == http.MethodHead {
+			c.Next()
+			return
+		}
+
+		w := &gzipWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		defer func() {
+			if w.compress {
+				w.gz.Close()
+			}
+		}()
+
+		c.Next()
+	}
+}
@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func TestGzip(t *testing.T) {
+	const svg = `<svg xmlns="http://www.w3.org/2000/svg"></svg>`
+
+	r := gin.New()
+	r.Use(Gzip())
+	r.GET("/json", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+	r.GET("/json-error", func(c *gin.Context) {
+		c.JSON(http.StatusNotFound, gin.H{"ok": false})
+	})
+	serveSVG := func(c *gin.Context) {
+		c.Header("ETag", `"abc"`)
+		c.Data(http.StatusOK, "image/svg+xml", []byte(svg))
+	}
+	r.GET("/svg", serveSVG)
+	r.HEAD("/svg", serveSVG)
+	r.GET("/svg-weak", func(c *gin.Context) {
+		c.Header("ETag", `W/"abc"`)
+		c.Data(http.StatusOK, "image/svg+xml", []byte(svg))
+	})
+	r.GET("/png", func(c *gin.Context) {
+		c.Header("ETag", `"abc"`)
+		c.Data(http.StatusOK, "image/png", []byte("\x89PNG"))
+	})
+
+	tests := []struct {
+		name     string
+		target   string
+		accept   string
+		method   string
+		compress bool
+		body     string
+		etag     string
+	}{
+		{name: "json", target: "/json", accept: "gzip", compress: true, body: `{"ok":true}`},
+		{name: "json error", target: "/json-error", accept: "gzip", body: `{"ok":false}`},
+		{name: "svg", target: "/svg", accept: "gzip, deflate", compress: true, body: svg, etag: `W/"abc"`},
+		{name: "svg weak etag", target: "/svg-weak", accept: "gzip", compress: true, body: svg, etag: `W/"abc"`},
+		{name: "svg without gzip", target: "/svg", accept: "br", body: svg, etag: `"abc"`},
+		{name: "svg head", target: "/svg", accept: "gzip", method: http.MethodHead, etag: `"abc"`},
+		{name: "png", target: "/png", accept: "gzip", body: "\x89PNG", etag: `"abc"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, tt.target, nil)
+			req.Header.Set("Accept-Encoding", tt.accept)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if got := w.Header().Get("Content-Encoding") == "gzip"; got != tt.compress {
+				t.Fatalf("compressed = %v, want %v", got, tt.compress)
+			}
+			if got := w.Header().Get("ETag"); got != tt.etag {
+				t.Errorf("ETag = %q, want %q", got, tt.etag)
+			}
+
+			body := w.Body.String()
+			if tt.compress {
+				if w.Header().Get("Vary") != "Accept-Encoding" {
+					t.Errorf("Vary = %q, want Accept-Encoding", w.Header().Get("Vary"))
+				}
+				if w.Header().Get("Content-Length") != "" {
+					t.Errorf("Content-Length = %q on a compressed response", w.Header().Get("Content-Length"))
+				}
+				zr, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = string(data)
+			}
+			if tt.method != http.MethodHead && body != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
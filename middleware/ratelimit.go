@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bucketIdleTimeout is how long an unused client bucket is kept around.
+const bucketIdleTimeout = 10 * time.Minute
+
+// maxBuckets bounds how many clients are tracked at once, so a flood of
+// distinct addresses cannot grow the limiter without bound.
+const maxBuckets = 100_000
+
+type bucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// rateLimiter is a per-client token bucket: each client may burst up to
+// burst requests and regains rps tokens per second.
+type rateLimiter struct {
+	rps        float64
+	burst      float64
+	maxBuckets int
+	mu         sync.Mutex
+	buckets    map[string]*bucket
+	lastSweep  time.Time
+}
+
+// take consumes a token for key. When none is available it returns how long
+// the client has to wait for the next one.
+func (l *rateLimiter) take(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > bucketIdleTimeout {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= l.maxBuckets {
+			l.sweep(now)
+		}
+		if len(l.buckets) >= l.maxBuckets {
+			l.evictOldest()
+		}
+		b = &bucket{tokens: l.burst, lastSeen: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.lastSeen).Seconds()*l.rps)
+	b.lastSeen = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rps * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep drops the buckets of clients idle for longer than bucketIdleTimeout.
+func (l *rateLimiter) sweep(now time.Time) {
+	for k, b := range l.buckets {
+		if now.Sub(b.lastSeen) > bucketIdleTimeout {
+			delete(l.buckets, k)
+		}
+	}
+	l.lastSweep = now
+}
+
+// evictOldest drops the bucket of the client seen least recently.
+func (l *rateLimiter) evictOldest() {
+	var oldest string
+	var oldestSeen time.Time
+	for k, b := range l.buckets {
+		if oldest == "" || b.lastSeen.Before(oldestSeen) {
+			oldest, oldestSeen = k, b.lastSeen
+		}
+	}
+	delete(l.buckets, oldest)
+}
+
+// RateLimit limits each client IP to rps requests per second with bursts of
+// up to burst requests. Rejected requests get 429 with a Retry-After header.
+// The client IP is gin's ClientIP, which only follows X-Forwarded-For from
+// the engine's trusted proxies.
+// Every call returns an independent limiter, so routes can have separate
+// budgets. A non-positive rps disables limiting.
+func RateLimit(rps float64, burst int) gin.HandlerFunc {
+	if rps <= 0 {
+		return func(c *gin.Context) {
+			c.Next()
+		}
+	}
+
+	limiter := &rateLimiter{
+		rps:        rps,
+		burst:      math.Max(1, float64(burst)),
+		maxBuckets: maxBuckets,
+		buckets:    make(map[string]*bucket),
+	}
+
+	return func(c *gin.Context) {
+		ok, wait := limiter.take(c.ClientIP(), time.Now())
+		if !ok {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.Header("Cache-Control", "no-store")
+			abortWithError(c, http.StatusTooManyRequests, "RATE_LIMITED", "Too many requests")
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRateLimitClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		// want is the status of the second request, sent from the same
+		// connection address with a different X-Forwarded-For
+		want int
+	}{
+		{name: "no trusted proxies", want: http.StatusTooManyRequests},
+		{name: "other proxy trusted", trusted: []string{"10.0.0.0/8"}, want: http.StatusTooManyRequests},
+		{name: "proxy trusted", trusted: []string{"192.0.2.1"}, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			if err := r.SetTrustedProxies(tt.trusted); err != nil {
+				t.Fatal(err)
+			}
+			r.Use(RateLimit(1, 1))
+			r.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			statuses := make([]int, 2)
+			for i, forwarded := range []string{"203.0.113.1", "203.0.113.2"} {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.RemoteAddr = "192.0.2.1:1234"
+				req.Header.Set("X-Forwarded-For", forwarded)
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+				statuses[i] = w.Code
+			}
+
+			if statuses[0] != http.StatusOK || statuses[1] != tt.want {
+				t.Errorf("statuses = %v, want [200 %d]", statuses, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiterBucketCap(t *testing.T) {
+	l := &rateLimiter{rps: 1, burst: 1, maxBuckets: 3, buckets: make(map[string]*bucket)}
+	now := time.Now()
+
+	for i := range 10 {
+		if ok, _ := l.take(fmt.Sprint(i), now.Add(time.Duration(i)*time.Second)); !ok {
+			t.Fatalf("first request of client %d rejected", i)
+		}
+		if len(l.buckets) > l.maxBuckets {
+			t.Fatalf("%d buckets, want at most %d", len(l.buckets), l.maxBuckets)
+		}
+	}
+
+	// The most recent clients are still limited
+	if ok, _ := l.take("9", now.Add(9*time.Second)); ok {
+		t.Error("client 9 was not limited")
+	}
+	if _, ok := l.buckets["0"]; ok {
+		t.Error("oldest client 0 was not evicted")
+	}
+}
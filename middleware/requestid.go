@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestIDHeader carries the request ID in both directions.
+const RequestIDHeader = "X-Request-ID"
+
+// RequestIDKey is the gin context key the request ID is stored under.
+const RequestIDKey = "requestID"
+
+type requestIDContextKey struct{}
+
+// validRequestID limits client supplied IDs to characters that are safe in
+// headers and log lines.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestID takes the request ID from the X-Request-ID header, or generates
+// one when it is missing or unusable. The ID is stored in the gin and
+// request contexts and echoed in the response header.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+
+		c.Set(RequestIDKey, id)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestIDContextKey{}, id))
+		c.Header(RequestIDHeader, id)
+		c.Next()
+	}
+}
+
+// RequestIDFrom returns the request ID stored in ctx, or "" when there is
+// none.
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// newRequestID returns 16 random bytes in hex.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// AccessLog logs every request once it is done, with its request ID so a
+// reported ID leads to the matching log lines.
+func AccessLog(logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		logger.Info("Request",
+			"request_id", c.GetString(RequestIDKey),
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"duration", time.Since(start),
+			"client", c.ClientIP(),
+		)
+	}
+}
+
+// abortWithError aborts the request with the error envelope the handlers
+// use, including the request ID.
+func abortWithError(c *gin.Context, status int, code, message string) {
+	body := gin.H{"code": code, "message": message}
+	if id := c.GetString(RequestIDKey); id != "" {
+		body["requestId"] = id
+	}
+	c.AbortWithStatusJSON(status, gin.H{"error": body})
+}
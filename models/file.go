@@ -11,13 +11,208 @@ type FileInfo struct {
 	Size    int64     `json:"size"`
 	ModTime time.Time `json:"modTime"`
 	IsDir   bool      `json:"isDir"`
+
+	// Populated only when metadata is requested
+	ContentType string `json:"contentType,omitempty"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	BlurHash    string `json:"blurhash,omitempty"`
+}
+
+// FileList is a single page of a directory listing.
+type FileList struct {
+	Items      []FileInfo `json:"items"`
+	Page       int        `json:"page"`
+	Size       int        `json:"size"`
+	TotalItems int        `json:"totalItems"`
+	TotalPages int        `json:"totalPages"`
+}
+
+// UploadResult reports the outcome of one file in a batch upload.
+type UploadResult struct {
+	ID    string `json:"id"`
+	URL   string `json:"url,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// UploadedImage describes a stored upload. Path is relative to the data
+// directory; Size and the dimensions are those of the stored file, which is
+// a PNG when the upload was converted from OriginalFormat. Format repeats
+// StoredFormat. Width and Height are omitted for SVG and AVIF.
+type UploadedImage struct {
+	URL            string `json:"url"`
+	Path           string `json:"path"`
+	Size           int64  `json:"size"`
+	Width          int    `json:"width,omitempty"`
+	Height         int    `json:"height,omitempty"`
+	Format         string `json:"format"`
+	OriginalFormat string `json:"originalFormat"`
+	StoredFormat   string `json:"storedFormat"`
+}
+
+// VerifyResult reports the files under a directory that failed to decode.
+type VerifyResult struct {
+	Checked int           `json:"checked"`
+	Corrupt []CorruptFile `json:"corrupt"`
+}
+
+type CorruptFile struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// RenamedFile records a file renamed by maintenance.
+type RenamedFile struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// TransferRequest is the body of move and copy requests. Paths are relative
+// to the data directory.
+type TransferRequest struct {
+	From      string `json:"from" binding:"required"`
+	To        string `json:"to" binding:"required"`
+	Overwrite bool   `json:"overwrite"`
+}
+
+// Usage reports how much the stored originals take up.
+type Usage struct {
+	Bytes      int64         `json:"bytes"`
+	Files      int           `json:"files"`
+	Folders    []FolderUsage `json:"folders,omitempty"`
+	ComputedAt time.Time     `json:"computedAt"`
+}
+
+// FolderUsage is the share of one top-level folder in Usage.
+type FolderUsage struct {
+	Name  string `json:"name"`
+	Bytes int64  `json:"bytes"`
+	Files int    `json:"files"`
+}
+
+// DeleteResult reports the outcome for one path of a batch delete.
+type DeleteResult struct {
+	Path    string `json:"path"`
+	Deleted bool   `json:"deleted"`
+	Error   string `json:"error,omitempty"`
+}
+
+// FetchRequest asks the server to download and store a remote image. Folder
+// and ID follow the upload rules; Format defaults to the remote content type.
+type FetchRequest struct {
+	URL    string `json:"url" binding:"required"`
+	Folder string `json:"folder" binding:"required"`
+	ID     string `json:"id"`
+	Format string `json:"format"`
+}
+
+// DataUploadRequest stores an image sent inline as a base64 data URI.
+// Format defaults to the URI's media type; Convert overrides
+// CONVERT_ON_UPLOAD like the multipart convert field.
+type DataUploadRequest struct {
+	Data    string `json:"data" binding:"required"`
+	Folder  string `json:"folder" binding:"required"`
+	ID      string `json:"id"`
+	Format  string `json:"format"`
+	Convert *bool  `json:"convert"`
+}
+
+// SpriteTile is the pixel rectangle one image occupies in a sprite sheet.
+type SpriteTile struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+// Sprite describes a sprite sheet of the images in a directory. URL serves
+// the sheet itself and Tiles is keyed by file name.
+type Sprite struct {
+	URL    string                `json:"url"`
+	Width  int                   `json:"width"`
+	Height int                   `json:"height"`
+	Cols   int                   `json:"cols"`
+	Size   int                   `json:"size"`
+	Tiles  map[string]SpriteTile `json:"tiles"`
+}
+
+// ImageColors summarizes the colors of an image. Colors are "#rrggbb"
+// strings; the palette is ordered most common first.
+type ImageColors struct {
+	Dominant string   `json:"dominant"`
+	Palette  []string `json:"palette"`
+	Dark     bool     `json:"dark"`
+}
+
+// UploadSessionRequest starts a resumable upload of Size bytes. Folder, ID
+// and Format follow the upload rules.
+type UploadSessionRequest struct {
+	Folder string `json:"folder" binding:"required"`
+	ID     string `json:"id"`
+	Format string `json:"format" binding:"required"`
+	Size   int64  `json:"size" binding:"required"`
+}
+
+// UploadSession is a resumable upload in progress. Offset is how many bytes
+// have been received; the next chunk must start there.
+type UploadSession struct {
+	ID      string    `json:"id"`
+	Folder  string    `json:"folder"`
+	FileID  string    `json:"fileId,omitempty"`
+	Format  string    `json:"format"`
+	Size    int64     `json:"size"`
+	Offset  int64     `json:"offset"`
+	Expires time.Time `json:"expires"`
 }
 
 type ExtSlice []string
 
+// ParseExtSlice parses a comma-separated list of extensions such as
+// "png, .jpg,webp".
+func ParseExtSlice(value string) ExtSlice {
+	var list ExtSlice
+	for _, ext := range strings.Split(value, ",") {
+		ext = strings.TrimPrefix(strings.TrimSpace(ext), ".")
+		if ext != "" {
+			list = append(list, ext)
+		}
+	}
+	return list
+}
+
+// extAliases maps other spellings of an extension to the one files are
+// stored under.
+var extAliases = map[string]string{"jpeg": "jpg"}
+
+// CanonicalExt returns the extension files of format ext are stored under,
+// so "jpeg" becomes "jpg".
+func CanonicalExt(ext string) string {
+	if canonical, ok := extAliases[ext]; ok {
+		return canonical
+	}
+	return ext
+}
+
+// ExtAlias returns the other spelling of ext, or "" when it has none.
+func ExtAlias(ext string) string {
+	for alias, canonical := range extAliases {
+		switch ext {
+		case alias:
+			return canonical
+		case canonical:
+			return alias
+		}
+	}
+	return ""
+}
+
+// Has reports whether the list contains the extension a. Extensions match
+// exactly but case-insensitively, and the spellings of one format are
+// equal.
 func (list ExtSlice) Has(a string) bool {
+	a = CanonicalExt(strings.ToLower(a))
 	for _, b := range list {
-		if strings.HasSuffix(a, b) {
+		if a == CanonicalExt(strings.ToLower(b)) {
 			return true
 		}
 	}
@@ -31,10 +226,16 @@ var SupportedTypes = ExtSlice{
 	"webp",
 	"jpeg",
 	"svg",
+	"avif",
 }
 
+// ConverableTypes is the default set of formats variants are generated for.
+// Operators can narrow it with the CONVERTIBLE_TYPES environment variable.
+// AVIF is left out until it can be decoded and encoded.
 var ConverableTypes = ExtSlice{
 	"jpg",
 	"png",
 	"jpeg",
+	"gif",
+	"webp",
 }
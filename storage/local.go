@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Local stores files in a directory on disk.
+type Local struct {
+	root string
+}
+
+// NewLocal returns a Storage rooted at dir.
+func NewLocal(dir string) (*Local, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Local{root: root}, nil
+}
+
+// path converts a storage name to a path on disk.
+func (l *Local) path(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(l.root, filepath.FromSlash(name)), nil
+}
+
+func (l *Local) Open(name string) (fs.File, error) {
+	p, err := l.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (l *Local) Stat(name string) (fs.FileInfo, error) {
+	p, err := l.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+func (l *Local) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := l.path("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadDir(p)
+}
+
+func (l *Local) Create(name string) (Writer, error) {
+	p, err := l.path("create", name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	// CreateTemp only grants the owner access
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &atomicFile{File: f, path: p}, nil
+}
+
+// atomicFile renames its temporary file into place on Close.
+type atomicFile struct {
+	*os.File
+	path string
+}
+
+func (f *atomicFile) Close() error {
+	defer os.Remove(f.Name())
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), f.path)
+}
+
+func (f *atomicFile) Abort() error {
+	f.File.Close()
+	return os.Remove(f.Name())
+}
+
+func (l *Local) Remove(name string) error {
+	p, err := l.path("remove", name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(p); err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+func (l *Local) MkdirAll(name string) error {
+	p, err := l.path("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, 0755)
+}
+
+func (l *Local) Rename(from, to string) error {
+	src, err := l.path("rename", from)
+	if err != nil {
+		return err
+	}
+	dst, err := l.path("rename", to)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return os.Rename(src, dst)
+}
+
+func (l *Local) Chtimes(name string, modTime time.Time) error {
+	p, err := l.path("chtimes", name)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(p, modTime, modTime)
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"bytes"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"testing/fstest"
+	"time"
+)
+
+// Memory keeps files in memory. It is meant for tests and throwaway setups;
+// everything is lost when the process exits.
+type Memory struct {
+	mu    sync.RWMutex
+	files fstest.MapFS
+}
+
+// NewMemory returns an empty in-memory Storage.
+func NewMemory() *Memory {
+	return &Memory{files: fstest.MapFS{}}
+}
+
+// NewMemoryFrom returns an in-memory Storage holding a copy of files, which
+// makes it easy to seed a fixture.
+func NewMemoryFrom(files fstest.MapFS) *Memory {
+	m := NewMemory()
+	for name, file := range files {
+		copied := *file
+		m.files[name] = &copied
+	}
+	return m
+}
+
+// The read methods hand out files backed by the stored byte slices. Writes
+// replace a file's entry rather than its bytes, so open files stay valid.
+
+func (m *Memory) Open(name string) (fs.File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.files.Open(name)
+}
+
+func (m *Memory) Stat(name string) (fs.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.files.Stat(name)
+}
+
+func (m *Memory) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.files.ReadDir(name)
+}
+
+func (m *Memory) Create(name string) (Writer, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+	return &memoryWriter{m: m, name: name}, nil
+}
+
+// memoryWriter buffers a file until Close stores it.
+type memoryWriter struct {
+	bytes.Buffer
+	m    *Memory
+	name string
+}
+
+func (w *memoryWriter) Close() error {
+	w.m.mu.Lock()
+	defer w.m.mu.Unlock()
+	w.m.files[w.name] = &fstest.MapFile{Data: w.Bytes(), Mode: 0644, ModTime: time.Now()}
+	return nil
+}
+
+func (w *memoryWriter) Abort() error {
+	w.Reset()
+	return nil
+}
+
+func (m *Memory) Remove(name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.files.Stat(name); err != nil {
+		return err
+	}
+	for key := range m.files {
+		if name == "." || key == name || strings.HasPrefix(key, name+"/") {
+			delete(m.files, key)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) MkdirAll(name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if info, err := m.files.Stat(name); err == nil {
+		if !info.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+		}
+		return nil
+	}
+	m.files[name] = &fstest.MapFile{Mode: fs.ModeDir | 0755, ModTime: time.Now()}
+	return nil
+}
+
+func (m *Memory) Rename(from, to string) error {
+	if !fs.ValidPath(from) || !fs.ValidPath(to) || from == "." || to == "." {
+		return &fs.PathError{Op: "rename", Path: from, Err: fs.ErrInvalid}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.files.Stat(from); err != nil {
+		return err
+	}
+	moved := fstest.MapFS{}
+	for key, file := range m.files {
+		if key == from || strings.HasPrefix(key, from+"/") {
+			delete(m.files, key)
+			moved[path.Join(to, strings.TrimPrefix(key, from))] = file
+		}
+	}
+	for key, file := range moved {
+		m.files[key] = file
+	}
+	return nil
+}
+
+func (m *Memory) Chtimes(name string, modTime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, ok := m.files[name]
+	if !ok {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrNotExist}
+	}
+	copied := *file
+	copied.ModTime = modTime
+	m.files[name] = &copied
+	return nil
+}
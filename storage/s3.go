@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Options describes the bucket an S3 storage uses.
+type S3Options struct {
+	Endpoint  string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Region    string
+	UseSSL    bool
+	// Prefix is prepended to every object key
+	Prefix string
+}
+
+// S3 stores files as objects in an S3 compatible bucket. Directories are
+// key prefixes; MkdirAll writes an empty "<dir>/" marker object so empty
+// directories can still be listed.
+type S3 struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3 returns a Storage backed by the bucket in opts.
+func NewS3(opts S3Options) (*S3, error) {
+	client, err := minio.New(opts.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(opts.AccessKey, opts.SecretKey, ""),
+		Secure: opts.UseSSL,
+		Region: opts.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.Trim(opts.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &S3{client: client, bucket: opts.Bucket, prefix: prefix}, nil
+}
+
+// key returns the object key of a file.
+func (s *S3) key(op, name string) (string, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return s.prefix + name, nil
+}
+
+// dirPrefix returns the key prefix of everything below a directory.
+func (s *S3) dirPrefix(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return s.prefix, nil
+	}
+	return s.prefix + name + "/", nil
+}
+
+// mapError turns missing object errors into fs.ErrNotExist.
+func mapError(op, name string, err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchBucket", "NotFound":
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return err
+}
+
+// hasPrefix reports whether any object key starts with prefix.
+func (s *S3) hasPrefix(ctx context.Context, prefix string) (bool, error) {
+	// The listing keeps paging until it is cancelled and drained
+	ctx, cancel := context.WithCancel(ctx)
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, MaxKeys: 1})
+	defer func() {
+		cancel()
+		for range objects {
+		}
+	}()
+
+	for obj := range objects {
+		if obj.Err != nil {
+			return false, obj.Err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func (s *S3) Open(name string) (fs.File, error) {
+	key, err := s.key("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := s.client.GetObject(context.Background(), s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, mapError("open", name, err)
+	}
+
+	// GetObject is lazy; Stat surfaces a missing object right away
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, mapError("open", name, err)
+	}
+	return &s3File{Object: obj, info: fileInfo(path.Base(name), info)}, nil
+}
+
+func (s *S3) Stat(name string) (fs.FileInfo, error) {
+	ctx := context.Background()
+
+	if name == "." {
+		ok, err := s.client.BucketExists(ctx, s.bucket)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+		}
+		return dirInfo("."), nil
+	}
+
+	key, err := s.key("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err == nil {
+		return fileInfo(path.Base(name), info), nil
+	}
+	if err = mapError("stat", name, err); !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	// Not an object, but it is a directory if anything is stored below it
+	ok, err := s.hasPrefix(ctx, key+"/")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return dirInfo(path.Base(name)), nil
+}
+
+func (s *S3) ReadDir(name string) ([]fs.DirEntry, error) {
+	prefix, err := s.dirPrefix("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []fs.DirEntry
+	for obj := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return nil, mapError("readdir", name, obj.Err)
+		}
+
+		rel := strings.TrimPrefix(obj.Key, prefix)
+		switch {
+		case rel == "":
+			// The directory's own marker
+		case strings.HasSuffix(rel, "/"):
+			entries = append(entries, dirInfo(strings.TrimSuffix(rel, "/")))
+		default:
+			entries = append(entries, fileInfo(rel, obj))
+		}
+	}
+
+	if len(entries) == 0 && name != "." {
+		if _, err := s.Stat(name); err != nil {
+			return nil, err
+		}
+	}
+
+	// Keys are listed in byte order, which differs from name order once
+	// directories get their trailing slash
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (s *S3) Create(name string) (Writer, error) {
+	key, err := s.key("create", name)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.client.PutObject(context.Background(), s.bucket, key, pr, -1, minio.PutObjectOptions{
+			ContentType: mime.TypeByExtension(path.Ext(name)),
+			PartSize:    s3PartSize,
+		})
+		pr.CloseWithError(err)
+		done <- err
+	}()
+
+	return &s3Writer{pw: pw, done: done}, nil
+}
+
+// s3PartSize is the part size of streamed uploads, whose length is unknown.
+// minio-go buffers a whole part, and otherwise sizes parts for a 5 TiB
+// object.
+const s3PartSize = 16 << 20
+
+// errAborted cancels an upload started by Create.
+var errAborted = errors.New("write aborted")
+
+// s3Writer streams to a PutObject call, which only stores the object once
+// the stream ends cleanly.
+type s3Writer struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *s3Writer) Close() error {
+	w.pw.Close()
+	return <-w.done
+}
+
+func (w *s3Writer) Abort() error {
+	w.pw.CloseWithError(errAborted)
+	<-w.done
+	return nil
+}
+
+func (s *S3) Remove(name string) error {
+	ctx := context.Background()
+
+	prefix, err := s.dirPrefix("remove", name)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	if name != "." {
+		key, _ := s.key("remove", name)
+		if _, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{}); err == nil {
+			found = true
+			if err := s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+				return err
+			}
+		}
+	}
+
+	objects := make(chan minio.ObjectInfo)
+	listErr := make(chan error, 1)
+	go func() {
+		defer close(objects)
+		for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+			if obj.Err != nil {
+				listErr <- obj.Err
+				return
+			}
+			found = true
+			objects <- obj
+		}
+		listErr <- nil
+	}()
+
+	for rerr := range s.client.RemoveObjects(ctx, s.bucket, objects, minio.RemoveObjectsOptions{}) {
+		if rerr.Err != nil {
+			err = rerr.Err
+		}
+	}
+	if lerr := <-listErr; lerr != nil {
+		return lerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	return nil
+}
+
+func (s *S3) MkdirAll(name string) error {
+	if name == "." {
+		return nil
+	}
+	prefix, err := s.dirPrefix("mkdir", name)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.PutObject(context.Background(), s.bucket, prefix, strings.NewReader(""), 0, minio.PutObjectOptions{})
+	return err
+}
+
+// s3File is an object opened for reading. minio.Object already reads, seeks
+// and closes; only Stat needs an io/fs shaped result.
+type s3File struct {
+	*minio.Object
+	info fs.FileInfo
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// entry describes an object or directory as both fs.FileInfo and
+// fs.DirEntry.
+type entry struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func fileInfo(name string, obj minio.ObjectInfo) *entry {
+	return &entry{name: name, size: obj.Size, modTime: obj.LastModified}
+}
+
+func dirInfo(name string) *entry {
+	return &entry{name: name, dir: true}
+}
+
+func (e *entry) Name() string               { return e.name }
+func (e *entry) Size() int64                { return e.size }
+func (e *entry) ModTime() time.Time         { return e.modTime }
+func (e *entry) IsDir() bool                { return e.dir }
+func (e *entry) Sys() any                   { return nil }
+func (e *entry) Type() fs.FileMode          { return e.Mode().Type() }
+func (e *entry) Info() (fs.FileInfo, error) { return e, nil }
+
+func (e *entry) Mode() fs.FileMode {
+	if e.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
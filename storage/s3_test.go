@@ -0,0 +1,337 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockS3 is an in-memory S3 server implementing the subset of the API the
+// S3 backend uses: bucket HEAD, ListObjectsV2, object GET/HEAD/PUT/DELETE,
+// multi-object delete and multipart uploads. Listings honor max-keys, so
+// clients have to follow continuation tokens.
+type mockS3 struct {
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string]mockObject
+	uploads map[string]map[int][]byte
+	nextID  int
+}
+
+type mockObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newMockS3(bucket string) *mockS3 {
+	return &mockS3{bucket: bucket, objects: map[string]mockObject{}, uploads: map[string]map[int][]byte{}}
+}
+
+// newTestS3 starts a mockS3 and returns an S3 storage using it.
+func newTestS3(t *testing.T, prefix string) (*S3, *mockS3) {
+	t.Helper()
+
+	mock := newMockS3("images")
+	srv := httptest.NewServer(mock)
+	t.Cleanup(srv.Close)
+
+	s, err := NewS3(S3Options{
+		Endpoint: strings.TrimPrefix(srv.URL, "http://"),
+		Bucket:   mock.bucket,
+		Region:   "us-east-1",
+		Prefix:   prefix,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, mock
+}
+
+func (m *mockS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != m.bucket {
+		m.error(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+	case key == "" && r.Method == http.MethodGet && query.Has("location"):
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+		}{})
+	case key == "" && r.Method == http.MethodGet:
+		m.list(w, query)
+	case key == "" && r.Method == http.MethodPost && query.Has("delete"):
+		m.deleteObjects(w, r)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		m.nextID++
+		id := strconv.Itoa(m.nextID)
+		m.uploads[id] = map[int][]byte{}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		parts, ok := m.uploads[query.Get("uploadId")]
+		if !ok {
+			m.error(w, r, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		data, _ := io.ReadAll(r.Body)
+		parts[number] = data
+		w.Header().Set("ETag", fmt.Sprintf(`"part-%d"`, number))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts, ok := m.uploads[query.Get("uploadId")]
+		if !ok {
+			m.error(w, r, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		numbers := make([]int, 0, len(parts))
+		for number := range parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		for _, number := range numbers {
+			data = append(data, parts[number]...)
+		}
+		delete(m.uploads, query.Get("uploadId"))
+		m.objects[key] = mockObject{data: data, modTime: time.Now().UTC().Truncate(time.Second)}
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: `"multipart"`})
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(m.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		m.objects[key] = mockObject{data: data, modTime: time.Now().UTC().Truncate(time.Second)}
+		w.Header().Set("ETag", `"object"`)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		obj, ok := m.objects[key]
+		if !ok {
+			m.error(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", `"object"`)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, key, obj.modTime, bytes.NewReader(obj.data))
+	case r.Method == http.MethodDelete:
+		delete(m.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		m.error(w, r, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// list answers ListObjectsV2, grouping keys below delimiter into common
+// prefixes. The continuation token is the last key returned.
+func (m *mockS3) list(w http.ResponseWriter, query map[string][]string) {
+	get := func(key string) string {
+		if v := query[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	prefix, delimiter, after := get("prefix"), get("delimiter"), get("continuation-token")
+	maxKeys, err := strconv.Atoi(get("max-keys"))
+	if err != nil || maxKeys <= 0 {
+		maxKeys = 1000
+	}
+
+	type content struct {
+		Key          string
+		LastModified time.Time
+		Size         int64
+		ETag         string
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		KeyCount              int
+		MaxKeys               int
+		IsTruncated           bool
+		NextContinuationToken string         `xml:",omitempty"`
+		Contents              []content      `xml:"Contents"`
+		CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+	}{Name: m.bucket, Prefix: prefix, MaxKeys: maxKeys}
+
+	keys := make([]string, 0, len(m.objects))
+	for key := range m.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) || key <= after {
+			continue
+		}
+		entry := key
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				entry = key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if seen[entry] {
+			continue
+		}
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		seen[entry] = true
+		result.KeyCount++
+		// Skip the rest of a common prefix when continuing
+		result.NextContinuationToken = entry + "\xff"
+		if entry != key {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: entry})
+			continue
+		}
+		obj := m.objects[key]
+		result.Contents = append(result.Contents, content{Key: key, LastModified: obj.modTime, Size: int64(len(obj.data)), ETag: `"object"`})
+	}
+	if !result.IsTruncated {
+		result.NextContinuationToken = ""
+	}
+	writeXML(w, result)
+}
+
+// deleteObjects answers a multi-object delete.
+func (m *mockS3) deleteObjects(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		m.error(w, r, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	type deleted struct {
+		Key string
+	}
+	result := struct {
+		XMLName xml.Name  `xml:"DeleteResult"`
+		Deleted []deleted `xml:"Deleted"`
+	}{}
+	for _, obj := range req.Objects {
+		delete(m.objects, obj.Key)
+		result.Deleted = append(result.Deleted, deleted{Key: obj.Key})
+	}
+	writeXML(w, result)
+}
+
+func (m *mockS3) error(w http.ResponseWriter, r *http.Request, status int, code string) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: code})
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+func TestS3Prefix(t *testing.T) {
+	s, mock := newTestS3(t, "/tenant/")
+
+	if err := WriteFile(s, "a/b.png", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MkdirAll("empty"); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make([]string, 0, len(mock.objects))
+	for key := range mock.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if want := []string{"tenant/a/b.png", "tenant/empty/"}; strings.Join(keys, ",") != strings.Join(want, ",") {
+		t.Errorf("keys = %q, want %q", keys, want)
+	}
+
+	entries, err := s.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := entryNames(entries); got != "a/,empty/" {
+		t.Errorf("root = %s, want a/,empty/", got)
+	}
+}
+
+func TestS3LargeFile(t *testing.T) {
+	s, _ := newTestS3(t, "")
+
+	// Larger than one part, so the upload spans several
+	data := bytes.Repeat([]byte("0123456789abcdef"), s3PartSize/16+1000)
+	if err := WriteFile(s, "big.bin", data); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := s.Stat("big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(data)) {
+		t.Errorf("size = %d, want %d", info.Size(), len(data))
+	}
+}
+
+func TestS3StatDirectoryStopsListing(t *testing.T) {
+	s, _ := newTestS3(t, "")
+	seed(t, s, map[string]string{"dir/a": "a", "dir/b": "b", "dir/c": "c"})
+
+	before := runtime.NumGoroutine()
+	for range 20 {
+		if info, err := s.Stat("dir"); err != nil || !info.IsDir() {
+			t.Fatalf("Stat(dir) = %v, %v; want a directory", info, err)
+		}
+	}
+
+	// Listings abandoned after their first key must not linger
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before+2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before+2 {
+		t.Errorf("%d goroutines left running after Stat, had %d", n, before)
+	}
+}
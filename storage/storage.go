@@ -0,0 +1,149 @@
+// Package storage abstracts where original images are kept. Names are slash
+// separated paths relative to the storage root, as accepted by io/fs, with
+// "." naming the root itself. Callers validate user input before building
+// names.
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"time"
+)
+
+// Storage holds the original images. Besides the read-only io/fs methods,
+// which make fs.WalkDir, fs.ReadDir and fs.Stat work on any backend, it can
+// write and remove files.
+type Storage interface {
+	fs.ReadDirFS
+	fs.StatFS
+
+	// Create returns a writer for name, creating parent directories as
+	// needed. The content only becomes visible once Close returns without
+	// error, so readers never see a partial file.
+	Create(name string) (Writer, error)
+	// Remove deletes a file, or a directory with everything in it. It
+	// returns an error wrapping fs.ErrNotExist when name does not exist.
+	Remove(name string) error
+	// MkdirAll creates a directory and its parents. Backends without real
+	// directories may treat it as a no-op.
+	MkdirAll(name string) error
+}
+
+// Writer is returned by Storage.Create. Close publishes the file; Abort
+// discards everything written instead.
+type Writer interface {
+	io.WriteCloser
+	Abort() error
+}
+
+// Renamer is implemented by backends that can move files natively.
+type Renamer interface {
+	Rename(from, to string) error
+}
+
+// Chtimeser is implemented by backends that can set modification times.
+type Chtimeser interface {
+	Chtimes(name string, modTime time.Time) error
+}
+
+// ReadSeeker returns f as an io.ReadSeeker, buffering it in memory when the
+// backend's files cannot seek.
+func ReadSeeker(f fs.File) (io.ReadSeeker, error) {
+	if rs, ok := f.(io.ReadSeeker); ok {
+		return rs, nil
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+// WriteFile stores data at name.
+func WriteFile(s Storage, name string, data []byte) error {
+	w, err := s.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// Rename moves a file or directory, natively when the backend supports it
+// and by copying and removing otherwise.
+func Rename(s Storage, from, to string) error {
+	if r, ok := s.(Renamer); ok {
+		return r.Rename(from, to)
+	}
+	if _, err := CopyTree(s, from, to); err != nil {
+		return err
+	}
+	return s.Remove(from)
+}
+
+// CopyTree copies a file or directory to dst, returning the names of the
+// files written. Modification times are kept when the backend allows it.
+func CopyTree(s Storage, src, dst string) ([]string, error) {
+	var copied []string
+
+	err := fs.WalkDir(s, src, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		target := dst
+		if name != src {
+			target = path.Join(dst, name[len(src)+1:])
+		}
+
+		if d.IsDir() {
+			return s.MkdirAll(target)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		if err := copyFile(s, name, target); err != nil {
+			return err
+		}
+		copied = append(copied, target)
+		return nil
+	})
+
+	return copied, err
+}
+
+func copyFile(s Storage, src, dst string) error {
+	in, err := s.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := s.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Abort()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	if c, ok := s.(Chtimeser); ok {
+		return c.Chtimes(dst, info.ModTime())
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// backends returns a fresh, empty instance of every Storage implementation.
+func backends(t *testing.T) map[string]Storage {
+	t.Helper()
+
+	local, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3, _ := newTestS3(t, "")
+	return map[string]Storage{"local": local, "memory": NewMemory(), "s3": s3}
+}
+
+// seed writes files to s.
+func seed(t *testing.T, s Storage, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		if err := WriteFile(s, name, []byte(data)); err != nil {
+			t.Fatalf("writing %s: %v", name, err)
+		}
+	}
+}
+
+func TestStorage(t *testing.T) {
+	files := map[string]string{
+		"a.png":       "a",
+		"dir/b.png":   "bb",
+		"dir/sub/c":   "ccc",
+		"dir2/d.webp": "dddd",
+	}
+
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s Storage)
+	}{
+		{"read", func(t *testing.T, s Storage) {
+			data, err := fs.ReadFile(s, "dir/b.png")
+			if err != nil || string(data) != "bb" {
+				t.Errorf("ReadFile = %q, %v; want bb", data, err)
+			}
+		}},
+		{"stat", func(t *testing.T, s Storage) {
+			info, err := s.Stat("dir/sub/c")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Name() != "c" || info.Size() != 3 || info.IsDir() {
+				t.Errorf("Stat = %s %d dir=%v, want c 3 file", info.Name(), info.Size(), info.IsDir())
+			}
+
+			info, err = s.Stat("dir")
+			if err != nil || !info.IsDir() {
+				t.Errorf("Stat(dir) = %v, %v; want a directory", info, err)
+			}
+			if info, err := s.Stat("."); err != nil || !info.IsDir() {
+				t.Errorf("Stat(.) = %v, %v; want a directory", info, err)
+			}
+		}},
+		{"stat missing", func(t *testing.T, s Storage) {
+			for _, name := range []string{"missing.png", "dir/missing", "di"} {
+				if _, err := s.Stat(name); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("Stat(%s) = %v, want fs.ErrNotExist", name, err)
+				}
+				if _, err := s.Open(name); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("Open(%s) = %v, want fs.ErrNotExist", name, err)
+				}
+			}
+		}},
+		{"read dir", func(t *testing.T, s Storage) {
+			entries, err := s.ReadDir("dir")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := entryNames(entries); got != "b.png,sub/" {
+				t.Errorf("ReadDir(dir) = %s, want b.png,sub/", got)
+			}
+
+			entries, err = s.ReadDir(".")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := entryNames(entries); got != "a.png,dir/,dir2/" {
+				t.Errorf("ReadDir(.) = %s, want a.png,dir/,dir2/", got)
+			}
+
+			if _, err := s.ReadDir("missing"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("ReadDir(missing) = %v, want fs.ErrNotExist", err)
+			}
+		}},
+		{"walk", func(t *testing.T, s Storage) {
+			var names []string
+			err := fs.WalkDir(s, ".", func(name string, d fs.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					names = append(names, name)
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(names, ","); got != "a.png,dir/b.png,dir/sub/c,dir2/d.webp" {
+				t.Errorf("walk = %s", got)
+			}
+		}},
+		{"overwrite", func(t *testing.T, s Storage) {
+			seed(t, s, map[string]string{"a.png": "replaced"})
+			if data, _ := fs.ReadFile(s, "a.png"); string(data) != "replaced" {
+				t.Errorf("a.png = %q, want replaced", data)
+			}
+		}},
+		{"abort", func(t *testing.T, s Storage) {
+			w, err := s.Create("aborted.png")
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(w, "partial")
+			if err := w.Abort(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Stat("aborted.png"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Stat after Abort = %v, want fs.ErrNotExist", err)
+			}
+		}},
+		{"unpublished until close", func(t *testing.T, s Storage) {
+			for _, name := range []string{"a.png", "new.png"} {
+				before, _ := fs.ReadFile(s, name)
+				w, err := s.Create(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.WriteString(w, "partial")
+				// Readers keep seeing the previous content, if any
+				if data, _ := fs.ReadFile(s, name); string(data) != string(before) {
+					t.Errorf("%s = %q before Close, want %q", name, data, before)
+				}
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if data, _ := fs.ReadFile(s, name); string(data) != "partial" {
+					t.Errorf("%s = %q after Close, want partial", name, data)
+				}
+			}
+		}},
+		{"invalid names", func(t *testing.T, s Storage) {
+			for _, name := range []string{"../escape", "/abs", "a/../b"} {
+				if _, err := s.Create(name); err == nil {
+					t.Errorf("Create(%s) succeeded", name)
+				}
+				if err := s.Remove(name); err == nil {
+					t.Errorf("Remove(%s) succeeded", name)
+				}
+			}
+		}},
+		{"mkdir", func(t *testing.T, s Storage) {
+			if err := s.MkdirAll("empty/nested"); err != nil {
+				t.Fatal(err)
+			}
+			info, err := s.Stat("empty/nested")
+			if err != nil || !info.IsDir() {
+				t.Errorf("Stat(empty/nested) = %v, %v; want a directory", info, err)
+			}
+			entries, err := s.ReadDir("empty/nested")
+			if err != nil || len(entries) != 0 {
+				t.Errorf("ReadDir(empty/nested) = %v, %v; want no entries", entries, err)
+			}
+		}},
+		{"remove file", func(t *testing.T, s Storage) {
+			if err := s.Remove("dir/b.png"); err != nil {
+				t.Fatal(err)
+			}
+			assertFiles(t, s, "a.png,dir/sub/c,dir2/d.webp")
+		}},
+		{"remove dir", func(t *testing.T, s Storage) {
+			if err := s.Remove("dir"); err != nil {
+				t.Fatal(err)
+			}
+			assertFiles(t, s, "a.png,dir2/d.webp")
+			if _, err := s.Stat("dir"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Stat(dir) = %v, want fs.ErrNotExist", err)
+			}
+		}},
+		{"remove missing", func(t *testing.T, s Storage) {
+			if err := s.Remove("missing"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Remove(missing) = %v, want fs.ErrNotExist", err)
+			}
+		}},
+		{"rename file", func(t *testing.T, s Storage) {
+			if err := Rename(s, "a.png", "moved/a.png"); err != nil {
+				t.Fatal(err)
+			}
+			assertFiles(t, s, "dir/b.png,dir/sub/c,dir2/d.webp,moved/a.png")
+		}},
+		{"rename dir", func(t *testing.T, s Storage) {
+			if err := Rename(s, "dir", "dir3"); err != nil {
+				t.Fatal(err)
+			}
+			assertFiles(t, s, "a.png,dir2/d.webp,dir3/b.png,dir3/sub/c")
+		}},
+		{"copy tree", func(t *testing.T, s Storage) {
+			copied, err := CopyTree(s, "dir", "copy")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(copied)
+			if got := strings.Join(copied, ","); got != "copy/b.png,copy/sub/c" {
+				t.Errorf("copied = %s", got)
+			}
+			assertFiles(t, s, "a.png,copy/b.png,copy/sub/c,dir/b.png,dir/sub/c,dir2/d.webp")
+			if data, _ := fs.ReadFile(s, "copy/sub/c"); string(data) != "ccc" {
+				t.Errorf("copy/sub/c = %q, want ccc", data)
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, s := range backends(t) {
+				t.Run(name, func(t *testing.T) {
+					seed(t, s, files)
+					tt.run(t, s)
+				})
+			}
+		})
+	}
+}
+
+func TestMemoryFrom(t *testing.T) {
+	files := fstest.MapFS{"a.png": {Data: []byte("a")}}
+	m := NewMemoryFrom(files)
+	seed(t, m, map[string]string{"a.png": "changed"})
+
+	if string(files["a.png"].Data) != "a" {
+		t.Error("writing to the storage changed the fixture")
+	}
+}
+
+// entryNames joins the names of entries, marking directories with a slash.
+func entryNames(entries []fs.DirEntry) string {
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+		if entry.IsDir() {
+			names[i] += "/"
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// assertFiles checks that the regular files in s are exactly want, given as
+// sorted comma separated names.
+func assertFiles(t *testing.T, s Storage, want string) {
+	t.Helper()
+
+	var names []string
+	err := fs.WalkDir(s, ".", func(name string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			names = append(names, name)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(names, ","); got != want {
+		t.Errorf("files = %s, want %s", got, want)
+	}
+}
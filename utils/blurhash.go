@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"io/fs"
+	"math"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// blurHashSampleSize bounds the side of the image a BlurHash is computed
+// from. The hash only keeps a few low frequency components, so scaling
+// down first barely changes it.
+const blurHashSampleSize = 32
+
+// ImageBlurHash decodes the image name and returns its BlurHash with the
+// given number of horizontal and vertical components.
+func ImageBlurHash(fsys fs.FS, name string, xComponents, yComponents int) (string, error) {
+	img, err := loadImage(fsys, name)
+	if err != nil {
+		return "", err
+	}
+	if img == nil {
+		return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	bounds := img.Bounds()
+	if bounds.Dx() > blurHashSampleSize || bounds.Dy() > blurHashSampleSize {
+		img = Resize(img, blurHashSampleSize, blurHashSampleSize, draw.CatmullRom)
+	}
+	return BlurHash(img, xComponents, yComponents)
+}
+
+// BlurHash encodes img as a BlurHash string (https://blurha.sh) with 1 to 9
+// components on each axis. Alpha is ignored.
+func BlurHash(img image.Image, xComponents, yComponents int) (string, error) {
+	if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+		return "", errors.New("blurhash components must be from 1 to 9")
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return "", errors.New("blurhash of an empty image")
+	}
+
+	// Linear channel values, read once
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+			linear[y*width+x] = [3]float64{srgbToLinear(c.R), srgbToLinear(c.G), srgbToLinear(c.B)}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+
+			var sum [3]float64
+			for y := 0; y < height; y++ {
+				basisY := math.Cos(math.Pi * float64(j) * float64(y) / float64(height))
+				for x := 0; x < width; x++ {
+					basis := basisY * math.Cos(math.Pi*float64(i)*float64(x)/float64(width))
+					p := linear[y*width+x]
+					sum[0] += basis * p[0]
+					sum[1] += basis * p[1]
+					sum[2] += basis * p[2]
+				}
+			}
+
+			scale := normalisation / float64(width*height)
+			factors = append(factors, [3]float64{sum[0] * scale, sum[1] * scale, sum[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	encode83(&hash, (xComponents-1)+(yComponents-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+
+	maximumValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = max(actualMax, math.Abs(f[0]), math.Abs(f[1]), math.Abs(f[2]))
+		}
+		quantisedMax := int(max(0, min(82, math.Floor(actualMax*166-0.5))))
+		maximumValue = float64(quantisedMax+1) / 166
+		encode83(&hash, quantisedMax, 1)
+	} else {
+		encode83(&hash, 0, 1)
+	}
+
+	encode83(&hash, linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+
+	for _, f := range ac {
+		quant := func(v float64) int {
+			return int(max(0, min(18, math.Floor(signPow(v/maximumValue, 0.5)*9+9.5))))
+		}
+		encode83(&hash, quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2)
+	}
+
+	return hash.String(), nil
+}
+
+// base83 is the BlurHash digit alphabet.
+const base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// encode83 appends value as length base 83 digits.
+func encode83(b *strings.Builder, value, length int) {
+	divisor := 1
+	for i := 1; i < length; i++ {
+		divisor *= 83
+	}
+	for ; length > 0; length-- {
+		b.WriteByte(base83[(value/divisor)%83])
+		divisor /= 83
+	}
+}
+
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = max(0, min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
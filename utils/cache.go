@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"path"
+
+	"ImageServer/storage"
+)
+
+// VariantCacheName returns the name a variant of the original name is cached
+// under. Variants live in a directory mirroring the original's name, and the
+// file name is a hash of the name and the variant key so that any
+// combination of parameters maps to its own file.
+func VariantCacheName(original, key, ext string) string {
+	sum := sha256.Sum256([]byte(original + "\x00" + key))
+	return path.Join(original, hex.EncodeToString(sum[:8])+"."+ext)
+}
+
+// PurgeVariants removes every cached variant of original. For a directory
+// this covers all files below it.
+func PurgeVariants(cache storage.Storage, original string) error {
+	if err := cache.Remove(original); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"context"
+	"io"
+)
+
+// ctxReader fails reads once ctx is done. Decoders read in small chunks,
+// so wrapping their input stops a long decode soon after cancellation.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// ctxWriter fails writes once ctx is done, which aborts an encoder at its
+// next write.
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w ctxWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
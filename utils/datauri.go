@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// ErrInvalidDataURI is returned for data URIs that are not base64 encoded
+// or do not decode.
+var ErrInvalidDataURI = errors.New("invalid data URI")
+
+// ParseDataURI splits a base64 data URI such as
+// "data:image/png;base64,iVBORw0..." into its media type and decoded bytes.
+// The media type is "" when the URI does not name one.
+func ParseDataURI(uri string) (string, []byte, error) {
+	rest, ok := strings.CutPrefix(uri, "data:")
+	if !ok {
+		return "", nil, ErrInvalidDataURI
+	}
+	meta, payload, ok := strings.Cut(rest, ",")
+	if !ok {
+		return "", nil, ErrInvalidDataURI
+	}
+	mediaType, ok := strings.CutSuffix(meta, ";base64")
+	if !ok {
+		return "", nil, ErrInvalidDataURI
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(payload))
+	if err != nil {
+		return "", nil, ErrInvalidDataURI
+	}
+	return mediaType, data, nil
+}
@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"container/list"
+	"image"
+	"sync"
+	"time"
+
+	"ImageServer/metrics"
+)
+
+// DecodedCache keeps recently decoded originals in memory so generating
+// several variants of one image decodes it only once. Entries are keyed by
+// name, modification time and size, so a replaced file is decoded again.
+// The cache is bounded by an estimate of the decoded pixel data and evicts
+// the least recently used images first. A nil *DecodedCache caches nothing.
+//
+// Cached images are shared between requests and must not be modified.
+type DecodedCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	entries  map[decodedKey]*list.Element
+	order    *list.List
+}
+
+type decodedKey struct {
+	name    string
+	modTime time.Time
+	size    int64
+}
+
+type decodedEntry struct {
+	key   decodedKey
+	img   image.Image
+	bytes int64
+}
+
+// NewDecodedCache returns a cache holding up to maxBytes of decoded pixels,
+// or nil when maxBytes is not positive.
+func NewDecodedCache(maxBytes int64) *DecodedCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &DecodedCache{
+		maxBytes: maxBytes,
+		entries:  map[decodedKey]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+// get returns the cached image for key, marking it recently used.
+func (c *DecodedCache) get(key decodedKey) image.Image {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		metrics.DecodedCache.WithLabelValues("miss").Inc()
+		return nil
+	}
+	metrics.DecodedCache.WithLabelValues("hit").Inc()
+	c.order.MoveToFront(elem)
+	return elem.Value.(*decodedEntry).img
+}
+
+// add stores img under key, evicting old entries to stay within maxBytes.
+// Images larger than the whole cache are not stored.
+func (c *DecodedCache) add(key decodedKey, img image.Image) {
+	if c == nil {
+		return
+	}
+
+	// Four bytes per pixel is exact for RGBA and an upper bound for the
+	// paletted, gray and YCbCr images decoders mostly return
+	bounds := img.Bounds()
+	size := int64(bounds.Dx()) * int64(bounds.Dy()) * 4
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&decodedEntry{key: key, img: img, bytes: size})
+	c.bytes += size
+
+	for c.bytes > c.maxBytes {
+		oldest := c.order.Back()
+		entry := oldest.Value.(*decodedEntry)
+		c.order.Remove(oldest)
+		delete(c.entries, entry.key)
+		c.bytes -= entry.bytes
+	}
+}
@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"io"
+	"io/fs"
+
+	"ImageServer/storage"
+
+	"golang.org/x/image/draw"
+)
+
+func encodeGIF(w io.Writer, img image.Image, opts EncodeOptions) error {
+	return gif.Encode(w, img, nil)
+}
+
+// loadAnimation decodes every frame of a GIF with FindImage. It returns nil
+// when the file is not a GIF or only has a single frame, so callers fall
+// back to the still image path. Decoding stops once ctx is done.
+func loadAnimation(ctx context.Context, fsys fs.FS, name string) (*gif.GIF, error) {
+	f, err := FindImage(fsys, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	file, err := storage.ReadSeeker(f)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(file, header); err != nil || !bytes.HasPrefix(header, []byte("GIF8")) {
+		return nil, nil
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// Every frame is decoded at the canvas size
+	if err := CheckPixels(file); err != nil {
+		return nil, err
+	}
+
+	anim, err := gif.DecodeAll(ctxReader{ctx, file})
+	if err != nil && ctx.Err() != nil {
+		// The decoder flattens read errors into its own messages
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(anim.Image) < 2 {
+		return nil, nil
+	}
+	return anim, nil
+}
+
+// ApplyVariantAll applies a variant to every frame of an animation. Frames
+// are composited onto the full canvas first, honoring disposal, so each
+// output frame is complete and can be transformed independently. Delays and
+// the loop count are kept. ctx is checked between frames.
+func ApplyVariantAll(ctx context.Context, anim *gif.GIF, variant Variant) (*gif.GIF, error) {
+	bounds := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	canvas := image.NewRGBA(bounds)
+
+	out := &gif.GIF{
+		Delay:     anim.Delay,
+		LoopCount: anim.LoopCount,
+	}
+
+	for i, frame := range anim.Image {
+		var previous *image.RGBA
+		disposal := byte(gif.DisposalNone)
+		if i < len(anim.Disposal) {
+			disposal = anim.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(bounds)
+			draw.Draw(previous, bounds, canvas, image.Point{}, draw.Src)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		full := image.NewRGBA(bounds)
+		draw.Draw(full, bounds, canvas, image.Point{}, draw.Src)
+		transformed, err := ApplyVariant(ctx, full, variant)
+		if err != nil {
+			return nil, err
+		}
+		out.Image = append(out.Image, quantize(transformed, frame.Palette, variant))
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	return out, nil
+}
+
+// quantize converts a frame back to a paletted image. The source palette is
+// reused unless the variant changed the colors to gray or a tint.
+func quantize(img image.Image, p color.Palette, variant Variant) *image.Paletted {
+	switch {
+	case variant.Tint.A != 0:
+		p = shadePalette(variant.Tint)
+	case variant.Grayscale:
+		p = grayPalette
+	}
+	if len(p) == 0 {
+		p = palette.Plan9
+	}
+
+	dst := image.NewPaletted(img.Bounds(), p)
+	draw.FloydSteinberg.Draw(dst, dst.Bounds(), img, img.Bounds().Min)
+	return dst
+}
+
+// grayPalette holds 255 gray levels and a transparent entry.
+var grayPalette = shadePalette(color.NRGBA{0xff, 0xff, 0xff, 0xff})
+
+// shadePalette holds 255 shades of c from black up to c itself and a
+// transparent entry, which covers any monochrome image multiplied by c.
+func shadePalette(c color.NRGBA) color.Palette {
+	p := make(color.Palette, 0, 256)
+	for i := 0; i < 255; i++ {
+		v := uint8(i * 255 / 254)
+		p = append(p, color.NRGBA{multiply(c.R, v), multiply(c.G, v), multiply(c.B, v), 0xff})
+	}
+	return append(p, color.Transparent)
+}
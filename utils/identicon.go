@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"image"
+	"image/color"
+
+	"ImageServer/storage"
+
+	"golang.org/x/image/draw"
+)
+
+// identiconGrid is the number of cells per side. The left half is mirrored
+// onto the right so the pattern is symmetric.
+const identiconGrid = 5
+
+// Identicon renders a size x size symmetric pattern derived from seed. The
+// same seed always produces the same image.
+func Identicon(seed string, size int) image.Image {
+	sum := sha256.Sum256([]byte(seed))
+
+	fg := color.NRGBA{R: sum[0], G: sum[1], B: sum[2], A: 255}
+	bg := color.NRGBA{R: 240, G: 240, B: 240, A: 255}
+
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+
+	// Half a cell of margin on every side
+	cell := size / (identiconGrid + 1)
+	offset := (size - cell*identiconGrid) / 2
+	half := (identiconGrid + 1) / 2
+
+	for y := 0; y < identiconGrid; y++ {
+		for x := 0; x < half; x++ {
+			// One bit of the hash per cell, skipping the color bytes
+			bit := y*half + x
+			if sum[3+bit/8]>>(bit%8)&1 == 0 {
+				continue
+			}
+			for _, col := range []int{x, identiconGrid - 1 - x} {
+				rect := image.Rect(col*cell, y*cell, (col+1)*cell, (y+1)*cell).Add(image.Pt(offset, offset))
+				draw.Draw(img, rect, image.NewUniform(fg), image.Point{}, draw.Src)
+			}
+		}
+	}
+
+	return img
+}
+
+// SaveIdenticon renders the identicon for seed and stores it as name in s,
+// in the format given by ext.
+func SaveIdenticon(s storage.Storage, name, seed string, size int, ext string, opts EncodeOptions) error {
+	return save(context.Background(), s, name, Identicon(seed, size), ext, opts)
+}
@@ -1,18 +1,162 @@
 package utils
 
 import (
-	"ImageServer/config"
+	"ImageServer/metrics"
+	"ImageServer/models"
+	"ImageServer/storage"
+	"bytes"
+	"context"
+	"errors"
 	"image"
+	"image/gif"
 	"image/jpeg"
 	"image/png"
-	"log"
-	"os"
-	"path/filepath"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/HugoSmits86/nativewebp"
 	"golang.org/x/image/draw"
 )
 
+// ErrEncoderUnavailable is returned when no encoder is registered for the
+// requested output format.
+var ErrEncoderUnavailable = errors.New("no encoder available for format")
+
+// DefaultQuality is the JPEG quality used when none is requested.
+const DefaultQuality = 85
+
+// EncodeOptions tunes how generated images are encoded.
+type EncodeOptions struct {
+	// Quality is the lossy encoding quality from 1 to 100.
+	Quality int
+	// Progressive writes JPEG as progressive scans; other formats ignore it.
+	Progressive bool
+}
+
+type encoderFunc func(w io.Writer, img image.Image, opts EncodeOptions) error
+
+func encodePNG(w io.Writer, img image.Image, opts EncodeOptions) error {
+	return png.Encode(w, img)
+}
+
+func encodeJPEG(w io.Writer, img image.Image, opts EncodeOptions) error {
+	quality := opts.Quality
+	if quality == 0 {
+		quality = DefaultQuality
+	}
+	if opts.Progressive {
+		data, err := ProgressiveJPEG(img, quality)
+		if err == nil {
+			_, err = w.Write(data)
+			return err
+		}
+		slog.Warn("Progressive JPEG encoding failed, writing baseline", "error", err)
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+}
+
+// encodeWebP writes lossless WebP; the quality option does not apply.
+func encodeWebP(w io.Writer, img image.Image, opts EncodeOptions) error {
+	return nativewebp.Encode(w, img, nil)
+}
+
+// encoders maps an output extension to its encoder. AVIF originals are
+// stored and served as they are, but there is no pure Go AVIF encoder, so
+// AVIF is not an output format; requests for it get 415.
+var encoders = map[string]encoderFunc{
+	"png":  encodePNG,
+	"jpg":  encodeJPEG,
+	"jpeg": encodeJPEG,
+	"gif":  encodeGIF,
+	"webp": encodeWebP,
+}
+
+// ConvertToPNG decodes an image in any registered format and encodes it as
+// PNG. Only the first frame of animated images is kept.
+func ConvertToPNG(data []byte) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// CanEncode reports whether images can be written in the given format.
+func CanEncode(ext string) bool {
+	_, ok := encoders[ext]
+	return ok
+}
+
+// OutputFormats returns the formats images can be written in, sorted.
+func OutputFormats() []string {
+	formats := make([]string, 0, len(encoders))
+	for ext := range encoders {
+		formats = append(formats, ext)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+var contentTypes = map[string]string{
+	"png":  "image/png",
+	"jpg":  "image/jpeg",
+	"jpeg": "image/jpeg",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+	"svg":  "image/svg+xml",
+	"avif": "image/avif",
+}
+
+// ExtensionFor returns the extension images of the given MIME type are
+// stored under, or "" when it is not an image type the server knows.
+// Parameters such as charset are ignored.
+func ExtensionFor(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	if mediaType == "image/jpeg" {
+		return "jpg"
+	}
+	for ext, ct := range contentTypes {
+		if ct == mediaType {
+			return ext
+		}
+	}
+	return ""
+}
+
+// ContentType returns the MIME type of an image file, sniffing the first 512
+// bytes when the extension is missing or unknown.
+func ContentType(fsys fs.FS, name string) string {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+	if contentType, ok := contentTypes[ext]; ok {
+		return contentType
+	}
+
+	file, err := fsys.Open(name)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer file.Close()
+
+	buffer := make([]byte, 512)
+	n, _ := io.ReadFull(file, buffer)
+	return http.DetectContentType(buffer[:n])
+}
+
 func ContainsDotFile(name string) bool {
 	parts := strings.Split(name, "/")
 	for _, part := range parts {
@@ -23,106 +167,230 @@ func ContainsDotFile(name string) bool {
 	return false
 }
 
-func FindImage(filePath string) (*os.File, error) {
-	file, err := os.Open(filePath)
+// FindExtensions are the extensions FindImage appends, in order, when name
+// itself does not exist. Set from FIND_EXTENSIONS at startup.
+var FindExtensions = models.ExtSlice{"png", "jpg", "webp", "jpeg", "gif", "avif"}
+
+// FindImage opens the file FindImageName resolves name to.
+func FindImage(fsys fs.FS, name string) (fs.File, error) {
+	found, err := FindImageName(fsys, name)
 	if err != nil {
-		file, err = os.Open(filePath + ".png")
+		return nil, err
+	}
+	return fsys.Open(found)
+}
+
+// FindImageName returns name if it exists, or else name with the other
+// spelling of its extension, or else the first of name plus one of
+// FindExtensions that exists, or else name without its extension.
+func FindImageName(fsys fs.FS, name string) (string, error) {
+	_, err := fs.Stat(fsys, name)
+	if err == nil {
+		return name, nil
+	}
+
+	if alias := aliasName(name); alias != "" {
+		if _, err := fs.Stat(fsys, alias); err == nil {
+			return alias, nil
+		}
+	}
+
+	for _, ext := range FindExtensions {
+		if _, err := fs.Stat(fsys, name+"."+ext); err == nil {
+			return name + "." + ext, nil
+		}
+	}
+
+	nameNoExt := name[:len(name)-len(path.Ext(name))]
+	if nameNoExt == name {
+		return "", err
+	}
+	if _, err := fs.Stat(fsys, nameNoExt); err != nil {
+		return "", err
+	}
+	return nameNoExt, nil
+}
+
+// aliasName returns name with the other spelling of its extension, such as
+// a.jpg for a.jpeg, or "" when the extension has none.
+func aliasName(name string) string {
+	ext := path.Ext(name)
+	alias := models.ExtAlias(strings.TrimPrefix(ext, "."))
+	if alias == "" {
+		return ""
+	}
+	return strings.TrimSuffix(name, ext) + "." + alias
+}
+
+// ResolveAlias returns name, or name with the other spelling of its
+// extension when only that file exists, so a.jpeg and a.jpg find the same
+// image.
+func ResolveAlias(fsys fs.StatFS, name string) string {
+	alias := aliasName(name)
+	if alias == "" {
+		return name
+	}
+	if _, err := fsys.Stat(name); errors.Is(err, fs.ErrNotExist) {
+		if _, err := fsys.Stat(alias); err == nil {
+			return alias
+		}
+	}
+	return name
+}
+
+// ReadImage loads the image name from src, applies a variant if specified
+// and caches the result in cache at variantName encoded as ext. Decoded
+// originals are reused from decoded when possible. Generation stops with
+// ctx's error once ctx is done, and a partly written variant is discarded.
+func ReadImage(ctx context.Context, src fs.FS, decoded *DecodedCache, name string, variant Variant, ext string, cache storage.Storage, variantName string, opts EncodeOptions) (image.Image, error) {
+	// 2. Load original image (with the FindImage fallback extensions)
+	log := slog.With("path", name, "variant", variant.Key())
+
+	start := time.Now()
+	defer func() {
+		metrics.VariantGeneration.Observe(time.Since(start).Seconds())
+	}()
+
+	// Animated GIFs keep all their frames when the output is a GIF too
+	if ext == "gif" {
+		anim, err := loadAnimation(ctx, src, name)
 		if err != nil {
-			file, err = os.Open(filePath + ".jpg")
+			log.Warn("Error loading animation", "error", err)
+			return nil, err
+		}
+		if anim != nil {
+			anim, err = ApplyVariantAll(ctx, anim, variant)
 			if err != nil {
-				file, err = os.Open(filePath + ".webp")
-				if err != nil {
-					file, err = os.Open(filePath + ".jpeg")
-					if err != nil {
-						filePathNoExt := filePath[:len(filePath)-len(filepath.Ext(filePath))]
-						file, err = os.Open(filePathNoExt)
-						if err != nil {
-							return nil, err
-						}
-					}
-				}
+				return nil, err
+			}
+			if err := writeFile(ctx, cache, variantName, func(w io.Writer) error { return gif.EncodeAll(w, anim) }); err != nil {
+				log.Error("Error saving variant", "file", variantName, "error", err)
+				return nil, err
 			}
+			return anim.Image[0], nil
 		}
 	}
 
-	return file, nil
-}
-
-// ReadImage loads an image from disk and applies a variant if specified.
-// If the variant already exists, it is returned directly (cached).
-func ReadImage(filePath, variant, ext, variantPath string) (image.Image, error) {
-	// 2. Load original image (with FindImage fallback: .png, .jpg, .webp, .jpeg)
-	img, err := loadImage(filePath)
+	img, err := loadCachedImage(ctx, src, decoded, name)
 	if err != nil {
-		println(err.Error())
+		log.Warn("Error loading image", "error", err)
 		return nil, err
 	}
 
 	if img == nil {
-		println("Image not found: " + filePath)
+		log.Debug("Image not found")
 		return nil, nil
 	}
 
-	// 3. Apply variant and cache if requested
-	if variant != "" {
-		img = ApplyVariant(img, variant)
+	// 3. Apply variant and cache the result in the requested format
+	img, err = ApplyVariant(ctx, img, variant)
+	if err != nil {
+		return nil, err
+	}
 
-		if err := save(variantPath, img, ext); err != nil {
-			println(err.Error())
-			return nil, err
-		}
+	if err := save(ctx, cache, variantName, img, ext, opts); err != nil {
+		log.Error("Error saving variant", "file", variantName, "error", err)
+		return nil, err
 	}
 
 	return img, nil
 }
 
 // loadImage uses FindImage to open a file and decode it.
-func loadImage(path string) (image.Image, error) {
-	file, err := FindImage(path)
+func loadImage(fsys fs.FS, name string) (image.Image, error) {
+	return loadCachedImage(context.Background(), fsys, nil, name)
+}
+
+// loadCachedImage is loadImage returning the decoded image from decoded
+// when the file has not changed since it was cached. Decoding stops once ctx
+// is done.
+func loadCachedImage(ctx context.Context, fsys fs.FS, decoded *DecodedCache, name string) (image.Image, error) {
+	file, err := FindImage(fsys, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.Debug("Image not found", "path", name)
+		return nil, nil
+	}
 	if err != nil {
-		println(err.Error())
+		slog.Debug("Error finding image", "path", name, "error", err)
 		return nil, err
 	}
 	defer file.Close()
 
 	if file == nil {
-		println("File not found: " + path)
+		slog.Debug("File not found", "path", name)
 		return nil, nil
 	}
 
-	img, _, err := image.Decode(file)
+	var key decodedKey
+	if decoded != nil {
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		key = decodedKey{name: name, modTime: info.ModTime(), size: info.Size()}
+		if img := decoded.get(key); img != nil {
+			return img, nil
+		}
+	}
 
+	rs, err := storage.ReadSeeker(file)
 	if err != nil {
-		println(err.Error())
 		return nil, err
 	}
 
+	if err := CheckPixels(rs); err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(ctxReader{ctx, rs})
+	if err != nil && ctx.Err() != nil {
+		// Format sniffing reports a failed read as an unknown format
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		slog.Warn("Error decoding image", "path", name, "error", err)
+		return nil, err
+	}
+
+	// Files stored before uploads were normalized may still carry an EXIF
+	// orientation that variants need to honor
+	if _, err := rs.Seek(0, io.SeekStart); err == nil {
+		img = Orient(img, Orientation(rs))
+	}
+
+	decoded.add(key, img)
 	return img, nil
 }
 
-// save saves an image as PNG.
-func save(path string, img image.Image, ext string) error {
-	f, err := os.Create(path)
-	if err != nil {
-		return err
+// save encodes an image in the format given by ext. Nothing is stored when
+// the format has no encoder, encoding fails or ctx is done first.
+func save(ctx context.Context, s storage.Storage, name string, img image.Image, ext string, opts EncodeOptions) error {
+	encode, ok := encoders[ext]
+	if !ok {
+		return ErrEncoderUnavailable
 	}
-	defer f.Close()
 
-	println("Save image: " + path)
+	return writeFile(ctx, s, name, func(w io.Writer) error { return encode(w, img, opts) })
+}
+
+// writeFile creates name and fills it with encode. Storage only publishes
+// the file once it is complete, so readers never see a partial image, and
+// nothing is published if encoding fails or ctx is done before it finishes.
+func writeFile(ctx context.Context, s storage.Storage, name string, encode func(w io.Writer) error) error {
+	slog.Debug("Save image", "path", name)
 
-	switch ext {
-	case "png":
-		return png.Encode(f, img)
-	case "jpg", "jpeg":
-		return jpeg.Encode(f, img, nil)
-	// case ".webp":
-	// 	return webp.Encode(f, img, nil)
-	default:
-		return nil
+	w, err := s.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := encode(ctxWriter{ctx, w}); err != nil {
+		w.Abort()
+		return err
 	}
+	return w.Close()
 }
 
-func Scale(img image.Image, size int) image.Image {
+func Scale(img image.Image, size int, interp draw.Interpolator) image.Image {
 	bounds := img.Bounds()
 	srcW := bounds.Dx()
 	srcH := bounds.Dy()
@@ -137,62 +405,183 @@ func Scale(img image.Image, size int) image.Image {
 	}
 
 	dst := image.NewRGBA(image.Rect(0, 0, newW, newH))
-	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+	resample(dst, img, interp)
 
 	return dst
 }
 
-func ApplyVariant(img image.Image, variant string) image.Image {
-	switch variant {
+// resample scales src to fill dst.
+func resample(dst *image.RGBA, src image.Image, interp draw.Interpolator) {
+	interp.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+}
+
+// ApplyVariant transforms img as variant describes. ctx is checked between
+// steps, so a cancelled generation stops before starting the next one.
+func ApplyVariant(ctx context.Context, img image.Image, variant Variant) (image.Image, error) {
+	var steps []func(image.Image) image.Image
+
+	if variant.Rotate != 0 {
+		steps = append(steps, func(img image.Image) image.Image { return Rotate(img, variant.Rotate) })
+	}
+
+	if variant.Flip != "" {
+		steps = append(steps, func(img image.Image) image.Image { return Flip(img, variant.Flip) })
+	}
+
+	switch variant.Name {
 	case "preview":
-		return Preview(img)
-	default:
-		return img
+		steps = append(steps, func(img image.Image) image.Image { return Preview(img, variant.interpolator()) })
+	case "crop":
+		steps = append(steps, func(img image.Image) image.Image {
+			return Crop(img, variant.Width, variant.Height, variant.Gravity, variant.interpolator())
+		})
+	case "resize":
+		steps = append(steps, func(img image.Image) image.Image {
+			return Resize(img, variant.Width, variant.Height, variant.interpolator())
+		})
+	}
+
+	if variant.Grayscale {
+		steps = append(steps, Grayscale)
+	}
+
+	if variant.Tint.A != 0 {
+		steps = append(steps, func(img image.Image) image.Image { return Tint(img, variant.Tint) })
+	}
+
+	if variant.BlurRadius > 0 {
+		steps = append(steps, func(img image.Image) image.Image { return Blur(img, variant.BlurRadius) })
+	}
+
+	if variant.Watermark != nil {
+		steps = append(steps, func(img image.Image) image.Image {
+			return ApplyWatermark(img, variant.Watermark, variant.WatermarkPosition, variant.WatermarkOpacity)
+		})
 	}
+
+	for _, step := range steps {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		img = step(img)
+	}
+	return img, nil
 }
 
-func Preview(img image.Image) image.Image {
+func Preview(img image.Image, interp draw.Interpolator) image.Image {
 	// Preview does not exist, scale and write to disk
-	previewImage := Scale(img, 256)
+	previewImage := Scale(img, 256, interp)
 
 	return previewImage
 }
 
-func FixAllFiles(cfg *config.Config) {
-	baseDir, err := filepath.Abs(cfg.Path)
+// sniffedExtensions maps the content types http.DetectContentType reports
+// for images to the extension they are stored under.
+var sniffedExtensions = map[string]string{
+	"image/png":  "png",
+	"image/jpeg": "jpg",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+}
+
+// SniffExtension returns the extension matching the content of file, or ""
+// when it is not a recognized image. http.DetectContentType covers the
+// common raster formats; registered image decoders, the AVIF file type box
+// and an <svg> root catch the rest. name is resolved with FindImage.
+func SniffExtension(fsys fs.FS, name string) (string, error) {
+	f, err := FindImage(fsys, name)
 	if err != nil {
-		log.Fatalf("Error getting absolute path: %v", err)
+		return "", err
+	}
+	defer f.Close()
+
+	file, err := storage.ReadSeeker(f)
+	if err != nil {
+		return "", err
+	}
+
+	buffer := make([]byte, 512)
+	n, err := io.ReadFull(file, buffer)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	buffer = buffer[:n]
+
+	if ext, ok := sniffedExtensions[http.DetectContentType(buffer)]; ok {
+		return ext, nil
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if _, format, err := image.DecodeConfig(file); err == nil && models.SupportedTypes.Has(format) {
+		return format, nil
 	}
 
-	err = filepath.Walk(baseDir, func(path string, info os.FileInfo, err error) error {
+	if isAVIF(buffer) {
+		return "avif", nil
+	}
+
+	if bytes.Contains(bytes.ToLower(buffer), []byte("<svg")) {
+		return "svg", nil
+	}
+
+	return "", nil
+}
+
+// isAVIF reports whether head starts an ISO media file whose ftyp box names
+// the avif or avis (image sequence) brand.
+func isAVIF(head []byte) bool {
+	if len(head) < 12 || string(head[4:8]) != "ftyp" {
+		return false
+	}
+	brand := string(head[8:12])
+	return brand == "avif" || brand == "avis"
+}
+
+// FixAllFiles gives extension-less files in s the extension of their actual
+// format so they can be served and decoded. Files that are not recognized as
+// images, or whose new name is already taken, are left alone. The renamed
+// files are returned with paths relative to the storage root.
+func FixAllFiles(s storage.Storage) ([]models.RenamedFile, error) {
+	renamed := []models.RenamedFile{}
+	err := fs.WalkDir(s, ".", func(name string, d fs.DirEntry, err error) error {
 		if err != nil {
+			// Nothing to fix before the data directory is created
+			if name == "." && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
 			return err
 		}
-		if info.IsDir() {
+		if d.IsDir() || path.Ext(name) != "" {
 			return nil
 		}
-		// Read image file
-		ext := filepath.Ext(path)
-		file, err := os.Open(path)
+
+		ext, err := SniffExtension(s, name)
 		if err != nil {
 			return err
 		}
-		defer file.Close()
-		
-		if (ext == ""){
-			// Rename to .png
-			newPath := path + ".png"
-			if err := os.Rename(path, newPath); err != nil {
-				return err
-			}
-			println("Renamed to .png: " + path)
+		if ext == "" {
+			slog.Debug("Unrecognized file left as is", "path", name)
+			return nil
+		}
+
+		newName := name + "." + ext
+		if _, err := s.Stat(newName); err == nil {
+			slog.Warn("Not renaming, target exists", "path", name, "target", newName)
+			return nil
 		}
-		
-		
+		if err := storage.Rename(s, name, newName); err != nil {
+			return err
+		}
+		slog.Info("Renamed file", "path", name, "target", newName)
+
+		renamed = append(renamed, models.RenamedFile{
+			From: "/" + name,
+			To:   "/" + newName,
+		})
 		return nil
 	})
 
-	if err != nil {
-		log.Fatalf("Error walking path: %v", err)
-	}
+	return renamed, err
 }
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"io/fs"
+	"path"
+	"testing"
+	"testing/fstest"
+
+	"ImageServer/storage"
+)
+
+func TestSave(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	errEncode := errors.New("encode failed")
+
+	tests := []struct {
+		name string
+		save func(ctx context.Context, s storage.Storage) error
+		err  error
+	}{
+		{"png", func(ctx context.Context, s storage.Storage) error {
+			return save(ctx, s, "out.png", img, "png", EncodeOptions{})
+		}, nil},
+		{"unavailable encoder", func(ctx context.Context, s storage.Storage) error {
+			return save(ctx, s, "out.avif", img, "avif", EncodeOptions{})
+		}, ErrEncoderUnavailable},
+		{"failed encode", func(ctx context.Context, s storage.Storage) error {
+			return writeFile(ctx, s, "out.png", func(w io.Writer) error {
+				io.WriteString(w, "partial")
+				return errEncode
+			})
+		}, errEncode},
+		{"canceled", func(ctx context.Context, s storage.Storage) error {
+			ctx, cancel := context.WithCancel(ctx)
+			cancel()
+			return save(ctx, s, "out.png", img, "png", EncodeOptions{})
+		}, context.Canceled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := storage.NewMemory()
+
+			err := tt.save(context.Background(), s)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error = %v, want %v", err, tt.err)
+			}
+
+			names, _ := fs.Glob(s, "out.*")
+			if tt.err != nil {
+				if len(names) != 0 {
+					t.Errorf("failed save left %v", names)
+				}
+				return
+			}
+			f, err := s.Open("out.png")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if _, err := png.Decode(f); err != nil {
+				t.Errorf("saved file does not decode: %v", err)
+			}
+		})
+	}
+}
+
+func TestReadImageCanceled(t *testing.T) {
+	frame := image.NewPaletted(image.Rect(0, 0, 8, 8), color.Palette{color.Black, color.White})
+	var pngData, gifData bytes.Buffer
+	png.Encode(&pngData, frame)
+	gif.EncodeAll(&gifData, &gif.GIF{Image: []*image.Paletted{frame, frame}, Delay: []int{1, 1}})
+	src := fstest.MapFS{
+		"a.png": {Data: pngData.Bytes()},
+		"b.gif": {Data: gifData.Bytes()},
+	}
+
+	for _, name := range []string{"a.png", "b.gif"} {
+		t.Run(name, func(t *testing.T) {
+			cache := storage.NewMemory()
+			ext := path.Ext(name)[1:]
+			variantName := name + "/v." + ext
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := ReadImage(ctx, src, nil, name, Variant{}, ext, cache, variantName, EncodeOptions{})
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("error = %v, want context.Canceled", err)
+			}
+			if _, err := fs.Stat(cache, variantName); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Stat(variant) = %v, want fs.ErrNotExist", err)
+			}
+		})
+	}
+}
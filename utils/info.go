@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"errors"
+	"image"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"ImageServer/models"
+
+	_ "golang.org/x/image/webp"
+)
+
+// Dimensions reads the width and height from the image header without
+// decoding the pixel data.
+func Dimensions(fsys fs.FS, name string) (int, int, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	cfg, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// VerifyImage checks that a stored file can be read as the format its
+// extension claims. Only the header is decoded unless full is set, which
+// also catches files truncated after the header. SVG files are parsed as
+// XML and AVIF files, which have no decoder, only need their file type box.
+func VerifyImage(fsys fs.FS, name string, full bool) error {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+	if ext == "svg" {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		_, err = SanitizeSVG(data)
+		return err
+	}
+
+	file, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if ext == "avif" {
+		head := make([]byte, 12)
+		if _, err := io.ReadFull(file, head); err != nil || !isAVIF(head) {
+			return ErrFormatMismatch
+		}
+		return nil
+	}
+
+	if full {
+		_, _, err = image.Decode(file)
+	} else {
+		_, _, err = image.DecodeConfig(file)
+	}
+	return err
+}
+
+// ErrFormatMismatch is returned by ValidateImage when the content is a
+// different format than the one declared.
+var ErrFormatMismatch = errors.New("content does not match the declared format")
+
+// ValidateImage decodes all of r to make sure it is a readable image of the
+// declared format and not just a plausible header. Only the first frame of
+// a GIF is decoded. AVIF has no decoder, so only its file type box is
+// checked; SVG is checked by SanitizeSVG and passes.
+func ValidateImage(r io.Reader, format string) error {
+	if format == "svg" {
+		return nil
+	}
+	if format == "avif" {
+		head := make([]byte, 12)
+		if _, err := io.ReadFull(r, head); err != nil || !isAVIF(head) {
+			return ErrFormatMismatch
+		}
+		return nil
+	}
+
+	_, decoded, err := image.Decode(r)
+	if err != nil {
+		return err
+	}
+	if models.CanonicalExt(decoded) != models.CanonicalExt(format) {
+		return ErrFormatMismatch
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestValidateImage(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	encode := func(enc func(*bytes.Buffer) error) []byte {
+		var buf bytes.Buffer
+		if err := enc(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	pngData := encode(func(b *bytes.Buffer) error { return png.Encode(b, img) })
+	jpegData := encode(func(b *bytes.Buffer) error { return jpeg.Encode(b, img, nil) })
+	gifData := encode(func(b *bytes.Buffer) error { return gif.Encode(b, img, nil) })
+	ftyp := func(brand string) []byte {
+		return append([]byte("\x00\x00\x00\x1cftyp"+brand+"\x00\x00\x00\x00mif1"), make([]byte, 16)...)
+	}
+
+	tests := []struct {
+		name   string
+		data   []byte
+		format string
+		// wantErr is nil, ErrFormatMismatch, or errAny for any other error
+		wantErr error
+	}{
+		{name: "png", data: pngData, format: "png"},
+		{name: "jpg", data: jpegData, format: "jpg"},
+		{name: "jpeg alias", data: jpegData, format: "jpeg"},
+		{name: "gif", data: gifData, format: "gif"},
+		{name: "png declared as jpg", data: pngData, format: "jpg", wantErr: ErrFormatMismatch},
+		{name: "jpeg declared as gif", data: jpegData, format: "gif", wantErr: ErrFormatMismatch},
+		{name: "truncated png", data: pngData[:len(pngData)/2], format: "png", wantErr: errAny},
+		{name: "garbage png", data: []byte("not an image"), format: "png", wantErr: errAny},
+		{name: "avif", data: ftyp("avif"), format: "avif"},
+		{name: "avif sequence", data: ftyp("avis"), format: "avif"},
+		{name: "heic declared as avif", data: ftyp("heic"), format: "avif", wantErr: ErrFormatMismatch},
+		{name: "garbage avif", data: []byte("<script>alert(1)</script>"), format: "avif", wantErr: ErrFormatMismatch},
+		{name: "png declared as avif", data: pngData, format: "avif", wantErr: ErrFormatMismatch},
+		{name: "short avif", data: []byte("ftyp"), format: "avif", wantErr: ErrFormatMismatch},
+		{name: "svg", data: []byte("<svg/>"), format: "svg"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateImage(bytes.NewReader(tt.data), tt.format)
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Errorf("error = %v, want nil", err)
+			case tt.wantErr == errAny && (err == nil || errors.Is(err, ErrFormatMismatch)):
+				t.Errorf("error = %v, want a decoding error", err)
+			case tt.wantErr == ErrFormatMismatch && !errors.Is(err, ErrFormatMismatch):
+				t.Errorf("error = %v, want ErrFormatMismatch", err)
+			}
+		})
+	}
+}
+
+// errAny stands for any error in test tables.
+var errAny = errors.New("any error")
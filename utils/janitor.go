@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"ImageServer/metrics"
+	"ImageServer/storage"
+)
+
+// CacheJanitor keeps the variant cache within a size budget by removing the
+// least recently used files first. Use is recorded in memory by Touch; files
+// not used since startup count as used when they were written, so a restart
+// only forgets recency. A nil *CacheJanitor does nothing.
+//
+// Only the cache it is given is ever swept, so originals are never eligible.
+type CacheJanitor struct {
+	cache    storage.Storage
+	maxBytes int64
+
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+// NewCacheJanitor returns a janitor keeping cache within maxBytes, or nil
+// when maxBytes is not positive.
+func NewCacheJanitor(cache storage.Storage, maxBytes int64) *CacheJanitor {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &CacheJanitor{
+		cache:    cache,
+		maxBytes: maxBytes,
+		used:     map[string]time.Time{},
+	}
+}
+
+// Touch records that the cached file name was just used.
+func (j *CacheJanitor) Touch(name string) {
+	if j == nil {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.used[name] = time.Now()
+}
+
+// Run sweeps the cache at once and then every interval until ctx is done.
+func (j *CacheJanitor) Run(ctx context.Context, interval time.Duration) {
+	if j == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		removed, freed, err := j.Sweep()
+		if err != nil {
+			slog.Error("Error sweeping cache", "error", err)
+		} else if removed > 0 {
+			slog.Info("Evicted cached variants", "files", removed, "bytes", freed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// cachedFile is one file found by a sweep.
+type cachedFile struct {
+	name string
+	size int64
+	used time.Time
+}
+
+// Sweep removes the least recently used files until the cache fits its
+// budget, returning how many files and bytes were removed. Temporary files
+// of variants still being written are left alone.
+func (j *CacheJanitor) Sweep() (int, int64, error) {
+	var files []cachedFile
+	var total int64
+
+	err := fs.WalkDir(j.cache, ".", func(name string, d fs.DirEntry, err error) error {
+		// Purges may remove files and directories while the walk runs
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, cachedFile{name: name, size: info.Size(), used: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	j.mu.Lock()
+	seen := make(map[string]bool, len(files))
+	for i, file := range files {
+		seen[file.name] = true
+		if used, ok := j.used[file.name]; ok && used.After(file.used) {
+			files[i].used = used
+		}
+	}
+	// Forget files removed by purges so the index does not grow forever
+	for name := range j.used {
+		if !seen[name] {
+			delete(j.used, name)
+		}
+	}
+	j.mu.Unlock()
+
+	if total <= j.maxBytes {
+		return 0, 0, nil
+	}
+
+	sort.Slice(files, func(a, b int) bool { return files[a].used.Before(files[b].used) })
+
+	var removed int
+	var freed int64
+	for _, file := range files {
+		if total-freed <= j.maxBytes {
+			break
+		}
+		if err := j.cache.Remove(file.name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return removed, freed, err
+		}
+		removed++
+		freed += file.size
+
+		j.mu.Lock()
+		delete(j.used, file.name)
+		j.mu.Unlock()
+	}
+
+	metrics.CacheEvictions.Add(float64(removed))
+	return removed, freed, nil
+}
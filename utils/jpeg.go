@@ -0,0 +1,449 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"math"
+)
+
+// The standard library only writes baseline JPEG. Progressive files are
+// written here with the same quantization and Huffman tables (section K of
+// ITU T.81) and 4:2:0 chroma subsampling, split into spectral selection
+// scans: the DC coefficients of every component first, which is enough for
+// a browser to paint a blurry preview, then the AC bands from low to high
+// frequency.
+
+// unscaledQuant are the luminance and chrominance quantization tables in
+// zig-zag order, scaled by quality before use.
+var unscaledQuant = [2][64]byte{
+	{
+		16, 11, 12, 14, 12, 10, 16, 14,
+		13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37,
+		29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68,
+		87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113,
+		121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	{
+		17, 18, 18, 24, 21, 24, 47, 26,
+		26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// unzig maps a zig-zag index to the natural index within a block.
+var unzig = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// huffmanSpec lists how many codes there are of each length from 1 to 16
+// bits and the values they encode.
+type huffmanSpec struct {
+	count [16]byte
+	value []byte
+}
+
+// huffmanSpecs are the luminance DC and AC, then chrominance DC and AC
+// tables. The AC tables include the EOB (0x00) and ZRL (0xf0) symbols but
+// no longer end-of-band runs, so every block ends its own band.
+var huffmanSpecs = [4]huffmanSpec{
+	{
+		[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	{
+		[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+// huffmanCodes holds, for each table and value, the code length in the top
+// 8 bits and the code in the low 24.
+var huffmanCodes = func() (codes [4][256]uint32) {
+	for t, spec := range huffmanSpecs {
+		code, k := uint32(0), 0
+		for i, n := range spec.count {
+			for j := byte(0); j < n; j++ {
+				codes[t][spec.value[k]] = uint32(i+1)<<24 | code
+				code++
+				k++
+			}
+			code <<= 1
+		}
+	}
+	return codes
+}()
+
+// dctCos[x][u] is the scaled cosine term of the 8-point forward DCT.
+var dctCos = func() (c [8][8]float64) {
+	for x := range 8 {
+		for u := range 8 {
+			scale := 0.5
+			if u == 0 {
+				scale = 0.5 / math.Sqrt2
+			}
+			c[x][u] = scale * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+		}
+	}
+	return c
+}()
+
+// jpegComponent is one color channel, quantized and in zig-zag order.
+// Blocks cover whole MCUs, so there may be more than the image needs.
+type jpegComponent struct {
+	id       byte
+	sampling int
+	table    int
+	wide     int
+	high     int
+	blocks   [][64]int32
+}
+
+type jpegWriter struct {
+	buf   bytes.Buffer
+	bits  uint32
+	nBits uint32
+}
+
+// emit writes the low nBits of bits, stuffing a zero after 0xff bytes.
+func (e *jpegWriter) emit(bits, nBits uint32) {
+	nBits += e.nBits
+	bits <<= 32 - nBits
+	bits |= e.bits
+	for nBits >= 8 {
+		b := byte(bits >> 24)
+		e.buf.WriteByte(b)
+		if b == 0xff {
+			e.buf.WriteByte(0)
+		}
+		bits <<= 8
+		nBits -= 8
+	}
+	e.bits, e.nBits = bits, nBits
+}
+
+func (e *jpegWriter) emitHuff(table int, value byte) {
+	code := huffmanCodes[table][value]
+	e.emit(code&(1<<24-1), code>>24)
+}
+
+// emitValue writes the symbol for run zeros followed by value, then the
+// value's bits.
+func (e *jpegWriter) emitValue(table int, run, value int32) {
+	a, b := value, value
+	if a < 0 {
+		a, b = -value, value-1
+	}
+	nBits := uint32(0)
+	for a > 0 {
+		nBits++
+		a >>= 1
+	}
+	e.emitHuff(table, byte(run<<4)|byte(nBits))
+	if nBits > 0 {
+		e.emit(uint32(b)&(1<<nBits-1), nBits)
+	}
+}
+
+// pad fills the last byte of a scan with ones.
+func (e *jpegWriter) pad() {
+	if e.nBits > 0 {
+		e.emit(0x7f, 7)
+	}
+	e.bits, e.nBits = 0, 0
+}
+
+func (e *jpegWriter) marker(marker byte, data ...byte) {
+	e.buf.Write([]byte{0xff, marker, byte((len(data) + 2) >> 8), byte(len(data) + 2)})
+	e.buf.Write(data)
+}
+
+// ProgressiveJPEG encodes img as a progressive JPEG of the given quality.
+// Grayscale images are written with a single component.
+func ProgressiveJPEG(img image.Image, quality int) ([]byte, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < 1 || height < 1 || width >= 1<<16 || height >= 1<<16 {
+		return nil, errors.New("jpeg: invalid image size")
+	}
+
+	quality = min(max(quality, 1), 100)
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	var quant [2][64]byte
+	for i := range quant {
+		for j, q := range unscaledQuant[i] {
+			quant[i][j] = byte(min(max((int(q)*scale+50)/100, 1), 255))
+		}
+	}
+
+	_, gray := img.(*image.Gray)
+	comps := jpegComponents(img, gray, &quant)
+
+	var e jpegWriter
+	e.buf.Write([]byte{0xff, 0xd8})
+
+	tables := 2
+	if gray {
+		tables = 1
+	}
+	var dqt []byte
+	for i := range tables {
+		dqt = append(dqt, byte(i))
+		dqt = append(dqt, quant[i][:]...)
+	}
+	e.marker(0xdb, dqt...)
+
+	sof := []byte{8, byte(height >> 8), byte(height), byte(width >> 8), byte(width), byte(len(comps))}
+	for _, comp := range comps {
+		sof = append(sof, comp.id, byte(comp.sampling<<4|comp.sampling), byte(comp.table))
+	}
+	e.marker(0xc2, sof...)
+
+	var dht []byte
+	for i, spec := range huffmanSpecs[:2*tables] {
+		dht = append(dht, "\x00\x10\x01\x11"[i])
+		dht = append(dht, spec.count[:]...)
+		dht = append(dht, spec.value...)
+	}
+	e.marker(0xc4, dht...)
+
+	// DC first, then the luminance band that carries most of the detail,
+	// the chrominance, and the remaining luminance
+	e.dcScan(comps, width, height)
+	e.acScan(comps[0], 1, 5, width, height)
+	for _, comp := range comps[1:] {
+		e.acScan(comp, 1, 63, (width+1)/2, (height+1)/2)
+	}
+	e.acScan(comps[0], 6, 63, width, height)
+
+	e.buf.Write([]byte{0xff, 0xd9})
+	return e.buf.Bytes(), nil
+}
+
+func (e *jpegWriter) sos(comps []*jpegComponent, start, end byte) {
+	data := []byte{byte(len(comps))}
+	for _, comp := range comps {
+		data = append(data, comp.id, byte(comp.table<<4|comp.table))
+	}
+	e.marker(0xda, append(data, start, end, 0)...)
+}
+
+// dcScan writes the DC coefficients of every component. With more than one
+// component the scan is interleaved and walks whole MCUs.
+func (e *jpegWriter) dcScan(comps []*jpegComponent, width, height int) {
+	e.sos(comps, 0, 0)
+
+	prev := make([]int32, len(comps))
+	mcu := 8 * comps[0].sampling
+	for my := 0; my < (height+mcu-1)/mcu; my++ {
+		for mx := 0; mx < (width+mcu-1)/mcu; mx++ {
+			for i, comp := range comps {
+				for by := range comp.sampling {
+					for bx := range comp.sampling {
+						block := &comp.blocks[(my*comp.sampling+by)*comp.wide+mx*comp.sampling+bx]
+						e.emitValue(2*comp.table, 0, block[0]-prev[i])
+						prev[i] = block[0]
+					}
+				}
+			}
+		}
+	}
+	e.pad()
+}
+
+// acScan writes the band from start to end of one component. Scans of a
+// single component only cover the blocks inside its width and height.
+func (e *jpegWriter) acScan(comp *jpegComponent, start, end, width, height int) {
+	e.sos([]*jpegComponent{comp}, byte(start), byte(end))
+
+	table := 2*comp.table + 1
+	for by := 0; by < (height+7)/8; by++ {
+		for bx := 0; bx < (width+7)/8; bx++ {
+			block := &comp.blocks[by*comp.wide+bx]
+			run := int32(0)
+			for k := start; k <= end; k++ {
+				if block[k] == 0 {
+					run++
+					continue
+				}
+				for run > 15 {
+					e.emitHuff(table, 0xf0)
+					run -= 16
+				}
+				e.emitValue(table, run, block[k])
+				run = 0
+			}
+			if run > 0 {
+				e.emitHuff(table, 0x00)
+			}
+		}
+	}
+	e.pad()
+}
+
+// jpegComponents converts img to quantized YCbCr blocks, or to luminance
+// only when gray is set. Edge pixels are repeated to fill partial blocks.
+func jpegComponents(img image.Image, gray bool, quant *[2][64]byte) []*jpegComponent {
+	bounds := img.Bounds()
+	mcu := 16
+	if gray {
+		mcu = 8
+	}
+	wide := (bounds.Dx() + mcu - 1) / mcu * mcu
+	high := (bounds.Dy() + mcu - 1) / mcu * mcu
+
+	planes := make([][]float64, 3)
+	for i := range planes {
+		planes[i] = make([]float64, wide*high)
+	}
+	rgba, _ := img.(*image.RGBA)
+	for y := range high {
+		sy := bounds.Min.Y + min(y, bounds.Dy()-1)
+		for x := range wide {
+			sx := bounds.Min.X + min(x, bounds.Dx()-1)
+			var r, g, b uint8
+			if rgba != nil {
+				pix := rgba.Pix[rgba.PixOffset(sx, sy):]
+				r, g, b = pix[0], pix[1], pix[2]
+			} else {
+				cr, cg, cb, _ := img.At(sx, sy).RGBA()
+				r, g, b = uint8(cr>>8), uint8(cg>>8), uint8(cb>>8)
+			}
+			yy, cb, cr := color.RGBToYCbCr(r, g, b)
+			planes[0][y*wide+x] = float64(yy)
+			planes[1][y*wide+x] = float64(cb)
+			planes[2][y*wide+x] = float64(cr)
+		}
+	}
+
+	if gray {
+		return []*jpegComponent{newJPEGComponent(1, 1, 0, planes[0], wide, high, &quant[0])}
+	}
+
+	// 4:2:0, each chroma sample averages a 2x2 square
+	for _, plane := range planes[1:] {
+		for y := 0; y < high/2; y++ {
+			for x := 0; x < wide/2; x++ {
+				i := 2*y*wide + 2*x
+				plane[y*wide/2+x] = (plane[i] + plane[i+1] + plane[i+wide] + plane[i+wide+1]) / 4
+			}
+		}
+	}
+	return []*jpegComponent{
+		newJPEGComponent(1, 2, 0, planes[0], wide, high, &quant[0]),
+		newJPEGComponent(2, 1, 1, planes[1][:wide*high/4], wide/2, high/2, &quant[1]),
+		newJPEGComponent(3, 1, 1, planes[2][:wide*high/4], wide/2, high/2, &quant[1]),
+	}
+}
+
+// newJPEGComponent transforms and quantizes a plane whose sides are
+// multiples of 8.
+func newJPEGComponent(id byte, sampling, table int, plane []float64, wide, high int, quant *[64]byte) *jpegComponent {
+	comp := &jpegComponent{
+		id:       id,
+		sampling: sampling,
+		table:    table,
+		wide:     wide / 8,
+		high:     high / 8,
+		blocks:   make([][64]int32, wide/8*high/8),
+	}
+
+	var rows [64]float64
+	for by := range comp.high {
+		for bx := range comp.wide {
+			// Rows first, then columns
+			for y := range 8 {
+				line := plane[(by*8+y)*wide+bx*8:]
+				for u := range 8 {
+					sum := 0.0
+					for x := range 8 {
+						sum += (line[x] - 128) * dctCos[x][u]
+					}
+					rows[y*8+u] = sum
+				}
+			}
+			block := &comp.blocks[by*comp.wide+bx]
+			for k, n := range unzig {
+				u, v := n%8, n/8
+				sum := 0.0
+				for y := range 8 {
+					sum += rows[y*8+u] * dctCos[y][v]
+				}
+				coef := math.Round(sum / float64(quant[k]))
+				block[k] = int32(min(max(coef, -1023), 1023))
+			}
+		}
+	}
+	return comp
+}
@@ -0,0 +1,231 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// testPattern returns an image with smooth gradients and hard edges, so
+// both low and high frequency coefficients are exercised.
+func testPattern(width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			c := color.NRGBA{
+				R: uint8(x * 255 / max(width-1, 1)),
+				G: uint8(y * 255 / max(height-1, 1)),
+				B: 128,
+				A: 255,
+			}
+			if (x/8+y/8)%2 == 0 {
+				c.B = 32
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// meanDiff returns the mean absolute difference per channel between two
+// images of the same size, on a 0-255 scale.
+func meanDiff(a, b image.Image) float64 {
+	ab, bb := a.Bounds(), b.Bounds()
+	var sum float64
+	for y := range ab.Dy() {
+		for x := range ab.Dx() {
+			r1, g1, b1, _ := a.At(ab.Min.X+x, ab.Min.Y+y).RGBA()
+			r2, g2, b2, _ := b.At(bb.Min.X+x, bb.Min.Y+y).RGBA()
+			for _, d := range []int{int(r1) - int(r2), int(g1) - int(g2), int(b1) - int(b2)} {
+				sum += float64(max(d, -d)) / 257
+			}
+		}
+	}
+	return sum / float64(3*ab.Dx()*ab.Dy())
+}
+
+func TestProgressiveJPEGRoundTrip(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 33, 17))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 7)
+	}
+
+	tests := []struct {
+		name  string
+		img   image.Image
+		model color.Model
+	}{
+		{name: "1x1", img: testPattern(1, 1), model: color.YCbCrModel},
+		{name: "one block", img: testPattern(8, 8), model: color.YCbCrModel},
+		{name: "one mcu", img: testPattern(16, 16), model: color.YCbCrModel},
+		{name: "odd size", img: testPattern(17, 9), model: color.YCbCrModel},
+		{name: "wide", img: testPattern(301, 7), model: color.YCbCrModel},
+		{name: "large", img: testPattern(160, 120), model: color.YCbCrModel},
+		{name: "offset bounds", img: testPattern(40, 40).SubImage(image.Rect(5, 7, 30, 33)), model: color.YCbCrModel},
+		{name: "gray", img: gray, model: color.GrayModel},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := ProgressiveJPEG(tt.img, 90)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoded, err := jpeg.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("decoding: %v", err)
+			}
+			if decoded.Bounds().Size() != tt.img.Bounds().Size() {
+				t.Fatalf("size = %v, want %v", decoded.Bounds().Size(), tt.img.Bounds().Size())
+			}
+			if decoded.ColorModel() != tt.model {
+				t.Errorf("color model = %T, want %T", decoded.ColorModel(), tt.model)
+			}
+
+			// The same tables and subsampling as the standard library's
+			// baseline encoder, so both decode to nearly the same pixels
+			var baseline bytes.Buffer
+			if err := jpeg.Encode(&baseline, tt.img, &jpeg.Options{Quality: 90}); err != nil {
+				t.Fatal(err)
+			}
+			reference, err := jpeg.Decode(&baseline)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := meanDiff(decoded, reference); d > 1.5 {
+				t.Errorf("mean difference from baseline = %.2f, want at most 1.5", d)
+			}
+			// and lose no more of the source than baseline does
+			if d, want := meanDiff(decoded, tt.img), meanDiff(reference, tt.img)+1; d > want {
+				t.Errorf("mean difference from source = %.2f, want at most %.2f", d, want)
+			}
+		})
+	}
+}
+
+func TestProgressiveJPEGMarkers(t *testing.T) {
+	tests := []struct {
+		name       string
+		img        image.Image
+		components int
+		scans      int
+	}{
+		// DC, luma 1-5, Cb, Cr, luma 6-63
+		{name: "color", img: testPattern(24, 24), components: 3, scans: 5},
+		// DC, luma 1-5, luma 6-63
+		{name: "gray", img: image.NewGray(image.Rect(0, 0, 24, 24)), components: 1, scans: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := ProgressiveJPEG(tt.img, 75)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			markers, sof, err := jpegMarkers(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if markers[0] != 0xd8 || markers[len(markers)-1] != 0xd9 {
+				t.Errorf("markers %x do not run from SOI to EOI", markers)
+			}
+
+			counts := map[byte]int{}
+			for _, m := range markers {
+				counts[m]++
+			}
+			if counts[0xc2] != 1 {
+				t.Errorf("%d SOF2 markers, want 1", counts[0xc2])
+			}
+			for _, m := range []byte{0xc0, 0xc1, 0xc3} {
+				if counts[m] != 0 {
+					t.Errorf("unexpected SOF marker %x", m)
+				}
+			}
+			if counts[0xda] != tt.scans {
+				t.Errorf("%d scans, want %d", counts[0xda], tt.scans)
+			}
+			if int(sof[5]) != tt.components {
+				t.Errorf("SOF2 declares %d components, want %d", sof[5], tt.components)
+			}
+			if width, height := int(sof[3])<<8|int(sof[4]), int(sof[1])<<8|int(sof[2]); width != 24 || height != 24 {
+				t.Errorf("SOF2 declares %dx%d, want 24x24", width, height)
+			}
+		})
+	}
+}
+
+func TestProgressiveJPEGQuality(t *testing.T) {
+	img := testPattern(64, 64)
+
+	low, err := ProgressiveJPEG(img, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	high, err := ProgressiveJPEG(img, 95)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(low) >= len(high) {
+		t.Errorf("quality 20 is %d bytes, quality 95 %d; want it smaller", len(low), len(high))
+	}
+
+	// Out of range qualities are clamped rather than rejected
+	for _, quality := range []int{0, -5, 101} {
+		if _, err := ProgressiveJPEG(img, quality); err != nil {
+			t.Errorf("quality %d: %v", quality, err)
+		}
+	}
+
+	if _, err := ProgressiveJPEG(image.NewNRGBA(image.Rect(0, 0, 0, 10)), 75); err == nil {
+		t.Error("empty image encoded without error")
+	}
+}
+
+// jpegMarkers walks the segments of a JPEG file and returns its markers in
+// order, along with the payload of the SOF2 segment. Entropy coded data
+// after each SOS is skipped up to the next marker.
+func jpegMarkers(data []byte) ([]byte, []byte, error) {
+	var markers, sof []byte
+	i := 0
+	for i+1 < len(data) {
+		if data[i] != 0xff {
+			return nil, nil, errMalformedJPEG(i)
+		}
+		m := data[i+1]
+		markers = append(markers, m)
+		i += 2
+		if m == 0xd8 || m == 0xd9 {
+			continue
+		}
+
+		if i+1 >= len(data) {
+			return nil, nil, errMalformedJPEG(i)
+		}
+		length := int(data[i])<<8 | int(data[i+1])
+		if i+length > len(data) {
+			return nil, nil, errMalformedJPEG(i)
+		}
+		if m == 0xc2 {
+			sof = data[i+2 : i+length]
+		}
+		i += length
+
+		if m == 0xda {
+			// Stuffed 0xff00 bytes and restart markers belong to the scan
+			for i+1 < len(data) && (data[i] != 0xff || data[i+1] == 0 || (data[i+1] >= 0xd0 && data[i+1] <= 0xd7)) {
+				i++
+			}
+		}
+	}
+	return markers, sof, nil
+}
+
+func errMalformedJPEG(offset int) error {
+	return fmt.Errorf("malformed JPEG at offset %d", offset)
+}
@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var errMalformedImage = errors.New("malformed image")
+
+// StripMetadata removes metadata that may leak private details, such as GPS
+// coordinates or camera information, without re-encoding the pixels. JPEGs
+// lose their EXIF/XMP (APP1), IPTC (APP13) and comment segments; PNGs lose
+// their text, EXIF and timestamp chunks. Other formats are returned as is.
+func StripMetadata(data []byte, format string) ([]byte, error) {
+	switch format {
+	case "jpg", "jpeg":
+		return stripJPEG(data)
+	case "png":
+		return stripPNG(data)
+	default:
+		return data, nil
+	}
+}
+
+func stripJPEG(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, errMalformedImage
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+
+	for i := 2; i < len(data); {
+		if data[i] != 0xff || i+1 >= len(data) {
+			return nil, errMalformedImage
+		}
+		marker := data[i+1]
+
+		// Fill bytes and markers without a length field
+		if marker == 0xff {
+			i++
+			continue
+		}
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			out.Write(data[i : i+2])
+			i += 2
+			continue
+		}
+
+		if i+4 > len(data) {
+			return nil, errMalformedImage
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) {
+			return nil, errMalformedImage
+		}
+
+		// Start of scan: the entropy-coded data that follows is kept as is
+		if marker == 0xda {
+			out.Write(data[i:])
+			break
+		}
+
+		switch marker {
+		case 0xe1, 0xed, 0xfe: // APP1, APP13, COM
+		default:
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+
+	return out.Bytes(), nil
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetadataChunks are ancillary chunks dropped by stripPNG.
+var pngMetadataChunks = map[string]bool{
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"eXIf": true,
+	"tIME": true,
+}
+
+func stripPNG(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errMalformedImage
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+
+	for i := len(pngSignature); i < len(data); {
+		if i+8 > len(data) {
+			return nil, errMalformedImage
+		}
+		// length, type, data, crc
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+		if end > len(data) || end < i {
+			return nil, errMalformedImage
+		}
+
+		if !pngMetadataChunks[string(data[i+4:i+8])] {
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+
+	return out.Bytes(), nil
+}
@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Orientation returns the EXIF orientation tag (1-8) of an image, or 1 when
+// the image carries no orientation.
+func Orientation(r io.Reader) int {
+	x, err := exif.Decode(r)
+	if err != nil {
+		return 1
+	}
+
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+
+	orientation, err := tag.Int(0)
+	if err != nil || orientation < 1 || orientation > 8 {
+		return 1
+	}
+	return orientation
+}
+
+// Orient returns img rotated and flipped so an image stored with the given
+// EXIF orientation displays upright.
+func Orient(img image.Image, orientation int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	switch orientation {
+	case 2: // mirrored horizontally
+		return remap(img, w, h, func(x, y int) (int, int) { return w - 1 - x, y })
+	case 3: // rotated 180
+		return remap(img, w, h, func(x, y int) (int, int) { return w - 1 - x, h - 1 - y })
+	case 4: // mirrored vertically
+		return remap(img, w, h, func(x, y int) (int, int) { return x, h - 1 - y })
+	case 5: // mirrored along the main diagonal
+		return remap(img, h, w, func(x, y int) (int, int) { return y, x })
+	case 6: // needs a 90 degree clockwise turn
+		return remap(img, h, w, func(x, y int) (int, int) { return y, h - 1 - x })
+	case 7: // mirrored along the anti-diagonal
+		return remap(img, h, w, func(x, y int) (int, int) { return w - 1 - y, h - 1 - x })
+	case 8: // needs a 90 degree counter-clockwise turn
+		return remap(img, h, w, func(x, y int) (int, int) { return w - 1 - y, x })
+	default:
+		return img
+	}
+}
+
+// remap builds a width x height image whose pixel (x, y) is taken from the
+// source pixel returned by from, relative to the source bounds.
+func remap(img image.Image, width, height int, from func(x, y int) (int, int)) image.Image {
+	min := img.Bounds().Min
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			sx, sy := from(x, y)
+			dst.Set(x, y, img.At(min.X+sx, min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// NormalizeOrientation re-encodes a JPEG carrying a non-default EXIF
+// orientation so its pixels are upright. The output has no EXIF segment, so
+// the now incorrect orientation tag is dropped with it. Other data is
+// returned unchanged.
+func NormalizeOrientation(data []byte, format string) ([]byte, error) {
+	if format != "jpg" && format != "jpeg" {
+		return data, nil
+	}
+
+	orientation := Orientation(bytes.NewReader(data))
+	if orientation == 1 {
+		return data, nil
+	}
+
+	if err := CheckPixels(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, Orient(img, orientation), &jpeg.Options{Quality: DefaultQuality}); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
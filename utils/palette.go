@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io/fs"
+	"sort"
+
+	"ImageServer/models"
+
+	"golang.org/x/image/draw"
+)
+
+// paletteSampleSize bounds the side of the image colors are sampled from;
+// larger images are scaled down first.
+const paletteSampleSize = 64
+
+// ImageColors decodes the image name and reports its dominant color, a
+// palette of at most n colors and whether it is predominantly dark.
+func ImageColors(fsys fs.FS, name string, n int) (*models.ImageColors, error) {
+	img, err := loadImage(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	if img == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	bounds := img.Bounds()
+	if bounds.Dx() > paletteSampleSize || bounds.Dy() > paletteSampleSize {
+		img = Resize(img, paletteSampleSize, paletteSampleSize, draw.CatmullRom)
+	}
+
+	pixels := opaquePixels(img)
+	palette := Palette(pixels, n)
+
+	result := &models.ImageColors{
+		Palette: make([]string, len(palette)),
+		Dark:    luminance(pixels) < 128,
+	}
+	for i, c := range palette {
+		result.Palette[i] = hexColor(c)
+	}
+	if len(result.Palette) > 0 {
+		result.Dominant = result.Palette[0]
+	}
+	return result, nil
+}
+
+// opaquePixels returns the colors of the mostly opaque pixels of img, or of
+// every pixel when the image is mostly transparent.
+func opaquePixels(img image.Image) []color.NRGBA {
+	bounds := img.Bounds()
+	all := make([]color.NRGBA, 0, bounds.Dx()*bounds.Dy())
+	opaque := make([]color.NRGBA, 0, bounds.Dx()*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			all = append(all, c)
+			if c.A >= 0x80 {
+				opaque = append(opaque, c)
+			}
+		}
+	}
+	if len(opaque) == 0 {
+		return all
+	}
+	return opaque
+}
+
+// Palette reduces pixels to at most n colors with median cut: the box of
+// pixels with the widest channel range is split at its median until there
+// are n boxes, and each box is averaged. Colors are ordered by how many
+// pixels they stand for, most common first. Fewer colors are returned when
+// the pixels hold fewer distinct ones.
+func Palette(pixels []color.NRGBA, n int) []color.NRGBA {
+	if len(pixels) == 0 || n < 1 {
+		return nil
+	}
+
+	boxes := [][]color.NRGBA{append([]color.NRGBA(nil), pixels...)}
+	for len(boxes) < n {
+		best, channel, spread := -1, 0, 0
+		for i, box := range boxes {
+			if c, s := widestChannel(box); s > spread {
+				best, channel, spread = i, c, s
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		box := boxes[best]
+		sort.Slice(box, func(a, b int) bool { return channelOf(box[a], channel) < channelOf(box[b], channel) })
+		mid := len(box) / 2
+		boxes[best] = box[:mid]
+		boxes = append(boxes, box[mid:])
+	}
+
+	sort.SliceStable(boxes, func(a, b int) bool { return len(boxes[a]) > len(boxes[b]) })
+
+	colors := make([]color.NRGBA, len(boxes))
+	for i, box := range boxes {
+		colors[i] = average(box)
+	}
+	return colors
+}
+
+// widestChannel returns the RGB channel with the largest range in box and
+// that range.
+func widestChannel(box []color.NRGBA) (int, int) {
+	channel, spread := 0, 0
+	for c := 0; c < 3; c++ {
+		lo, hi := 255, 0
+		for _, p := range box {
+			v := int(channelOf(p, c))
+			lo, hi = min(lo, v), max(hi, v)
+		}
+		if hi-lo > spread {
+			channel, spread = c, hi-lo
+		}
+	}
+	return channel, spread
+}
+
+func channelOf(c color.NRGBA, channel int) uint8 {
+	switch channel {
+	case 0:
+		return c.R
+	case 1:
+		return c.G
+	default:
+		return c.B
+	}
+}
+
+// average returns the mean color of box.
+func average(box []color.NRGBA) color.NRGBA {
+	var r, g, b int
+	for _, p := range box {
+		r += int(p.R)
+		g += int(p.G)
+		b += int(p.B)
+	}
+	n := len(box)
+	return color.NRGBA{uint8((r + n/2) / n), uint8((g + n/2) / n), uint8((b + n/2) / n), 0xff}
+}
+
+// luminance returns the mean ITU-R 601 luminance of pixels, from 0 to 255.
+func luminance(pixels []color.NRGBA) float64 {
+	if len(pixels) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, p := range pixels {
+		sum += 0.299*float64(p.R) + 0.587*float64(p.G) + 0.114*float64(p.B)
+	}
+	return sum / float64(len(pixels))
+}
+
+// hexColor formats c as "#rrggbb".
+func hexColor(c color.NRGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"errors"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrInvalidPath is returned by CleanName for paths that try to leave the
+// storage root.
+var ErrInvalidPath = errors.New("invalid path")
+
+// CleanName converts a user supplied path into a storage name, relative to
+// the storage root with "." naming the root itself. Paths containing ".."
+// components or volume names are rejected with ErrInvalidPath. It is the
+// one traversal check: every user supplied path goes through it before
+// reaching storage.
+func CleanName(userPath string) (string, error) {
+	if containsTraversalSequences(userPath) || filepath.VolumeName(userPath) != "" {
+		return "", ErrInvalidPath
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(userPath)), "/")
+	if name == "" {
+		return ".", nil
+	}
+	return name, nil
+}
+
+// containsTraversalSequences checks for explicit traversal sequences
+func containsTraversalSequences(path string) bool {
+	// Backslashes count as separators on every platform, since names end up
+	// in archives and URLs read by Windows clients too
+	parts := strings.FieldsFunc(path, func(r rune) bool {
+		return r == '/' || r == '\\'
+	})
+
+	// Check each component for traversal sequences
+	for _, part := range parts {
+		if part == ".." {
+			return true
+		}
+	}
+
+	return false
+}
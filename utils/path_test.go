@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCleanName(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+		err  error
+	}{
+		{path: "", want: "."},
+		{path: "/", want: "."},
+		{path: "a.png", want: "a.png"},
+		{path: "/a/b.png", want: "a/b.png"},
+		{path: "a//b/./c.png", want: "a/b/c.png"},
+		{path: "a/b/", want: "a/b"},
+		{path: `a\b.png`, want: `a\b.png`},
+		{path: "..", err: ErrInvalidPath},
+		{path: "../a.png", err: ErrInvalidPath},
+		{path: "a/../b.png", err: ErrInvalidPath},
+		{path: "/a/b/..", err: ErrInvalidPath},
+		{path: "a/..hidden.png", want: "a/..hidden.png"},
+		{path: `..\a.png`, err: ErrInvalidPath},
+		{path: `a\..\..\b.png`, err: ErrInvalidPath},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := CleanName(tt.path)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("CleanName(%q) error = %v, want %v", tt.path, err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("CleanName(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"errors"
+	"image"
+	"io"
+)
+
+// MaxPixels is the largest width × height that is decoded. Larger images are
+// rejected from their header with ErrTooManyPixels before any pixel data is
+// read, so a small file cannot claim gigapixel dimensions and exhaust
+// memory. 0 disables the check. It is set once at startup.
+var MaxPixels int64
+
+// ErrTooManyPixels is returned for images whose dimensions exceed MaxPixels.
+var ErrTooManyPixels = errors.New("image dimensions exceed the pixel limit")
+
+// CheckPixels reads the image header from r and returns ErrTooManyPixels
+// when the image is larger than MaxPixels. Headers that cannot be read are
+// left to the decoder to report. r is rewound when it can seek.
+func CheckPixels(r io.Reader) error {
+	if MaxPixels <= 0 {
+		return nil
+	}
+
+	cfg, _, err := image.DecodeConfig(r)
+	if seeker, ok := r.(io.Seeker); ok {
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return nil
+	}
+
+	if int64(cfg.Width)*int64(cfg.Height) > MaxPixels {
+		return ErrTooManyPixels
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"image"
+	"image/draw"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
+
+	"ImageServer/models"
+	"ImageServer/storage"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// BuildSprite packs the images names of fsys, each scaled to fit a
+// size×size cell, into a grid cols cells wide. Images that cannot be decoded
+// are left out rather than failing the whole sheet; only ctx ending does.
+func BuildSprite(ctx context.Context, fsys fs.FS, names []string, cols, size int, interp xdraw.Interpolator) (image.Image, *models.Sprite, error) {
+	sprite := &models.Sprite{Cols: cols, Size: size, Tiles: map[string]models.SpriteTile{}}
+
+	// Tiles are scaled as they are decoded so only one original is held in
+	// memory at a time
+	type tile struct {
+		name string
+		img  image.Image
+	}
+	tiles := make([]tile, 0, len(names))
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		img, err := loadCachedImage(ctx, fsys, nil, name)
+		if err != nil || img == nil {
+			slog.Warn("Skipping image in sprite", "path", name, "error", err)
+			continue
+		}
+		tiles = append(tiles, tile{path.Base(name), Scale(img, size, interp)})
+	}
+
+	gridCols := min(cols, len(tiles))
+	rows := (len(tiles) + cols - 1) / cols
+	sprite.Width, sprite.Height = gridCols*size, rows*size
+
+	sheet := image.NewRGBA(image.Rect(0, 0, sprite.Width, sprite.Height))
+	for i, t := range tiles {
+		bounds := t.img.Bounds()
+		at := image.Pt(i%cols*size, i/cols*size)
+		draw.Draw(sheet, bounds.Sub(bounds.Min).Add(at), t.img, bounds.Min, draw.Src)
+		sprite.Tiles[t.name] = models.SpriteTile{X: at.X, Y: at.Y, W: bounds.Dx(), H: bounds.Dy()}
+	}
+
+	return sheet, sprite, nil
+}
+
+// SaveSprite stores a sprite sheet as the PNG imageName and its tile map as
+// the JSON mapName. The map is written last, so a reader that finds it can
+// rely on the sheet being there too.
+func SaveSprite(ctx context.Context, s storage.Storage, imageName, mapName string, sheet image.Image, sprite *models.Sprite) error {
+	if err := save(ctx, s, imageName, sheet, "png", EncodeOptions{}); err != nil {
+		return err
+	}
+	return writeFile(ctx, s, mapName, func(w io.Writer) error { return json.NewEncoder(w).Encode(sprite) })
+}
@@ -0,0 +1,305 @@
+package utils
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Gravities lists the anchors a crop can be aligned to.
+var Gravities = []string{"center", "north", "south", "east", "west"}
+
+// Interpolators maps the names accepted for interp to the scaler they
+// select, from fastest and blockiest to slowest and smoothest.
+var Interpolators = map[string]draw.Interpolator{
+	"nearest":        draw.NearestNeighbor,
+	"approxbilinear": draw.ApproxBiLinear,
+	"bilinear":       draw.BiLinear,
+	"catmullrom":     draw.CatmullRom,
+}
+
+// DefaultInterpolator is used when a variant does not pick one.
+const DefaultInterpolator = "catmullrom"
+
+// Rotations lists the clockwise turns in degrees a variant can apply.
+var Rotations = []int{90, 180, 270}
+
+// Flips lists the axes a variant can mirror along: "h" swaps left and right,
+// "v" top and bottom.
+var Flips = []string{"h", "v"}
+
+// Variant describes how a stored image is transformed before it is served.
+type Variant struct {
+	// Name selects the operation, e.g. "preview" or "crop".
+	Name string
+	// Width and Height are the target box for sized operations.
+	Width  int
+	Height int
+	// Gravity anchors a crop inside the scaled image.
+	Gravity string
+	// Grayscale converts the result to shades of gray. It composes with the
+	// named operation.
+	Grayscale bool
+	// BlurRadius applies a blur of the given radius in pixels when non-zero.
+	// It composes with the named operation.
+	BlurRadius int
+	// DPR is the device pixel ratio Width and Height were multiplied by.
+	DPR int
+	// Interp names the entry of Interpolators used to scale; empty means
+	// DefaultInterpolator.
+	Interp string
+	// Rotate turns the image clockwise by 90, 180 or 270 degrees and Flip
+	// mirrors it along "h" or "v". Both happen before the named operation,
+	// so Width and Height apply to the turned image.
+	Rotate int
+	Flip   string
+	// Tint multiplies every pixel by the color when it is opaque; the zero
+	// value leaves colors alone. It composes with the named operation.
+	Tint color.NRGBA
+	// Watermark is drawn over the finished image at WatermarkPosition with
+	// WatermarkOpacity (0 to 1) when set.
+	Watermark         *Watermark
+	WatermarkPosition string
+	WatermarkOpacity  float64
+}
+
+// Key returns the fragment used in cached variant filenames, or "" when no
+// variant is requested. Every parameter that changes the output is part of
+// the key so different requests never share a cache file.
+func (v Variant) Key() string {
+	var parts []string
+	if v.Rotate != 0 {
+		parts = append(parts, fmt.Sprintf("rot%d", v.Rotate))
+	}
+	if v.Flip != "" {
+		parts = append(parts, "flip"+v.Flip)
+	}
+	switch v.Name {
+	case "":
+	case "crop":
+		parts = append(parts, fmt.Sprintf("crop-%dx%d-%s", v.Width, v.Height, v.Gravity))
+	case "resize":
+		parts = append(parts, fmt.Sprintf("resize-%dx%d", v.Width, v.Height))
+	case "identicon":
+		parts = append(parts, fmt.Sprintf("identicon-%d", v.Width))
+	default:
+		parts = append(parts, v.Name)
+	}
+	if v.Grayscale {
+		parts = append(parts, "gray")
+	}
+	if v.Tint.A != 0 {
+		parts = append(parts, fmt.Sprintf("tint%02x%02x%02x", v.Tint.R, v.Tint.G, v.Tint.B))
+	}
+	if v.BlurRadius > 0 {
+		parts = append(parts, fmt.Sprintf("blur%d", v.BlurRadius))
+	}
+	if v.DPR > 1 {
+		parts = append(parts, fmt.Sprintf("dpr%d", v.DPR))
+	}
+	// The interpolator only changes the output of operations that scale
+	if v.scales() && v.Interp != "" && v.Interp != DefaultInterpolator {
+		parts = append(parts, v.Interp)
+	}
+	if v.Watermark != nil {
+		parts = append(parts, fmt.Sprintf("wm%s-%s-%g", v.Watermark.ID, v.WatermarkPosition, v.WatermarkOpacity))
+	}
+	return strings.Join(parts, "-")
+}
+
+// scales reports whether the named operation resamples the image.
+func (v Variant) scales() bool {
+	return v.Name == "preview" || v.Name == "crop" || v.Name == "resize"
+}
+
+// interpolator returns the scaler selected by Interp.
+func (v Variant) interpolator() draw.Interpolator {
+	if interp, ok := Interpolators[v.Interp]; ok {
+		return interp
+	}
+	return Interpolators[DefaultInterpolator]
+}
+
+// Resize scales img to fit inside a width x height box, keeping the aspect
+// ratio. A zero width or height is derived from the other side.
+func Resize(img image.Image, width, height int, interp draw.Interpolator) image.Image {
+	bounds := img.Bounds()
+	srcW := bounds.Dx()
+	srcH := bounds.Dy()
+
+	scale := float64(width) / float64(srcW)
+	if width == 0 || (height != 0 && float64(height)/float64(srcH) < scale) {
+		scale = float64(height) / float64(srcH)
+	}
+
+	newW := max(int(float64(srcW)*scale+0.5), 1)
+	newH := max(int(float64(srcH)*scale+0.5), 1)
+
+	dst := image.NewRGBA(image.Rect(0, 0, newW, newH))
+	resample(dst, img, interp)
+	return dst
+}
+
+// Crop scales img to cover a width x height box and cuts the box out,
+// anchored according to gravity.
+func Crop(img image.Image, width, height int, gravity string, interp draw.Interpolator) image.Image {
+	bounds := img.Bounds()
+	srcW := bounds.Dx()
+	srcH := bounds.Dy()
+
+	// Cover scale: the smaller ratio side fills the box exactly
+	scale := max(float64(width)/float64(srcW), float64(height)/float64(srcH))
+	scaledW := max(width, int(float64(srcW)*scale+0.5))
+	scaledH := max(height, int(float64(srcH)*scale+0.5))
+
+	scaled := image.NewRGBA(image.Rect(0, 0, scaledW, scaledH))
+	resample(scaled, img, interp)
+
+	x := (scaledW - width) / 2
+	y := (scaledH - height) / 2
+	switch gravity {
+	case "north":
+		y = 0
+	case "south":
+		y = scaledH - height
+	case "west":
+		x = 0
+	case "east":
+		x = scaledW - width
+	}
+
+	return scaled.SubImage(image.Rect(x, y, x+width, y+height))
+}
+
+// Rotate turns img clockwise by degrees, which must be a multiple of 90.
+func Rotate(img image.Image, degrees int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	switch (degrees%360 + 360) % 360 {
+	case 90:
+		return remap(img, h, w, func(x, y int) (int, int) { return y, h - 1 - x })
+	case 180:
+		return remap(img, w, h, func(x, y int) (int, int) { return w - 1 - x, h - 1 - y })
+	case 270:
+		return remap(img, h, w, func(x, y int) (int, int) { return w - 1 - y, x })
+	default:
+		return img
+	}
+}
+
+// Flip mirrors img horizontally for "h" and vertically for "v".
+func Flip(img image.Image, axis string) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	switch axis {
+	case "h":
+		return remap(img, w, h, func(x, y int) (int, int) { return w - 1 - x, y })
+	case "v":
+		return remap(img, w, h, func(x, y int) (int, int) { return x, h - 1 - y })
+	default:
+		return img
+	}
+}
+
+// Grayscale converts img using ITU-R 601 luminance weights. Opaque images
+// become image.Gray; images with transparency keep their alpha channel.
+func Grayscale(img image.Image) image.Image {
+	bounds := img.Bounds()
+
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		dst := image.NewGray(bounds)
+		draw.Draw(dst, bounds, img, bounds.Min, draw.Src)
+		return dst
+	}
+
+	dst := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			gray := color.GrayModel.Convert(color.RGBA{c.R, c.G, c.B, 0xff}).(color.Gray)
+			dst.SetNRGBA(x, y, color.NRGBA{gray.Y, gray.Y, gray.Y, c.A})
+		}
+	}
+	return dst
+}
+
+// ParseHexColor parses an opaque color written as six hex digits, e.g.
+// "ff8800".
+func ParseHexColor(s string) (color.NRGBA, error) {
+	if len(s) != 6 {
+		return color.NRGBA{}, errors.New("color must be six hex digits")
+	}
+	rgb, err := hex.DecodeString(s)
+	if err != nil {
+		return color.NRGBA{}, errors.New("color must be six hex digits")
+	}
+	return color.NRGBA{R: rgb[0], G: rgb[1], B: rgb[2], A: 0xff}, nil
+}
+
+// Tint multiplies each channel of img by c, keeping the alpha channel. A
+// white icon becomes c and darker shades scale towards black, which is how
+// monochrome icons are recolored.
+func Tint(img image.Image, c color.NRGBA) image.Image {
+	bounds := img.Bounds()
+	dst := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			p := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			dst.SetNRGBA(x, y, color.NRGBA{multiply(p.R, c.R), multiply(p.G, c.G), multiply(p.B, c.B), p.A})
+		}
+	}
+	return dst
+}
+
+// multiply scales a by b as if both were fractions of 255.
+func multiply(a, b uint8) uint8 {
+	return uint8((uint16(a)*uint16(b) + 127) / 255)
+}
+
+// Blur approximates a Gaussian blur of the given radius with three passes of
+// a box blur.
+func Blur(img image.Image, radius int) image.Image {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+
+	tmp := make([]uint8, len(dst.Pix))
+	for range 3 {
+		boxBlur(tmp, dst.Pix, dst.Rect.Dx(), dst.Rect.Dy(), radius, 4, dst.Stride)
+		boxBlur(dst.Pix, tmp, dst.Rect.Dy(), dst.Rect.Dx(), radius, dst.Stride, 4)
+	}
+	return dst
+}
+
+// boxBlur averages each pixel with its neighbours along one axis. A line of
+// length n is walked with step, and lines are stride apart, so the same code
+// blurs rows and columns.
+func boxBlur(dst, src []uint8, n, lines, radius, step, stride int) {
+	window := 2*radius + 1
+	for line := 0; line < lines; line++ {
+		base := line * stride
+		for channel := 0; channel < 4; channel++ {
+			at := func(i int) int {
+				// Clamp to the edge pixel
+				i = min(max(i, 0), n-1)
+				return int(src[base+i*step+channel])
+			}
+
+			sum := 0
+			for i := -radius; i <= radius; i++ {
+				sum += at(i)
+			}
+			for i := 0; i < n; i++ {
+				dst[base+i*step+channel] = uint8(sum / window)
+				sum += at(i+radius+1) - at(i-radius)
+			}
+		}
+	}
+}
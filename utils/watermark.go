@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"os"
+
+	"golang.org/x/image/draw"
+)
+
+// WatermarkPositions lists where a watermark can be placed.
+var WatermarkPositions = []string{"top-left", "top-right", "bottom-left", "bottom-right", "center"}
+
+// Watermark is an image composited onto variants.
+type Watermark struct {
+	image.Image
+	// ID is derived from the file content. It is part of the cache key so
+	// replacing the watermark does not keep serving the old one.
+	ID string
+}
+
+// LoadWatermark reads and decodes the watermark image at path.
+func LoadWatermark(path string) (*Watermark, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	return &Watermark{Image: img, ID: hex.EncodeToString(sum[:4])}, nil
+}
+
+// ApplyWatermark draws wm over img at position with the given opacity,
+// blending through the watermark's own alpha. The watermark keeps its size,
+// inset by a small margin, unless it is larger than img, in which case it is
+// scaled down to fit.
+func ApplyWatermark(img image.Image, wm image.Image, position string, opacity float64) image.Image {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+
+	w, h := dst.Rect.Dx(), dst.Rect.Dy()
+	margin := min(w, h) / 50
+
+	mark := wm
+	markW, markH := wm.Bounds().Dx(), wm.Bounds().Dy()
+	if markW > w-2*margin || markH > h-2*margin {
+		scale := min(float64(w-2*margin)/float64(markW), float64(h-2*margin)/float64(markH))
+		scaled := image.NewRGBA(image.Rect(0, 0, max(int(float64(markW)*scale), 1), max(int(float64(markH)*scale), 1)))
+		resample(scaled, wm, draw.CatmullRom)
+		mark = scaled
+		markW, markH = scaled.Rect.Dx(), scaled.Rect.Dy()
+	}
+
+	x, y := w-markW-margin, h-markH-margin
+	switch position {
+	case "top-left":
+		x, y = margin, margin
+	case "top-right":
+		y = margin
+	case "bottom-left":
+		x = margin
+	case "center":
+		x, y = (w-markW)/2, (h-markH)/2
+	}
+
+	mask := image.NewUniform(color.Alpha{A: uint8(opacity*255 + 0.5)})
+	draw.DrawMask(dst, image.Rect(x, y, x+markW, y+markH), mark, mark.Bounds().Min, mask, image.Point{}, draw.Over)
+	return dst
+}